@@ -0,0 +1,24 @@
+package common
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"otel-mock/config"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// BoundedAttr returns an attribute for a potentially high-cardinality value
+// such as a user ID. With ATTR_CARDINALITY_LIMIT unset the value is kept as
+// is; otherwise it is replaced by a stable "<key>.bucket" attribute holding
+// one of that many hash buckets, so backends index a bounded set of values.
+func BoundedAttr(key, value string) attribute.KeyValue {
+	limit := config.AttrCardinalityLimit
+	if limit <= 0 {
+		return attribute.String(key, value)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return attribute.String(key+".bucket", fmt.Sprintf("bucket-%d", h.Sum32()%uint32(limit)))
+}
@@ -0,0 +1,47 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+
+	"otel-mock/config"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestBoundedAttrKeepsValueWithoutLimit(t *testing.T) {
+	setForTest(t, &config.AttrCardinalityLimit, 0)
+
+	if got, want := BoundedAttr("app.user.id", "user-42"), attribute.String("app.user.id", "user-42"); got != want {
+		t.Fatalf("BoundedAttr = %v, want %v", got, want)
+	}
+}
+
+func TestBoundedAttrBucketsAreStable(t *testing.T) {
+	setForTest(t, &config.AttrCardinalityLimit, 10)
+
+	first := BoundedAttr("app.user.id", "user-42")
+	if first.Key != "app.user.id.bucket" {
+		t.Fatalf("key = %s, want app.user.id.bucket", first.Key)
+	}
+	for range 5 {
+		if again := BoundedAttr("app.user.id", "user-42"); again != first {
+			t.Fatalf("same user bucketed as %v then %v", first, again)
+		}
+	}
+}
+
+func TestBoundedAttrStaysWithinLimit(t *testing.T) {
+	setForTest(t, &config.AttrCardinalityLimit, 10)
+
+	buckets := map[string]bool{}
+	for i := range 1000 {
+		buckets[BoundedAttr("app.user.id", fmt.Sprintf("user-%d", i)).Value.AsString()] = true
+	}
+	if len(buckets) > 10 {
+		t.Fatalf("%d distinct buckets for 1000 users, want at most 10", len(buckets))
+	}
+	if len(buckets) < 2 {
+		t.Fatalf("1000 users all landed in %v, want them spread across buckets", buckets)
+	}
+}
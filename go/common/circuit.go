@@ -0,0 +1,189 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"otel-mock/config"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrCircuitOpen is returned for requests short-circuited by an open breaker
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitState is the state of a CircuitBreaker
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker trips open after a run of consecutive failures and rejects
+// calls until the cooldown has passed. It then lets a single probe through
+// (half-open): success closes the circuit, failure opens it again.
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	state     CircuitState
+	failures  int
+	openedAt  time.Time
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+}
+
+// NewCircuitBreaker creates a closed breaker that trips after threshold
+// consecutive failures and stays open for cooldown
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// State returns the current state, moving an expired open circuit to half-open
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.checkCooldown()
+	return cb.state
+}
+
+// Allow reports whether a call may proceed, and the state it was admitted in.
+// Only one probe is admitted while half-open.
+func (cb *CircuitBreaker) Allow() (CircuitState, bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.checkCooldown()
+
+	switch cb.state {
+	case CircuitOpen:
+		return cb.state, false
+	case CircuitHalfOpen:
+		// Re-open until the probe reports back so concurrent calls fail fast
+		cb.state = CircuitOpen
+		cb.openedAt = cb.now()
+		return CircuitHalfOpen, true
+	default:
+		return cb.state, true
+	}
+}
+
+// Record reports the outcome of an admitted call and returns true if this
+// failure tripped the circuit open. Only the half-open probe can close an
+// open circuit; a late success from a call admitted while closed is ignored
+// once the circuit has tripped.
+func (cb *CircuitBreaker) Record(success bool, admittedIn CircuitState) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if success {
+		switch {
+		case admittedIn == CircuitHalfOpen:
+			cb.state = CircuitClosed
+			cb.failures = 0
+		case cb.state == CircuitClosed:
+			cb.failures = 0
+		}
+		return false
+	}
+
+	if admittedIn == CircuitHalfOpen {
+		cb.state = CircuitOpen
+		cb.openedAt = cb.now()
+		return true
+	}
+
+	cb.failures++
+	if cb.state == CircuitClosed && cb.failures >= cb.threshold {
+		cb.state = CircuitOpen
+		cb.openedAt = cb.now()
+		return true
+	}
+	return false
+}
+
+func (cb *CircuitBreaker) checkCooldown() {
+	if cb.state == CircuitOpen && cb.now().Sub(cb.openedAt) >= cb.cooldown {
+		cb.state = CircuitHalfOpen
+	}
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = map[string]*CircuitBreaker{}
+)
+
+// breakerFor returns the shared breaker for a target, so every client in the
+// process sees the same state for a given downstream
+func breakerFor(target string) *CircuitBreaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	cb, ok := breakers[target]
+	if !ok {
+		cb = NewCircuitBreaker(config.CircuitFailureThreshold, config.CircuitCooldown)
+		breakers[target] = cb
+	}
+	return cb
+}
+
+// newCircuitTrips creates the app.circuit.trips counter on mp, so trips are
+// reported by the service whose client saw them
+func newCircuitTrips(mp metric.MeterProvider) metric.Int64Counter {
+	trips, err := mp.Meter("circuit-breaker").Int64Counter("app.circuit.trips",
+		metric.WithDescription("Number of times a circuit breaker tripped open"),
+		metric.WithUnit("{trips}"))
+	if err != nil {
+		panic(err)
+	}
+	return trips
+}
+
+// circuitTransport guards each downstream (scheme + host) with a breaker.
+// Connection errors and 5xx responses count as failures.
+type circuitTransport struct {
+	base  http.RoundTripper
+	trips metric.Int64Counter
+}
+
+func (t *circuitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	target := req.URL.Scheme + "://" + req.URL.Host
+	cb := breakerFor(target)
+
+	state, ok := cb.Allow()
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("app.circuit.state", state.String()))
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrCircuitOpen, target)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	success := err == nil && resp.StatusCode < http.StatusInternalServerError
+	if cb.Record(success, state) {
+		span.AddEvent("circuit_tripped", trace.WithAttributes(
+			attribute.String("app.circuit.target", target),
+		))
+		t.trips.Add(ctx, 1, metric.WithAttributes(attribute.String("app.circuit.target", target)))
+	}
+	return resp, err
+}
@@ -0,0 +1,140 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"otel-mock/config"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// fakeClock lets tests move a breaker past its cooldown without sleeping
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestBreaker(threshold int) (*CircuitBreaker, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	cb := NewCircuitBreaker(threshold, time.Second)
+	cb.now = clock.now
+	return cb, clock
+}
+
+func fail(t *testing.T, cb *CircuitBreaker) bool {
+	t.Helper()
+	state, ok := cb.Allow()
+	if !ok {
+		t.Fatalf("call rejected in state %s", state)
+	}
+	return cb.Record(false, state)
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	cb, clock := newTestBreaker(3)
+
+	if fail(t, cb) || fail(t, cb) {
+		t.Fatal("tripped before reaching the threshold")
+	}
+	if cb.State() != CircuitClosed {
+		t.Fatalf("state = %s, want closed", cb.State())
+	}
+	if !fail(t, cb) {
+		t.Fatal("third failure did not trip the circuit")
+	}
+	if _, ok := cb.Allow(); ok || cb.State() != CircuitOpen {
+		t.Fatalf("open circuit admitted a call (state %s)", cb.State())
+	}
+
+	clock.advance(time.Second)
+	if cb.State() != CircuitHalfOpen {
+		t.Fatalf("state after cooldown = %s, want half-open", cb.State())
+	}
+	state, ok := cb.Allow()
+	if !ok || state != CircuitHalfOpen {
+		t.Fatalf("probe admitted=%v in %s, want admitted in half-open", ok, state)
+	}
+	if _, ok := cb.Allow(); ok {
+		t.Fatal("second call admitted while the probe is in flight")
+	}
+
+	// A failed probe re-opens the circuit for another cooldown
+	if !cb.Record(false, state) || cb.State() != CircuitOpen {
+		t.Fatalf("failed probe left state %s, want open", cb.State())
+	}
+
+	clock.advance(time.Second)
+	state, _ = cb.Allow()
+	cb.Record(true, state)
+	if cb.State() != CircuitClosed {
+		t.Fatalf("state after successful probe = %s, want closed", cb.State())
+	}
+}
+
+func TestCircuitBreakerSuccessResetsFailureRun(t *testing.T) {
+	cb, _ := newTestBreaker(2)
+
+	fail(t, cb)
+	state, _ := cb.Allow()
+	cb.Record(true, state)
+	if fail(t, cb) {
+		t.Fatal("failure count was not reset by the success in between")
+	}
+}
+
+func TestCircuitBreakerIgnoresLateClosedSuccess(t *testing.T) {
+	cb, _ := newTestBreaker(1)
+
+	// A slow call is admitted while closed, then another call trips the circuit
+	slow, _ := cb.Allow()
+	if !fail(t, cb) {
+		t.Fatal("failure did not trip the circuit")
+	}
+
+	cb.Record(true, slow)
+	if cb.State() != CircuitOpen {
+		t.Fatalf("late success moved the breaker to %s, want it to stay open", cb.State())
+	}
+}
+
+func TestCircuitTripIsCountedOnClientMeterProvider(t *testing.T) {
+	setForTest(t, &config.CircuitFailureThreshold, 2)
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	tp, _ := newTestTracerProvider(t)
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer down.Close()
+
+	client := NewHTTPClient(tp, mp)
+	for range 3 {
+		if resp, err := client.Get(down.URL); err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	var trips []metricdata.DataPoint[int64]
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == "app.circuit.trips" {
+				trips = m.Data.(metricdata.Sum[int64]).DataPoints
+			}
+		}
+	}
+	if len(trips) != 1 || trips[0].Value != 1 {
+		t.Fatalf("app.circuit.trips = %+v, want one trip", trips)
+	}
+	if target, _ := trips[0].Attributes.Value("app.circuit.target"); target.AsString() != down.URL {
+		t.Fatalf("trip target = %q, want %s", target.AsString(), down.URL)
+	}
+}
@@ -0,0 +1,46 @@
+package common
+
+import (
+	"net/http"
+
+	"otel-mock/config"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewHTTPClient creates an HTTP client that traces outgoing requests with tp,
+// records client and circuit breaker metrics on mp and propagates context
+// using the global propagator. Requests go through a per-downstream circuit
+// breaker and carry the context's X-Request-Id. Extra otelhttp options (e.g.
+// otelhttp.WithPropagators) are applied after the defaults.
+func NewHTTPClient(tp trace.TracerProvider, mp metric.MeterProvider, opts ...otelhttp.Option) *http.Client {
+	opts = append([]otelhttp.Option{
+		otelhttp.WithTracerProvider(tp),
+		otelhttp.WithMeterProvider(mp),
+		otelhttp.WithPropagators(otel.GetTextMapPropagator()),
+	}, opts...)
+
+	circuit := &circuitTransport{base: newPooledTransport(), trips: newCircuitTrips(mp)}
+	return &http.Client{
+		Timeout:   config.HTTPClientTimeout,
+		Transport: otelhttp.NewTransport(&requestIDTransport{base: circuit}, opts...),
+	}
+}
+
+// newPooledTransport clones http.DefaultTransport with the connection pool
+// limits from HTTP_MAX_IDLE_CONNS_PER_HOST and HTTP_MAX_CONNS_PER_HOST;
+// zero keeps the default for each
+func newPooledTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if config.HTTPMaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = config.HTTPMaxIdleConnsPerHost
+		t.MaxIdleConns = max(t.MaxIdleConns, config.HTTPMaxIdleConnsPerHost)
+	}
+	if config.HTTPMaxConnsPerHost > 0 {
+		t.MaxConnsPerHost = config.HTTPMaxConnsPerHost
+	}
+	return t
+}
@@ -0,0 +1,70 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"otel-mock/config"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestNewHTTPClientTracesWithOtelhttp(t *testing.T) {
+	setForTest(t, &config.HTTPClientTimeout, 5*time.Second)
+	tp, sr := newTestTracerProvider(t)
+
+	client := NewHTTPClient(tp, metricnoop.NewMeterProvider())
+	if _, ok := client.Transport.(*otelhttp.Transport); !ok {
+		t.Fatalf("transport is %T, want *otelhttp.Transport", client.Transport)
+	}
+	if client.Timeout != 5*time.Second {
+		t.Fatalf("timeout = %v, want HTTP_CLIENT_TIMEOUT", client.Timeout)
+	}
+
+	// An explicit propagator option wins over the global one
+	var traceparent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer srv.Close()
+	resp, err := NewHTTPClient(tp, metricnoop.NewMeterProvider(), otelhttp.WithPropagators(propagation.TraceContext{})).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	span := sr.Ended()[0]
+	if span.SpanKind() != trace.SpanKindClient || traceparent == "" {
+		t.Fatalf("request made a %v span with traceparent %q, want a client span propagated downstream", span.SpanKind(), traceparent)
+	}
+}
+
+func TestPooledTransportUsesConfiguredLimits(t *testing.T) {
+	setForTest(t, &config.HTTPMaxIdleConnsPerHost, 256)
+	setForTest(t, &config.HTTPMaxConnsPerHost, 64)
+
+	tr := newPooledTransport()
+	if tr.MaxIdleConnsPerHost != 256 || tr.MaxConnsPerHost != 64 {
+		t.Fatalf("transport allows %d idle and %d total conns per host, want 256 and 64", tr.MaxIdleConnsPerHost, tr.MaxConnsPerHost)
+	}
+	// The overall idle pool must not cap the per-host one
+	if tr.MaxIdleConns < 256 {
+		t.Fatalf("MaxIdleConns = %d, want at least the per-host 256", tr.MaxIdleConns)
+	}
+}
+
+func TestPooledTransportKeepsDefaultsWhenUnset(t *testing.T) {
+	setForTest(t, &config.HTTPMaxIdleConnsPerHost, 0)
+	setForTest(t, &config.HTTPMaxConnsPerHost, 0)
+
+	tr := newPooledTransport()
+	def := http.DefaultTransport.(*http.Transport)
+	if tr.MaxIdleConnsPerHost != def.MaxIdleConnsPerHost || tr.MaxConnsPerHost != def.MaxConnsPerHost || tr.MaxIdleConns != def.MaxIdleConns {
+		t.Fatalf("transport limits = %d/%d/%d, want http.DefaultTransport's", tr.MaxIdleConnsPerHost, tr.MaxConnsPerHost, tr.MaxIdleConns)
+	}
+}
@@ -0,0 +1,82 @@
+package common
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"otel-mock/config"
+
+	otellog "go.opentelemetry.io/otel/log"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+)
+
+// startCollector starts a gRPC server that accepts any call and reports the
+// grpc-encoding each one was sent with, pointing the OTLP exporters at it
+func startCollector(t *testing.T) <-chan string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodings := make(chan string, 10)
+	srv := grpc.NewServer(grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+		// grpc-encoding never reaches the metadata; the transport stream
+		// keeps it for decompressing the request
+		ts, _ := grpc.ServerTransportStreamFromContext(stream.Context()).(interface{ RecvCompress() string })
+		if ts == nil {
+			t.Error("transport stream does not report its encoding")
+			encodings <- ""
+			return nil
+		}
+		encodings <- ts.RecvCompress()
+		return nil
+	}))
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://"+lis.Addr().String())
+	return encodings
+}
+
+func TestOTLPSpanExportCompression(t *testing.T) {
+	for _, tc := range []struct {
+		compression  string
+		wantEncoding string
+	}{
+		{compression: "gzip", wantEncoding: "gzip"},
+		{compression: "none", wantEncoding: ""},
+		{compression: "", wantEncoding: ""},
+	} {
+		t.Run("compression="+tc.compression, func(t *testing.T) {
+			encodings := startCollector(t)
+			setForTest(t, &config.TelemetryExporter, "otlp")
+			setForTest(t, &config.OTLPCompression, tc.compression)
+
+			exporter := spanExporters(context.Background())[0]
+			defer exporter.Shutdown(context.Background())
+			spans := tracetest.SpanStubs{{Name: "PlaceOrder"}}.Snapshots()
+			// The stub collector sends no response, so the export itself fails
+			exporter.ExportSpans(context.Background(), spans)
+
+			if got := <-encodings; got != tc.wantEncoding {
+				t.Fatalf("grpc-encoding = %q, want %q", got, tc.wantEncoding)
+			}
+		})
+	}
+}
+
+func TestOTLPLogExportCompression(t *testing.T) {
+	encodings := startCollector(t)
+	setForTest(t, &config.OTLPCompression, "gzip")
+
+	lp := initLoggerProvider(context.Background(), sdkresource.Empty())
+	defer lp.Shutdown(context.Background())
+	lp.Logger("checkout").Emit(context.Background(), otellog.Record{})
+	lp.ForceFlush(context.Background())
+
+	if got := <-encodings; got != "gzip" {
+		t.Fatalf("grpc-encoding = %q, want gzip", got)
+	}
+}
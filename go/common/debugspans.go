@@ -0,0 +1,82 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"otel-mock/config"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+// DebugSpan is a finished span as shown by GET /debug/spans
+type DebugSpan struct {
+	Service    string  `json:"service"`
+	Name       string  `json:"name"`
+	TraceID    string  `json:"trace_id"`
+	DurationMs float64 `json:"duration_ms"`
+	Status     string  `json:"status"`
+	EndTime    string  `json:"end_time"`
+}
+
+// spanRing keeps the last len(buf) finished spans
+type spanRing struct {
+	mu   sync.Mutex
+	buf  []DebugSpan
+	next int
+	full bool
+}
+
+func (r *spanRing) add(s DebugSpan) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buf[r.next] = s
+	r.next = (r.next + 1) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// snapshot returns the recorded spans, oldest first
+func (r *spanRing) snapshot() []DebugSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]DebugSpan{}, r.buf[:r.next]...)
+	}
+	return append(append([]DebugSpan{}, r.buf[r.next:]...), r.buf[:r.next]...)
+}
+
+// debugSpans is shared by every tracer provider in the process, so in "all"
+// mode one endpoint shows spans from every service
+var debugSpans = &spanRing{buf: make([]DebugSpan, max(config.DebugSpansSize, 1))}
+
+// debugSpanProcessor records finished spans into debugSpans
+type debugSpanProcessor struct{}
+
+func (debugSpanProcessor) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+
+func (debugSpanProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	service, _ := s.Resource().Set().Value(semconv.ServiceNameKey)
+	debugSpans.add(DebugSpan{
+		Service:    service.AsString(),
+		Name:       s.Name(),
+		TraceID:    s.SpanContext().TraceID().String(),
+		DurationMs: float64(s.EndTime().Sub(s.StartTime()).Microseconds()) / 1000,
+		Status:     s.Status().Code.String(),
+		EndTime:    s.EndTime().Format(time.RFC3339Nano),
+	})
+}
+
+func (debugSpanProcessor) Shutdown(context.Context) error   { return nil }
+func (debugSpanProcessor) ForceFlush(context.Context) error { return nil }
+
+// debugSpansHandler serves the recorded spans as a JSON array, oldest first
+func debugSpansHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(debugSpans.snapshot())
+}
@@ -0,0 +1,67 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"otel-mock/config"
+
+	"go.opentelemetry.io/otel/codes"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+func TestDebugSpansServesRecentSpans(t *testing.T) {
+	setForTest(t, &config.DebugSpans, true)
+	setForTest(t, &debugSpans, &spanRing{buf: make([]DebugSpan, 3)})
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithResource(sdkresource.NewSchemaless(semconv.ServiceName("cart"))),
+		sdktrace.WithSpanProcessor(debugSpanProcessor{}),
+	)
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+
+	for _, name := range []string{"first", "second", "third"} {
+		_, span := tp.Tracer("test").Start(context.Background(), name)
+		span.End()
+	}
+	_, failed := tp.Tracer("test").Start(context.Background(), "failed")
+	failed.SetStatus(codes.Error, "boom")
+	failed.End()
+
+	rec := httptest.NewRecorder()
+	NewServer(":0", http.NotFoundHandler()).Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/spans", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/debug/spans returned %d, want 200", rec.Code)
+	}
+	var spans []DebugSpan
+	if err := json.NewDecoder(rec.Body).Decode(&spans); err != nil {
+		t.Fatal(err)
+	}
+
+	// The ring holds three, so the oldest span has been dropped
+	var names []string
+	for _, s := range spans {
+		names = append(names, s.Name)
+		if s.Service != "cart" || len(s.TraceID) != 32 {
+			t.Errorf("span %s = %+v, want service cart and a trace ID", s.Name, s)
+		}
+	}
+	if len(names) != 3 || names[0] != "second" || names[1] != "third" || names[2] != "failed" {
+		t.Fatalf("served spans %v, want [second third failed]", names)
+	}
+	if spans[2].Status != "Error" || spans[0].Status != "Unset" {
+		t.Fatalf("statuses = %s, %s, want Unset and Error", spans[0].Status, spans[2].Status)
+	}
+}
+
+func TestDebugSpansOffByDefault(t *testing.T) {
+	setForTest(t, &config.DebugSpans, false)
+	setForTest(t, &config.AdminToken, "")
+	if code := serve(NewServer(":0", http.NotFoundHandler()).Handler, "GET", "/debug/spans", ""); code != http.StatusNotFound {
+		t.Fatalf("/debug/spans returned %d without DEBUG_SPANS, want 404", code)
+	}
+}
@@ -0,0 +1,48 @@
+package common
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"strings"
+
+	"otel-mock/config"
+
+	"go.opentelemetry.io/contrib/bridges/otelslog"
+	otellog "go.opentelemetry.io/otel/log"
+)
+
+// NewLogger creates an OTel-bridged slog logger for a service that drops
+// records below the service's LOG_LEVEL (or LOG_LEVEL_<SERVICE>) setting and
+// tags records with the request ID from their context
+func NewLogger(name string, lp otellog.LoggerProvider) *slog.Logger {
+	handler := &requestIDHandler{Handler: otelslog.NewHandler(name, otelslog.WithLoggerProvider(lp))}
+	return slog.New(&leveledHandler{Handler: handler, level: parseLogLevel(config.LogLevelFor(name))})
+}
+
+func parseLogLevel(s string) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(s))); err != nil {
+		log.Printf("invalid log level %q, using info", s)
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// leveledHandler filters records below level before they reach the wrapped handler
+type leveledHandler struct {
+	slog.Handler
+	level slog.Leveler
+}
+
+func (h *leveledHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level() && h.Handler.Enabled(ctx, level)
+}
+
+func (h *leveledHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &leveledHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h *leveledHandler) WithGroup(name string) slog.Handler {
+	return &leveledHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+)
+
+// logRecorder is a log exporter that keeps the body of every record
+type logRecorder struct {
+	mu     sync.Mutex
+	bodies []string
+}
+
+func (l *logRecorder) Export(_ context.Context, records []sdklog.Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, r := range records {
+		l.bodies = append(l.bodies, r.Body().AsString())
+	}
+	return nil
+}
+func (l *logRecorder) Shutdown(context.Context) error   { return nil }
+func (l *logRecorder) ForceFlush(context.Context) error { return nil }
+
+func newRecordingLogger(t *testing.T, name string) (*slog.Logger, *logRecorder) {
+	rec := &logRecorder{}
+	lp := sdklog.NewLoggerProvider(sdklog.WithProcessor(sdklog.NewSimpleProcessor(rec)))
+	t.Cleanup(func() { lp.Shutdown(context.Background()) })
+	return NewLogger(name, lp), rec
+}
+
+func TestDebugLogsSuppressedAtInfo(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "info")
+
+	logger, rec := newRecordingLogger(t, "cart")
+	logger.Debug("cart lookup")
+	logger.Info("cart updated")
+
+	if len(rec.bodies) != 1 || rec.bodies[0] != "cart updated" {
+		t.Fatalf("exported %q, want only the info record", rec.bodies)
+	}
+}
+
+func TestServiceLogLevelOverridesGlobal(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "warn")
+	t.Setenv("LOG_LEVEL_PRODUCT_CATALOG", "debug")
+
+	catalog, catalogRec := newRecordingLogger(t, "product-catalog")
+	cart, cartRec := newRecordingLogger(t, "cart")
+	catalog.Debug("catalog lookup")
+	cart.Info("cart updated")
+	cart.Warn("cart slow")
+
+	if len(catalogRec.bodies) != 1 {
+		t.Fatalf("product-catalog exported %q, want its debug record", catalogRec.bodies)
+	}
+	if len(cartRec.bodies) != 1 || cartRec.bodies[0] != "cart slow" {
+		t.Fatalf("cart exported %q, want only the warning", cartRec.bodies)
+	}
+}
+
+func TestInvalidLogLevelFallsBackToInfo(t *testing.T) {
+	if got := parseLogLevel("chatty"); got != slog.LevelInfo {
+		t.Fatalf("parseLogLevel(chatty) = %v, want info", got)
+	}
+	if got := parseLogLevel(" DEBUG "); got != slog.LevelDebug {
+		t.Fatalf("parseLogLevel(DEBUG) = %v, want debug", got)
+	}
+}
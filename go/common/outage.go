@@ -0,0 +1,48 @@
+package common
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"otel-mock/config"
+)
+
+// outage is one server's maintenance switch, flipped by POST /admin/outage
+type outage struct {
+	enabled atomic.Bool
+}
+
+// middleware answers 503 for every request except /health while the outage
+// is on, so callers see the failure cascade through their own spans
+func (o *outage) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if o.enabled.Load() && r.URL.Path != "/health" {
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "service in simulated outage", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// toggle handles POST /admin/outage?enabled=true|false, guarded by
+// ADMIN_TOKEN, and reports the resulting state
+func (o *outage) toggle(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+		http.Error(w, "invalid admin token", http.StatusUnauthorized)
+		return
+	}
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+		return
+	}
+	o.enabled.Store(enabled)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"outage": enabled})
+}
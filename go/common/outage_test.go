@@ -0,0 +1,79 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"otel-mock/config"
+)
+
+// serve sends one request to h and returns the response code
+func serve(h http.Handler, method, target, token string) int {
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func okHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+}
+
+func TestOutageToggle(t *testing.T) {
+	setForTest(t, &config.AdminToken, "secret")
+	h := NewServer(":0", okHandler()).Handler
+
+	if code := serve(h, "POST", "/admin/outage?enabled=true", "wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("toggle with a bad token returned %d, want 401", code)
+	}
+	if code := serve(h, "POST", "/admin/outage?enabled=maybe", "secret"); code != http.StatusBadRequest {
+		t.Fatalf("toggle with a bad value returned %d, want 400", code)
+	}
+	if code := serve(h, "GET", "/cart", ""); code != http.StatusOK {
+		t.Fatalf("request before the outage returned %d, want 200", code)
+	}
+
+	if code := serve(h, "POST", "/admin/outage?enabled=true", "secret"); code != http.StatusOK {
+		t.Fatalf("enabling the outage returned %d, want 200", code)
+	}
+	if code := serve(h, "GET", "/cart", ""); code != http.StatusServiceUnavailable {
+		t.Fatalf("request during the outage returned %d, want 503", code)
+	}
+	if code := serve(h, "GET", "/health", ""); code != http.StatusOK {
+		t.Fatalf("/health during the outage returned %d, want 200", code)
+	}
+
+	serve(h, "POST", "/admin/outage?enabled=false", "secret")
+	if code := serve(h, "GET", "/cart", ""); code != http.StatusOK {
+		t.Fatalf("request after the outage returned %d, want 200", code)
+	}
+}
+
+func TestOutageIsPerServer(t *testing.T) {
+	setForTest(t, &config.AdminToken, "secret")
+	a := NewServer(":0", okHandler()).Handler
+	b := NewServer(":0", okHandler()).Handler
+
+	serve(a, "POST", "/admin/outage?enabled=true", "secret")
+	if code := serve(b, "GET", "/", ""); code != http.StatusOK {
+		t.Fatalf("other server returned %d during the outage, want 200", code)
+	}
+}
+
+func TestInternalServerHasNoAdminEndpoint(t *testing.T) {
+	setForTest(t, &config.AdminToken, "secret")
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", okHandler())
+	h := newServer(":0", mux).Handler
+
+	if code := serve(h, "POST", "/admin/outage?enabled=true", "secret"); code != http.StatusNotFound {
+		t.Fatalf("metrics server answered /admin/outage with %d, want 404", code)
+	}
+	if code := serve(h, "GET", "/metrics", ""); code != http.StatusOK {
+		t.Fatalf("/metrics returned %d, want 200", code)
+	}
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// redactingProcessor hashes the values of configured attribute keys before
+// passing finished spans on, so PII such as user IDs never reaches the
+// exporter while equal values still correlate
+type redactingProcessor struct {
+	sdktrace.SpanProcessor
+	keys map[attribute.Key]bool
+}
+
+// newRedactingProcessor wraps next so spans it receives have the values of
+// keys (a comma-separated list, as in REDACT_ATTRS) hashed. With no keys it
+// returns next unchanged.
+func newRedactingProcessor(next sdktrace.SpanProcessor, keys string) sdktrace.SpanProcessor {
+	set := map[attribute.Key]bool{}
+	for _, k := range strings.Split(keys, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			set[attribute.Key(k)] = true
+		}
+	}
+	if len(set) == 0 {
+		return next
+	}
+	return &redactingProcessor{SpanProcessor: next, keys: set}
+}
+
+func (p *redactingProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	p.SpanProcessor.OnEnd(&redactedSpan{ReadOnlySpan: s, keys: p.keys})
+}
+
+// redactedSpan overrides Attributes on an otherwise unchanged span
+type redactedSpan struct {
+	sdktrace.ReadOnlySpan
+	keys map[attribute.Key]bool
+}
+
+func (s *redactedSpan) Attributes() []attribute.KeyValue {
+	attrs := s.ReadOnlySpan.Attributes()
+	out := make([]attribute.KeyValue, len(attrs))
+	for i, kv := range attrs {
+		if s.keys[kv.Key] {
+			kv = attribute.String(string(kv.Key), redactValue(kv.Value.Emit()))
+		}
+		out[i] = kv
+	}
+	return out
+}
+
+// redactValue returns a short stable hash standing in for value
+func redactValue(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,56 @@
+package common
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestRedactedAttributesExportMasked(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(
+		newRedactingProcessor(sdktrace.NewSimpleSpanProcessor(exporter), "app.user.id, app.user.email"),
+	))
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+
+	for range 2 {
+		_, span := tp.Tracer("checkout").Start(context.Background(), "PlaceOrder")
+		span.SetAttributes(
+			attribute.String("app.user.id", "user-42"),
+			attribute.String("app.user.email", "jane@example.com"),
+			attribute.String("app.order.id", "o-1"),
+		)
+		span.End()
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(spans))
+	}
+	attrs := attribute.NewSet(spans[0].Attributes...)
+	for key, raw := range map[attribute.Key]string{"app.user.id": "user-42", "app.user.email": "jane@example.com"} {
+		v, _ := attrs.Value(key)
+		if v.AsString() != redactValue(raw) {
+			t.Errorf("%s exported as %q, want it masked as %q", key, v.AsString(), redactValue(raw))
+		}
+	}
+	if v, _ := attrs.Value("app.order.id"); v.AsString() != "o-1" {
+		t.Errorf("app.order.id exported as %q, want it untouched", v.AsString())
+	}
+	// Equal values mask the same way, so redacted spans still correlate
+	second := attribute.NewSet(spans[1].Attributes...)
+	again, _ := second.Value("app.user.id")
+	if first, _ := attrs.Value("app.user.id"); again != first {
+		t.Errorf("same user masked as %q then %q", first.AsString(), again.AsString())
+	}
+}
+
+func TestRedactingProcessorWithoutKeys(t *testing.T) {
+	next := sdktrace.NewSimpleSpanProcessor(tracetest.NewInMemoryExporter())
+	if got := newRedactingProcessor(next, " , "); got != next {
+		t.Fatal("processor wrapped with no keys to redact, want next unchanged")
+	}
+}
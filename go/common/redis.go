@@ -0,0 +1,47 @@
+package common
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"otel-mock/config"
+
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// NewRedisClient connects to REDIS_ADDR (default localhost:6379) with tracing
+// instrumentation, tagging spans with dbName. An unreachable server is only
+// logged, so services still start and fail per request instead.
+func NewRedisClient(dbName string) *redis.Client {
+	redisAddr := config.RedisAddr
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     redisAddr,
+		Password: "",
+		DB:       0,
+	})
+
+	// Add OpenTelemetry auto-instrumentation for Redis
+	if err := redisotel.InstrumentTracing(client,
+		redisotel.WithAttributes(
+			attribute.String("db.system", "redis"),
+			attribute.String("db.name", dbName),
+		),
+	); err != nil {
+		log.Printf("Failed to instrument Redis: %v", err)
+	}
+
+	// Test connection
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		log.Printf("Warning: Redis not available at %s: %v", redisAddr, err)
+	} else {
+		log.Printf("Connected to Redis at %s", redisAddr)
+	}
+	return client
+}
@@ -0,0 +1,79 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func requestIDAttr(s sdktrace.ReadOnlySpan) string {
+	for _, kv := range s.Attributes() {
+		if kv.Key == attribute.Key("request.id") {
+			return kv.Value.AsString()
+		}
+	}
+	return ""
+}
+
+func TestRequestIDFlowsDownstream(t *testing.T) {
+	tp, sr := newTestTracerProvider(t)
+
+	downstream := httptest.NewServer(NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "Downstream", tp))
+	defer downstream.Close()
+
+	client := NewHTTPClient(tp, metricnoop.NewMeterProvider())
+	upstream := httptest.NewServer(NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, _ := http.NewRequestWithContext(r.Context(), "GET", downstream.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+	}), "Upstream", tp))
+	defer upstream.Close()
+
+	req, _ := http.NewRequest("GET", upstream.URL, nil)
+	req.Header.Set(RequestIDHeader, "req-123")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if got := resp.Header.Get(RequestIDHeader); got != "req-123" {
+		t.Fatalf("echoed %s = %q, want req-123", RequestIDHeader, got)
+	}
+	var found bool
+	for _, s := range sr.Ended() {
+		if s.Name() == "Downstream" {
+			found = true
+			if got := requestIDAttr(s); got != "req-123" {
+				t.Fatalf("downstream request.id = %q, want req-123", got)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("no downstream server span was recorded")
+	}
+}
+
+func TestRequestIDGeneratedWhenAbsent(t *testing.T) {
+	tp, sr := newTestTracerProvider(t)
+
+	rec := httptest.NewRecorder()
+	NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "Op", tp).
+		ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	id := rec.Header().Get(RequestIDHeader)
+	if id == "" {
+		t.Fatal("no request ID generated")
+	}
+	if got := requestIDAttr(sr.Ended()[0]); got != id {
+		t.Fatalf("span request.id = %q, want the generated %q", got, id)
+	}
+}
@@ -0,0 +1,108 @@
+package common
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"otel-mock/config"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RetryOption adjusts DoWithRetry for one call
+type RetryOption func(*retryPolicy)
+
+type retryPolicy struct {
+	throttle bool
+}
+
+// RetryOnThrottle also retries 429 responses, waiting at least as long as
+// their Retry-After header asks. Only use it for idempotent deliveries: a
+// throttled charge must not be sent again.
+func RetryOnThrottle() RetryOption {
+	return func(p *retryPolicy) { p.throttle = true }
+}
+
+// DoWithRetry sends req, retrying connection errors and 5xx responses with
+// exponential backoff up to RETRY_MAX_ATTEMPTS. Calls rejected by an open
+// circuit breaker are not retried. Each retry is recorded as a
+// retry_attempt event on the span in the request context. Waiting between
+// attempts stops as soon as the request context is done.
+func DoWithRetry(client *http.Client, req *http.Request, opts ...RetryOption) (*http.Response, error) {
+	resp, _, err := DoWithRetryCount(client, req, opts...)
+	return resp, err
+}
+
+// DoWithRetryCount is DoWithRetry that also reports how many retries were made
+func DoWithRetryCount(client *http.Client, req *http.Request, opts ...RetryOption) (*http.Response, int, error) {
+	var policy retryPolicy
+	for _, opt := range opts {
+		opt(&policy)
+	}
+
+	ctx := req.Context()
+	span := trace.SpanFromContext(ctx)
+	backoff := config.RetryBaseBackoff
+
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, attempt - 2, err
+				}
+				req.Body = body
+			}
+			span.AddEvent("retry_attempt", trace.WithAttributes(
+				attribute.Int("app.retry.attempt", attempt),
+			))
+		}
+
+		resp, err := client.Do(req)
+		if !policy.shouldRetry(resp, err) || ctx.Err() != nil || attempt >= config.RetryMaxAttempts {
+			return resp, attempt - 1, err
+		}
+		wait := backoff
+		if resp != nil {
+			wait = max(wait, retryAfter(resp))
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, attempt - 1, ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+func (p retryPolicy) shouldRetry(resp *http.Response, err error) bool {
+	if errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return p.throttle
+	}
+	return resp.StatusCode >= http.StatusInternalServerError
+}
+
+// retryAfter is a 429's Retry-After delay in seconds, or 0 when absent
+func retryAfter(resp *http.Response) time.Duration {
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return 0
+	}
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
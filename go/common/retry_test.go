@@ -0,0 +1,96 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"otel-mock/config"
+)
+
+// failingServer answers status for the first failures requests, then 200
+func failingServer(t *testing.T, failures int32, status int, header http.Header) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestDoWithRetryRecoversAfterTwoFailures(t *testing.T) {
+	setForTest(t, &config.RetryMaxAttempts, 3)
+	setForTest(t, &config.RetryBaseBackoff, time.Millisecond)
+	srv, calls := failingServer(t, 2, http.StatusServiceUnavailable, nil)
+
+	req, _ := http.NewRequest("POST", srv.URL, nil)
+	resp, retries, err := DoWithRetryCount(srv.Client(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || retries != 2 || calls.Load() != 3 {
+		t.Fatalf("status %d after %d retries and %d calls, want 200 after 2 retries and 3 calls", resp.StatusCode, retries, calls.Load())
+	}
+}
+
+func TestDoWithRetryGivesUpAtMaxAttempts(t *testing.T) {
+	setForTest(t, &config.RetryMaxAttempts, 2)
+	setForTest(t, &config.RetryBaseBackoff, time.Millisecond)
+	srv, calls := failingServer(t, 5, http.StatusBadGateway, nil)
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	resp, retries, err := DoWithRetryCount(srv.Client(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || retries != 1 || calls.Load() != 2 {
+		t.Fatalf("status %d after %d retries and %d calls, want 502 after 1 retry and 2 calls", resp.StatusCode, retries, calls.Load())
+	}
+}
+
+func TestDoWithRetryThrottle(t *testing.T) {
+	setForTest(t, &config.RetryMaxAttempts, 3)
+	setForTest(t, &config.RetryBaseBackoff, time.Millisecond)
+
+	t.Run("not retried by default", func(t *testing.T) {
+		srv, calls := failingServer(t, 1, http.StatusTooManyRequests, nil)
+		req, _ := http.NewRequest("POST", srv.URL, nil)
+		resp, err := DoWithRetry(srv.Client(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusTooManyRequests || calls.Load() != 1 {
+			t.Fatalf("status %d after %d calls, want the 429 after 1 call", resp.StatusCode, calls.Load())
+		}
+	})
+
+	t.Run("retried after Retry-After with RetryOnThrottle", func(t *testing.T) {
+		srv, calls := failingServer(t, 1, http.StatusTooManyRequests, http.Header{"Retry-After": {"1"}})
+		req, _ := http.NewRequest("POST", srv.URL, nil)
+		start := time.Now()
+		resp, err := DoWithRetry(srv.Client(), req, RetryOnThrottle())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || calls.Load() != 2 {
+			t.Fatalf("status %d after %d calls, want 200 after 2 calls", resp.StatusCode, calls.Load())
+		}
+		if waited := time.Since(start); waited < time.Second {
+			t.Fatalf("retried after %s, want at least the 1s Retry-After", waited)
+		}
+	})
+}
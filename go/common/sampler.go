@@ -0,0 +1,136 @@
+package common
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ForceSampleKey marks a span that must be exported whatever the sampler
+// decided, whether set when the span starts or any time before it ends
+const ForceSampleKey = attribute.Key("app.force_sample")
+
+// envSampler samples whatever an SDK tracer provider configured only from
+// the environment would, so OTEL_TRACES_SAMPLER and OTEL_TRACES_SAMPLER_ARG
+// keep the SDK's own parsing and defaults when errorSampler wraps them. The
+// SDK only reads those variables when no sampler is passed explicitly, so it
+// is asked through a probe span started with the sampled span's trace ID.
+type envSampler struct {
+	probe trace.Tracer
+}
+
+func newEnvSampler() sdktrace.Sampler {
+	tp := sdktrace.NewTracerProvider(sdktrace.WithIDGenerator(probeIDs{}))
+	return envSampler{probe: tp.Tracer("otel-mock/sampler")}
+}
+
+func (s envSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	ctx := context.WithValue(p.ParentContext, probeTraceIDKey{}, p.TraceID)
+	_, span := s.probe.Start(ctx, p.Name,
+		trace.WithSpanKind(p.Kind),
+		trace.WithAttributes(p.Attributes...),
+		trace.WithLinks(p.Links...),
+	)
+	span.End()
+	sc := span.SpanContext()
+	res := sdktrace.SamplingResult{Decision: sdktrace.Drop, Tracestate: sc.TraceState()}
+	if sc.IsSampled() {
+		res.Decision = sdktrace.RecordAndSample
+	}
+	return res
+}
+
+func (s envSampler) Description() string {
+	return "EnvSampler"
+}
+
+// probeTraceIDKey carries the trace ID being sampled to probeIDs
+type probeTraceIDKey struct{}
+
+// probeIDs gives envSampler's probe spans the trace ID of the span being
+// sampled, which ratio-based samplers decide on
+type probeIDs struct{}
+
+func (probeIDs) NewIDs(ctx context.Context) (trace.TraceID, trace.SpanID) {
+	id, _ := ctx.Value(probeTraceIDKey{}).(trace.TraceID)
+	return id, trace.SpanID{1}
+}
+
+func (probeIDs) NewSpanID(context.Context, trace.TraceID) trace.SpanID {
+	return trace.SpanID{1}
+}
+
+// errorSampler samples whatever base does, plus spans started with
+// app.force_sample=true. Spans base drops are still recorded rather than
+// discarded, so errorSamplingProcessor can export them if they end in error.
+type errorSampler struct {
+	base sdktrace.Sampler
+}
+
+func newErrorSampler(base sdktrace.Sampler) sdktrace.Sampler {
+	return errorSampler{base: base}
+}
+
+func (s errorSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	res := s.base.ShouldSample(p)
+	if res.Decision == sdktrace.RecordAndSample {
+		return res
+	}
+	for _, kv := range p.Attributes {
+		if kv.Key == ForceSampleKey && kv.Value.AsBool() {
+			res.Decision = sdktrace.RecordAndSample
+			return res
+		}
+	}
+	res.Decision = sdktrace.RecordOnly
+	return res
+}
+
+func (s errorSampler) Description() string {
+	return "ErrorSampler{" + s.base.Description() + "}"
+}
+
+// errorSamplingProcessor passes sampled spans on to next and drops the
+// recorded-only ones errorSampler kept, except those that ended with an error
+// status or app.force_sample=true, which are passed on as sampled. Only the
+// rescued span itself is exported; its unsampled parent and children are not.
+type errorSamplingProcessor struct {
+	sdktrace.SpanProcessor
+}
+
+func newErrorSamplingProcessor(next sdktrace.SpanProcessor) sdktrace.SpanProcessor {
+	return &errorSamplingProcessor{SpanProcessor: next}
+}
+
+func (p *errorSamplingProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	if s.SpanContext().IsSampled() {
+		p.SpanProcessor.OnEnd(s)
+		return
+	}
+	if s.Status().Code == codes.Error || forceSampled(s) {
+		p.SpanProcessor.OnEnd(&rescuedSpan{ReadOnlySpan: s})
+	}
+}
+
+func forceSampled(s sdktrace.ReadOnlySpan) bool {
+	for _, kv := range s.Attributes() {
+		if kv.Key == ForceSampleKey {
+			return kv.Value.AsBool()
+		}
+	}
+	return false
+}
+
+// rescuedSpan reports an unsampled span as sampled so batch processors and
+// exporters accept it
+type rescuedSpan struct {
+	sdktrace.ReadOnlySpan
+}
+
+func (s *rescuedSpan) SpanContext() trace.SpanContext {
+	sc := s.ReadOnlySpan.SpanContext()
+	return sc.WithTraceFlags(sc.TraceFlags().WithSampled(true))
+}
@@ -0,0 +1,107 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newErrorSamplingProvider builds a provider sampling like initTracerProvider
+// does with SAMPLE_ERRORS on, exporting to the returned recorder
+func newErrorSamplingProvider(t *testing.T) (*sdktrace.TracerProvider, *tracetest.SpanRecorder) {
+	t.Helper()
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSampler(newErrorSampler(newEnvSampler())),
+		sdktrace.WithSpanProcessor(newErrorSamplingProcessor(sr)),
+	)
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+	return tp, sr
+}
+
+func exportedNames(sr *tracetest.SpanRecorder) []string {
+	var names []string
+	for _, s := range sr.Ended() {
+		names = append(names, s.Name())
+	}
+	return names
+}
+
+func TestErrorSpanExportedAtRatioZero(t *testing.T) {
+	t.Setenv("OTEL_TRACES_SAMPLER", "traceidratio")
+	t.Setenv("OTEL_TRACES_SAMPLER_ARG", "0")
+	tp, sr := newErrorSamplingProvider(t)
+	tracer := tp.Tracer("test")
+
+	_, ok := tracer.Start(context.Background(), "ok")
+	ok.End()
+	_, failed := tracer.Start(context.Background(), "failed")
+	RecordSpanError(failed, errors.New("boom"))
+	failed.End()
+	_, forced := tracer.Start(context.Background(), "forced", trace.WithAttributes(ForceSampleKey.Bool(true)))
+	forced.End()
+
+	names := exportedNames(sr)
+	if len(names) != 2 || names[0] != "failed" || names[1] != "forced" {
+		t.Fatalf("exported %v, want only the failed and forced spans", names)
+	}
+	for _, s := range sr.Ended() {
+		if !s.SpanContext().IsSampled() {
+			t.Fatalf("span %s exported without the sampled flag", s.Name())
+		}
+	}
+}
+
+func TestEnvSamplerFollowsSDKEnvironment(t *testing.T) {
+	tests := []struct {
+		sampler, arg string
+		traceID      trace.TraceID
+		want         bool
+	}{
+		{"", "", trace.TraceID{1}, true},
+		{"always_off", "", trace.TraceID{1}, false},
+		{"traceidratio", "1", trace.TraceID{1}, true},
+		{"traceidratio", "0", trace.TraceID{1}, false},
+		{"parentbased_traceidratio", "0", trace.TraceID{1}, false},
+		// The ratio sampler decides on the span's own trace ID
+		{"traceidratio", "0.5", trace.TraceID{8: 0x10}, true},
+		{"traceidratio", "0.5", trace.TraceID{8: 0xf0}, false},
+	}
+	for _, tt := range tests {
+		t.Setenv("OTEL_TRACES_SAMPLER", tt.sampler)
+		t.Setenv("OTEL_TRACES_SAMPLER_ARG", tt.arg)
+
+		res := newEnvSampler().ShouldSample(sdktrace.SamplingParameters{
+			ParentContext: context.Background(),
+			TraceID:       tt.traceID,
+			Name:          "op",
+		})
+		if got := res.Decision == sdktrace.RecordAndSample; got != tt.want {
+			t.Errorf("OTEL_TRACES_SAMPLER=%q ARG=%q sampled = %v, want %v", tt.sampler, tt.arg, got, tt.want)
+		}
+	}
+}
+
+func TestEnvSamplerFollowsSampledParent(t *testing.T) {
+	t.Setenv("OTEL_TRACES_SAMPLER", "parentbased_traceidratio")
+	t.Setenv("OTEL_TRACES_SAMPLER_ARG", "0")
+	parent := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{2},
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	}))
+
+	res := newEnvSampler().ShouldSample(sdktrace.SamplingParameters{
+		ParentContext: parent,
+		TraceID:       trace.TraceID{1},
+		Name:          "op",
+	})
+	if res.Decision != sdktrace.RecordAndSample {
+		t.Fatalf("decision = %v under a sampled parent, want RecordAndSample", res.Decision)
+	}
+}
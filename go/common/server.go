@@ -0,0 +1,133 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"otel-mock/config"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewServer creates an http.Server with timeouts so slow or stalled clients
+// can't hold connections open indefinitely during load tests. Defaults:
+//   - ReadTimeout 10s (HTTP_READ_TIMEOUT): reading the full request, headers included
+//   - WriteTimeout 30s (HTTP_WRITE_TIMEOUT): from end of request read to end of
+//     response write; checkout's downstream fan-out must fit inside this
+//   - IdleTimeout 120s (HTTP_IDLE_TIMEOUT): keep-alive connections between requests
+//
+// With DEBUG_SPANS=true the server also answers GET /debug/spans, and with
+// ADMIN_TOKEN set it answers POST /admin/outage, which makes handler return
+// 503 for everything but /health until switched off again.
+//
+// The server is registered for ShutdownServers; run it with ListenAndServe so
+// in-flight requests are drained on shutdown.
+func NewServer(addr string, handler http.Handler) *http.Server {
+	if config.DebugSpans || config.AdminToken != "" {
+		mux := http.NewServeMux()
+		if config.DebugSpans {
+			mux.HandleFunc("GET /debug/spans", debugSpansHandler)
+		}
+		if config.AdminToken != "" {
+			o := &outage{}
+			mux.HandleFunc("POST /admin/outage", o.toggle)
+			handler = o.middleware(handler)
+		}
+		mux.Handle("/", handler)
+		handler = mux
+	}
+	return newServer(addr, handler)
+}
+
+// newServer is NewServer without the debug and admin endpoints, for internal
+// listeners such as the Prometheus endpoint that a simulated outage of the
+// service shouldn't take down
+func newServer(addr string, handler http.Handler) *http.Server {
+	inFlight := &sync.WaitGroup{}
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      trackInFlight(inFlight, handler),
+		ReadTimeout:  config.HTTPReadTimeout,
+		WriteTimeout: config.HTTPWriteTimeout,
+		IdleTimeout:  config.HTTPIdleTimeout,
+	}
+	registerServer(srv, inFlight)
+	return srv
+}
+
+// NewHandler wraps a service endpoint in an otelhttp server span named
+// operation, with the request ID, span status, request timeout and (opt-in)
+// trace ID middleware applied inside it. Extra otelhttp options are applied
+// after WithTracerProvider.
+func NewHandler(h http.Handler, operation string, tp trace.TracerProvider, opts ...otelhttp.Option) http.Handler {
+	opts = append([]otelhttp.Option{otelhttp.WithTracerProvider(tp)}, opts...)
+	return otelhttp.NewHandler(RequestID(ExposeTraceID(SpanStatus(Timeout(h)))), operation, opts...)
+}
+
+// Timeout answers 503 when h takes longer than REQUEST_TIMEOUT, cancelling
+// its context so slow Redis or downstream calls give up, and adds a
+// request_timeout event to the server span. Like ExposeTraceID it must sit
+// inside otelhttp.NewHandler. Returns h unchanged when REQUEST_TIMEOUT is 0.
+func Timeout(h http.Handler) http.Handler {
+	timeout := config.RequestTimeout
+	if timeout <= 0 {
+		return h
+	}
+	th := http.TimeoutHandler(h, timeout, "request timed out")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		rec := &statusRecorder{ResponseWriter: w}
+		th.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == http.StatusServiceUnavailable && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			trace.SpanFromContext(r.Context()).AddEvent("request_timeout", trace.WithAttributes(
+				attribute.Int64("app.request.timeout_ms", timeout.Milliseconds()),
+			))
+		}
+	})
+}
+
+// TraceIDHeader is the response header carrying the request's trace ID
+const TraceIDHeader = "X-Trace-Id"
+
+// ExposeTraceID writes the active span's trace ID into the X-Trace-Id
+// response header so a curl user can look the trace up in their backend. It
+// must sit inside otelhttp.NewHandler, where the server span is in the
+// request context (see NewHandler). Returns h unchanged unless EXPOSE_TRACE_ID=true.
+func ExposeTraceID(h http.Handler) http.Handler {
+	if !config.ExposeTraceID {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sc := trace.SpanContextFromContext(r.Context()); sc.HasTraceID() {
+			w.Header().Set(TraceIDHeader, sc.TraceID().String())
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// PadResponse appends PADDING_BYTES of whitespace to successful responses
+// from h, simulating larger payloads for load tests while the body still
+// parses as the same JSON, and records the amount as the
+// app.response.padding_bytes span attribute. Like ExposeTraceID it must sit
+// inside otelhttp.NewHandler. Returns h unchanged unless PADDING_BYTES > 0.
+func PadResponse(h http.Handler) http.Handler {
+	if config.PaddingBytes <= 0 {
+		return h
+	}
+	padding := bytes.Repeat([]byte{' '}, config.PaddingBytes)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status < 200 || rec.status >= 300 {
+			return
+		}
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.Int("app.response.padding_bytes", len(padding)))
+		w.Write(padding)
+	})
+}
@@ -0,0 +1,158 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"otel-mock/config"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+func jsonHandler(code int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		w.Write([]byte(`{"id":"p-1"}`))
+	})
+}
+
+func TestPadResponseGrowsBodyByPaddingBytes(t *testing.T) {
+	setForTest(t, &config.PaddingBytes, 64)
+	tp, sr := newTestTracerProvider(t)
+
+	rec := httptest.NewRecorder()
+	NewHandler(PadResponse(jsonHandler(http.StatusOK)), "Op", tp).
+		ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if got, want := rec.Body.Len(), len(`{"id":"p-1"}`)+64; got != want {
+		t.Fatalf("body is %d bytes, want %d", got, want)
+	}
+	var v map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil || v["id"] != "p-1" {
+		t.Fatalf("padded body no longer parses: %v", err)
+	}
+	var padded int64
+	for _, kv := range sr.Ended()[0].Attributes() {
+		if kv.Key == "app.response.padding_bytes" {
+			padded = kv.Value.AsInt64()
+		}
+	}
+	if padded != 64 {
+		t.Fatalf("app.response.padding_bytes = %d, want 64", padded)
+	}
+}
+
+func TestPadResponseSkipsErrorsAndDefault(t *testing.T) {
+	body := `{"id":"p-1"}`
+
+	setForTest(t, &config.PaddingBytes, 64)
+	rec := httptest.NewRecorder()
+	PadResponse(jsonHandler(http.StatusNotFound)).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Body.String() != body {
+		t.Fatalf("404 body = %q, want it unpadded", rec.Body)
+	}
+
+	config.PaddingBytes = 0
+	rec = httptest.NewRecorder()
+	PadResponse(jsonHandler(http.StatusOK)).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Body.String() != body {
+		t.Fatalf("body with PADDING_BYTES=0 = %q, want it unpadded", rec.Body)
+	}
+}
+
+func TestTimeoutAnswers503ForSlowHandler(t *testing.T) {
+	setForTest(t, &config.RequestTimeout, 50*time.Millisecond)
+	tp, sr := newTestTracerProvider(t)
+	cancelled := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(cancelled)
+	})
+
+	rec := httptest.NewRecorder()
+	NewHandler(slow, "Slow", tp).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("slow handler answered %d, want 503", rec.Code)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("slow handler's context was not cancelled")
+	}
+	span := sr.Ended()[0]
+	if span.Status().Code != codes.Error {
+		t.Fatalf("span status = %v, want Error", span.Status().Code)
+	}
+	if events := span.Events(); len(events) != 1 || events[0].Name != "request_timeout" {
+		t.Fatalf("span events = %+v, want request_timeout", events)
+	}
+}
+
+func TestTimeoutLeavesFastHandlerAlone(t *testing.T) {
+	setForTest(t, &config.RequestTimeout, time.Second)
+	tp, sr := newTestTracerProvider(t)
+
+	rec := httptest.NewRecorder()
+	NewHandler(jsonHandler(http.StatusOK), "Fast", tp).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"id":"p-1"}` {
+		t.Fatalf("fast handler answered %d %q, want its own 200 response", rec.Code, rec.Body)
+	}
+	if events := sr.Ended()[0].Events(); len(events) != 0 {
+		t.Fatalf("span events = %+v, want none", events)
+	}
+}
+
+func TestWriteTimeoutCutsOffSlowResponse(t *testing.T) {
+	setForTest(t, &config.HTTPWriteTimeout, 100*time.Millisecond)
+	url, done := startSlowServer(t, slowHandler(make(chan struct{}), 300*time.Millisecond))
+	t.Cleanup(func() {
+		ShutdownServers()
+		<-done
+	})
+
+	start := time.Now()
+	resp, err := http.Get(url)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("slow response arrived with %d, want the connection cut by the write timeout", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("request took %v to fail", elapsed)
+	}
+}
+
+func TestExposeTraceIDMatchesServerSpan(t *testing.T) {
+	setForTest(t, &config.ExposeTraceID, true)
+	tp, sr := newTestTracerProvider(t)
+
+	rec := httptest.NewRecorder()
+	NewHandler(ExposeTraceID(jsonHandler(http.StatusOK)), "GetCart", tp).
+		ServeHTTP(rec, httptest.NewRequest("GET", "/cart", nil))
+
+	spans := sr.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want the server span", len(spans))
+	}
+	if got, want := rec.Header().Get(TraceIDHeader), spans[0].SpanContext().TraceID().String(); got != want {
+		t.Fatalf("%s = %q, want the server span's trace ID %q", TraceIDHeader, got, want)
+	}
+}
+
+func TestExposeTraceIDOffByDefault(t *testing.T) {
+	setForTest(t, &config.ExposeTraceID, false)
+	tp, _ := newTestTracerProvider(t)
+
+	rec := httptest.NewRecorder()
+	NewHandler(ExposeTraceID(jsonHandler(http.StatusOK)), "GetCart", tp).
+		ServeHTTP(rec, httptest.NewRequest("GET", "/cart", nil))
+
+	if got := rec.Header().Get(TraceIDHeader); got != "" {
+		t.Fatalf("%s = %q with EXPOSE_TRACE_ID off, want no header", TraceIDHeader, got)
+	}
+}
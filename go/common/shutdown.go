@@ -0,0 +1,94 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"otel-mock/config"
+)
+
+// servers maps every server built by NewServer to the WaitGroup tracking its
+// in-flight requests, so ShutdownServers can stop them all
+var (
+	serversMu sync.Mutex
+	servers   = map[*http.Server]*sync.WaitGroup{}
+)
+
+// trackInFlight counts requests to h in inFlight until they return
+func trackInFlight(inFlight *sync.WaitGroup, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Done()
+		h.ServeHTTP(w, r)
+	})
+}
+
+func registerServer(srv *http.Server, inFlight *sync.WaitGroup) {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+	servers[srv] = inFlight
+}
+
+// ShutdownServers stops every server built by NewServer from accepting new
+// connections, giving open ones up to SHUTDOWN_TIMEOUT to go idle. Servers
+// are shut down concurrently so one slow server doesn't eat the others' time.
+func ShutdownServers() {
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	serversMu.Lock()
+	toStop := make([]*http.Server, 0, len(servers))
+	for srv := range servers {
+		toStop = append(toStop, srv)
+	}
+	serversMu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, srv := range toStop {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("server %s shutdown: %v", srv.Addr, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// ListenAndServe runs srv like srv.ListenAndServe, but once ShutdownServers
+// closes it, waits up to SHUTDOWN_TIMEOUT for its in-flight requests before
+// returning nil. Callers flush telemetry after it returns, so those requests'
+// spans end and export instead of being cut off.
+func ListenAndServe(srv *http.Server) error {
+	err := srv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	// srv.ListenAndServe returns as soon as Shutdown starts, while handlers
+	// may still be running; waiting for them here is what keeps main from
+	// flushing telemetry before their spans end
+	serversMu.Lock()
+	inFlight := servers[srv]
+	serversMu.Unlock()
+	if inFlight == nil {
+		return nil
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(config.ShutdownTimeout):
+		log.Printf("server %s: in-flight requests still running after %s", srv.Addr, config.ShutdownTimeout)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package common
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startSlowServer serves h through NewServer on a free local port and
+// returns the server's URL and a channel receiving ListenAndServe's result.
+// Each request signals started, then takes delay to answer.
+func startSlowServer(t *testing.T, h http.Handler) (string, <-chan error) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	srv := NewServer(addr, h)
+	done := make(chan error, 1)
+	go func() { done <- ListenAndServe(srv) }()
+	for range 50 {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return "http://" + addr, done
+}
+
+// slowHandler closes started when called, then answers after delay
+func slowHandler(started chan<- struct{}, delay time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(delay)
+	})
+}
+
+func TestSlowRequestSpanSurvivesShutdown(t *testing.T) {
+	tp, sr := newTestTracerProvider(t)
+	started := make(chan struct{})
+	url, done := startSlowServer(t, NewHandler(slowHandler(started, 200*time.Millisecond), "Slow", tp))
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	<-started
+	ShutdownServers()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// ListenAndServe has returned, which is when main flushes telemetry
+	if spans := sr.Ended(); len(spans) != 1 || spans[0].Name() != "Slow" {
+		t.Fatalf("ended spans = %d, want the slow request's span", len(spans))
+	}
+	if code := <-status; code != http.StatusOK {
+		t.Fatalf("slow request got %d during shutdown, want 200", code)
+	}
+}
+
+func TestShutdownServersStopsServersConcurrently(t *testing.T) {
+	const delay = 400 * time.Millisecond
+	var dones []<-chan error
+	for range 2 {
+		started := make(chan struct{})
+		url, done := startSlowServer(t, slowHandler(started, delay))
+		dones = append(dones, done)
+		go func() {
+			if resp, err := http.Get(url); err == nil {
+				resp.Body.Close()
+			}
+		}()
+		<-started
+	}
+
+	start := time.Now()
+	ShutdownServers()
+	if elapsed := time.Since(start); elapsed >= 2*delay {
+		t.Fatalf("shutdown took %v, want the servers drained in parallel (under %v)", elapsed, 2*delay)
+	}
+	for _, done := range dones {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
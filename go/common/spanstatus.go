@@ -0,0 +1,49 @@
+package common
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RecordSpanError records err on span and marks the span as failed, so
+// backends color it as an error rather than showing an OK span with an
+// exception event
+func RecordSpanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// statusRecorder remembers the status code a handler responded with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// SpanStatus sets the server span's status to error whenever h responds with
+// a non-2xx code. otelhttp only does so for 5xx, leaving 4xx spans unset. It
+// must sit inside otelhttp.NewHandler (see NewHandler).
+func SpanStatus(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status != 0 && (rec.status < 200 || rec.status >= 300) {
+			trace.SpanFromContext(r.Context()).SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+func TestRecordSpanErrorMarksSpanFailed(t *testing.T) {
+	tp, sr := newTestTracerProvider(t)
+
+	_, span := tp.Tracer("test").Start(context.Background(), "op")
+	RecordSpanError(span, errors.New("boom"))
+	span.End()
+
+	s := sr.Ended()[0]
+	if s.Status().Code != codes.Error || s.Status().Description != "boom" {
+		t.Fatalf("status = %+v, want Error \"boom\"", s.Status())
+	}
+	if len(s.Events()) != 1 || s.Events()[0].Name != "exception" {
+		t.Fatalf("events = %+v, want one exception event", s.Events())
+	}
+}
+
+func TestSpanStatusFollowsResponseCode(t *testing.T) {
+	tests := []struct {
+		code int
+		want codes.Code
+	}{
+		{http.StatusOK, codes.Unset},
+		{http.StatusNoContent, codes.Unset},
+		{http.StatusNotFound, codes.Error},
+		{http.StatusConflict, codes.Error},
+		{http.StatusInternalServerError, codes.Error},
+	}
+	for _, tt := range tests {
+		tp, sr := newTestTracerProvider(t)
+		NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.code)
+		}), "Op", tp).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+		if got := sr.Ended()[0].Status().Code; got != tt.want {
+			t.Errorf("%d response: span status = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
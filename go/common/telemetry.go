@@ -2,10 +2,21 @@ package common
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"otel-mock/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
 	"go.opentelemetry.io/contrib/instrumentation/host"
 	"go.opentelemetry.io/contrib/instrumentation/runtime"
 	"go.opentelemetry.io/otel"
@@ -13,9 +24,12 @@ import (
 	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	otelprom "go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
 	"go.opentelemetry.io/otel/propagation"
 	sdklog "go.opentelemetry.io/otel/sdk/log"
 	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/exemplar"
 	sdkresource "go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
@@ -30,6 +44,7 @@ type TelemetryProviders struct {
 	MeterProvider  *sdkmetric.MeterProvider
 	LoggerProvider *sdklog.LoggerProvider
 	Tracer         trace.Tracer
+	serviceName    string
 }
 
 // InitTelemetry initializes all OTel providers for a service
@@ -59,80 +74,274 @@ func InitTelemetry(ctx context.Context, serviceName string) *TelemetryProviders
 		MeterProvider:  mp,
 		LoggerProvider: lp,
 		Tracer:         tp.Tracer(serviceName),
+		serviceName:    serviceName,
 	}
 }
 
 func initResource(serviceName string) *sdkresource.Resource {
 	hostname, _ := os.Hostname()
 
+	attrs := []attribute.KeyValue{
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(serviceVersion),
+		semconv.TelemetrySDKLanguageGo,
+		semconv.HostName(hostname),
+		attribute.String("deployment.environment", config.DeploymentEnvironment),
+		attribute.String("container.runtime", "docker"),
+	}
+	if config.Region != "" {
+		attrs = append(attrs, semconv.CloudRegion(config.Region))
+	}
+
 	res, err := sdkresource.New(
 		context.Background(),
-		sdkresource.WithAttributes(
-			semconv.ServiceName(serviceName),
-			semconv.ServiceVersion(serviceVersion),
-			semconv.TelemetrySDKLanguageGo,
-			semconv.HostName(hostname),
-			attribute.String("deployment.environment", "demo"),
-			attribute.String("container.runtime", "docker"),
-		),
+		sdkresource.WithAttributes(attrs...),
 		sdkresource.WithHost(),
 		sdkresource.WithProcess(),
 		sdkresource.WithContainer(),
+		// After the defaults and detectors so OTEL_RESOURCE_ATTRIBUTES wins
+		sdkresource.WithFromEnv(),
+		// Services sharing a process each keep their own name, whatever
+		// OTEL_SERVICE_NAME says
+		sdkresource.WithAttributes(semconv.ServiceName(serviceName)),
 	)
-	if err != nil {
+	if errors.Is(err, sdkresource.ErrPartialResource) {
+		log.Printf("skipping malformed resource attributes: %v", err)
+	} else if err != nil {
 		log.Fatalf("failed to create resource: %v", err)
 	}
 	return res
 }
 
+// useGzip reports whether OTLP exports should be gzip-compressed
+func useGzip() bool {
+	switch config.OTLPCompression {
+	case "gzip":
+		return true
+	case "none", "":
+		return false
+	default:
+		log.Printf("unknown OTLP compression %q, sending uncompressed", config.OTLPCompression)
+		return false
+	}
+}
+
 func initTracerProvider(ctx context.Context, res *sdkresource.Resource) *sdktrace.TracerProvider {
-	exporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithInsecure())
-	if err != nil {
-		log.Fatalf("failed to create trace exporter: %v", err)
+	tpOpts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	if config.SampleErrors {
+		tpOpts = append(tpOpts, sdktrace.WithSampler(newErrorSampler(newEnvSampler())))
+	}
+	for _, exporter := range spanExporters(ctx) {
+		batcher := sdktrace.NewBatchSpanProcessor(exporter, spanBatchOptions()...)
+		tpOpts = append(tpOpts, sdktrace.WithSpanProcessor(sampledOnly(newRedactingProcessor(batcher, config.RedactAttrs))))
 	}
+	if config.DebugSpans {
+		tpOpts = append(tpOpts, sdktrace.WithSpanProcessor(sampledOnly(debugSpanProcessor{})))
+	}
+	return sdktrace.NewTracerProvider(tpOpts...)
+}
 
-	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithBatcher(exporter),
-		sdktrace.WithResource(res),
-	)
-	return tp
+// sampledOnly wraps next so it sees only exported spans when SAMPLE_ERRORS
+// keeps unsampled spans recording (see errorSampler)
+func sampledOnly(next sdktrace.SpanProcessor) sdktrace.SpanProcessor {
+	if !config.SampleErrors {
+		return next
+	}
+	return newErrorSamplingProcessor(next)
 }
 
-func initMeterProvider(ctx context.Context, res *sdkresource.Resource) *sdkmetric.MeterProvider {
-	exporter, err := otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithInsecure())
-	if err != nil {
-		log.Fatalf("failed to create metric exporter: %v", err)
+// stdoutSpans is where the "stdout" span exporter writes; tests may replace it
+var stdoutSpans io.Writer = os.Stdout
+
+// spanExporters builds one exporter per TELEMETRY_EXPORTER entry. Each gets
+// its own batch processor, so a slow collector doesn't hold up stdout and
+// the tracer provider shuts every one down.
+func spanExporters(ctx context.Context) []sdktrace.SpanExporter {
+	var exporters []sdktrace.SpanExporter
+	for _, name := range strings.Split(config.TelemetryExporter, ",") {
+		switch strings.TrimSpace(name) {
+		case "otlp":
+			opts := []otlptracegrpc.Option{otlptracegrpc.WithInsecure()}
+			if useGzip() {
+				opts = append(opts, otlptracegrpc.WithCompressor("gzip"))
+			}
+			exporter, err := otlptracegrpc.New(ctx, opts...)
+			if err != nil {
+				log.Fatalf("failed to create trace exporter: %v", err)
+			}
+			exporters = append(exporters, exporter)
+		case "stdout":
+			exporter, err := stdouttrace.New(stdouttrace.WithWriter(stdoutSpans))
+			if err != nil {
+				log.Fatalf("failed to create stdout trace exporter: %v", err)
+			}
+			exporters = append(exporters, exporter)
+		default:
+			log.Printf("unknown span exporter %q, ignoring", name)
+		}
 	}
+	return exporters
+}
 
-	mp := sdkmetric.NewMeterProvider(
-		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)),
+// spanBatchOptions applies OTEL_BSP_* tuning so bursts from the load
+// generator don't overflow the span queue
+func spanBatchOptions() []sdktrace.BatchSpanProcessorOption {
+	var opts []sdktrace.BatchSpanProcessorOption
+	if config.BSPMaxQueueSize > 0 {
+		opts = append(opts, sdktrace.WithMaxQueueSize(config.BSPMaxQueueSize))
+	}
+	if config.BSPMaxExportBatchSize > 0 {
+		opts = append(opts, sdktrace.WithMaxExportBatchSize(config.BSPMaxExportBatchSize))
+	}
+	if config.BSPScheduleDelayMs > 0 {
+		opts = append(opts, sdktrace.WithBatchTimeout(time.Duration(config.BSPScheduleDelayMs)*time.Millisecond))
+	}
+	return opts
+}
+
+func initMeterProvider(ctx context.Context, res *sdkresource.Resource) *sdkmetric.MeterProvider {
+	opts := []sdkmetric.Option{
 		sdkmetric.WithResource(res),
-	)
+		sdkmetric.WithExemplarFilter(exemplarFilter()),
+		sdkmetric.WithView(metricView(parseDropAttrs(config.MetricsDropAttrs), parseBuckets(config.MetricsLatencyBuckets))),
+	}
+
+	for _, name := range strings.Split(config.MetricsExporter, ",") {
+		switch strings.TrimSpace(name) {
+		case "otlp":
+			exporterOpts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithInsecure()}
+			if useGzip() {
+				exporterOpts = append(exporterOpts, otlpmetricgrpc.WithCompressor("gzip"))
+			}
+			exporter, err := otlpmetricgrpc.New(ctx, exporterOpts...)
+			if err != nil {
+				log.Fatalf("failed to create metric exporter: %v", err)
+			}
+			opts = append(opts, sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)))
+		case "prometheus":
+			opts = append(opts, sdkmetric.WithReader(initPrometheusReader()))
+		default:
+			log.Printf("unknown metrics exporter %q, ignoring", name)
+		}
+	}
+
+	mp := sdkmetric.NewMeterProvider(opts...)
 	return mp
 }
 
+// exemplarFilter picks which measurements keep exemplars. The default keeps
+// those recorded inside a sampled span, linking histogram buckets to traces.
+func exemplarFilter() exemplar.Filter {
+	switch config.MetricsExemplarFilter {
+	case "always_on":
+		return exemplar.AlwaysOnFilter
+	case "always_off":
+		return exemplar.AlwaysOffFilter
+	case "trace_based":
+		return exemplar.TraceBasedFilter
+	default:
+		log.Printf("unknown exemplar filter %q, using trace_based", config.MetricsExemplarFilter)
+		return exemplar.TraceBasedFilter
+	}
+}
+
+var (
+	promRegistry   = prometheus.NewRegistry()
+	promServerOnce sync.Once
+)
+
+// initPrometheusReader registers a Prometheus exporter on the shared registry
+// and starts the /metrics endpoint on first use. All services in the process
+// share one endpoint, so metrics are labelled with service_name.
+func initPrometheusReader() sdkmetric.Reader {
+	exporter, err := otelprom.New(
+		otelprom.WithRegisterer(promRegistry),
+		otelprom.WithResourceAsConstantLabels(attribute.NewAllowKeysFilter(semconv.ServiceNameKey)),
+	)
+	if err != nil {
+		log.Fatalf("failed to create prometheus exporter: %v", err)
+	}
+
+	promServerOnce.Do(func() {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", prometheusHandler())
+		go func() {
+			log.Printf("Prometheus metrics endpoint listening on %s/metrics", config.PrometheusAddr)
+			if err := ListenAndServe(newServer(config.PrometheusAddr, mux)); err != nil {
+				log.Printf("prometheus metrics endpoint failed: %v", err)
+			}
+		}()
+	})
+
+	return exporter
+}
+
+// prometheusHandler serves every exporter registered on the shared registry.
+// Services running in the same process can report identical series (e.g.
+// host metrics); serve what we can rather than failing the scrape.
+func prometheusHandler() http.Handler {
+	return promhttp.HandlerFor(promRegistry, promhttp.HandlerOpts{
+		ErrorHandling: promhttp.ContinueOnError,
+	})
+}
+
 func initLoggerProvider(ctx context.Context, res *sdkresource.Resource) *sdklog.LoggerProvider {
-	exporter, err := otlploggrpc.New(ctx, otlploggrpc.WithInsecure())
+	opts := []otlploggrpc.Option{otlploggrpc.WithInsecure()}
+	if useGzip() {
+		opts = append(opts, otlploggrpc.WithCompressor("gzip"))
+	}
+	exporter, err := otlploggrpc.New(ctx, opts...)
 	if err != nil {
 		log.Fatalf("failed to create log exporter: %v", err)
 	}
 
 	lp := sdklog.NewLoggerProvider(
-		sdklog.WithProcessor(sdklog.NewBatchProcessor(exporter)),
+		sdklog.WithProcessor(sdklog.NewBatchProcessor(exporter, logBatchOptions()...)),
 		sdklog.WithResource(res),
 	)
 	return lp
 }
 
-// Shutdown gracefully shuts down all providers
-func (t *TelemetryProviders) Shutdown(ctx context.Context) {
+// logBatchOptions applies OTEL_BLRP_* tuning to the log batch processor
+func logBatchOptions() []sdklog.BatchProcessorOption {
+	var opts []sdklog.BatchProcessorOption
+	if config.BLRPMaxQueueSize > 0 {
+		opts = append(opts, sdklog.WithMaxQueueSize(config.BLRPMaxQueueSize))
+	}
+	if config.BLRPMaxExportBatchSize > 0 {
+		opts = append(opts, sdklog.WithExportMaxBatchSize(config.BLRPMaxExportBatchSize))
+	}
+	if config.BLRPScheduleDelayMs > 0 {
+		opts = append(opts, sdklog.WithExportInterval(time.Duration(config.BLRPScheduleDelayMs)*time.Millisecond))
+	}
+	return opts
+}
+
+// Shutdown flushes and shuts down all providers, logging and returning every
+// failure joined together. All three share ctx's deadline, or
+// SHUTDOWN_TIMEOUT when ctx has none, so one stuck exporter can't stall exit.
+func (t *TelemetryProviders) Shutdown(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.ShutdownTimeout)
+		defer cancel()
+	}
+
+	var errs []error
+	shutdown := func(signal string, fn func(context.Context) error) {
+		if err := fn(ctx); err != nil {
+			log.Printf("%s: %s shutdown failed: %v", t.serviceName, signal, err)
+			errs = append(errs, fmt.Errorf("%s %s: %w", t.serviceName, signal, err))
+		}
+	}
 	if t.TracerProvider != nil {
-		t.TracerProvider.Shutdown(ctx)
+		shutdown("tracer provider", t.TracerProvider.Shutdown)
 	}
 	if t.MeterProvider != nil {
-		t.MeterProvider.Shutdown(ctx)
+		shutdown("meter provider", t.MeterProvider.Shutdown)
 	}
 	if t.LoggerProvider != nil {
-		t.LoggerProvider.Shutdown(ctx)
+		shutdown("logger provider", t.LoggerProvider.Shutdown)
 	}
+	return errors.Join(errs...)
 }
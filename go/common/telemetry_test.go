@@ -0,0 +1,312 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"otel-mock/config"
+
+	"go.opentelemetry.io/otel/attribute"
+	otellog "go.opentelemetry.io/otel/log"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestResourceCarriesRegion(t *testing.T) {
+	setForTest(t, &config.Region, "eu-west")
+
+	v, ok := initResource("cart").Set().Value(semconv.CloudRegionKey)
+	if !ok || v.AsString() != "eu-west" {
+		t.Fatalf("cloud.region = %q (set %v), want eu-west", v.AsString(), ok)
+	}
+}
+
+func TestResourceWithoutRegion(t *testing.T) {
+	setForTest(t, &config.Region, "")
+
+	if v, ok := initResource("cart").Set().Value(semconv.CloudRegionKey); ok {
+		t.Fatalf("cloud.region = %q with no REGION, want it unset", v.AsString())
+	}
+}
+
+func TestPrometheusEndpointServesServiceMetrics(t *testing.T) {
+	setForTest(t, &config.MetricsExporter, "prometheus")
+	setForTest(t, &config.PrometheusAddr, "127.0.0.1:0")
+	mp := initMeterProvider(context.Background(), initResource("checkout"))
+	t.Cleanup(func() { mp.Shutdown(context.Background()) })
+
+	orders, err := mp.Meter("checkout").Int64Counter("app.checkout.orders_total")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders.Add(context.Background(), 3)
+
+	srv := httptest.NewServer(prometheusHandler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `app_checkout_orders_total{`) || !strings.Contains(string(body), `service_name="checkout"`) {
+		t.Fatalf("/metrics is missing checkout's app_checkout_orders_total:\n%s", body)
+	}
+}
+
+func TestHistogramExemplarsCarryTraceID(t *testing.T) {
+	for _, tc := range []struct {
+		filter      string
+		inSpan      bool
+		wantTraceID bool
+	}{
+		{filter: "trace_based", inSpan: true, wantTraceID: true},
+		{filter: "trace_based", inSpan: false, wantTraceID: false},
+		{filter: "always_off", inSpan: true, wantTraceID: false},
+	} {
+		t.Run(fmt.Sprintf("%s/in_span=%v", tc.filter, tc.inSpan), func(t *testing.T) {
+			setForTest(t, &config.MetricsExemplarFilter, tc.filter)
+			reader := sdkmetric.NewManualReader()
+			mp := sdkmetric.NewMeterProvider(
+				sdkmetric.WithReader(reader),
+				sdkmetric.WithExemplarFilter(exemplarFilter()),
+			)
+			tp, _ := newTestTracerProvider(t)
+			latency, err := mp.Meter("checkout").Float64Histogram("app.checkout.latency")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := context.Background()
+			var span trace.Span
+			if tc.inSpan {
+				ctx, span = tp.Tracer("checkout").Start(ctx, "PlaceOrder")
+			}
+			latency.Record(ctx, 42)
+			if span != nil {
+				span.End()
+			}
+
+			var rm metricdata.ResourceMetrics
+			if err := reader.Collect(context.Background(), &rm); err != nil {
+				t.Fatal(err)
+			}
+			hist := rm.ScopeMetrics[0].Metrics[0].Data.(metricdata.Histogram[float64])
+			exemplars := hist.DataPoints[0].Exemplars
+			if !tc.wantTraceID {
+				if len(exemplars) != 0 {
+					t.Fatalf("got %d exemplars, want none", len(exemplars))
+				}
+				return
+			}
+			if len(exemplars) != 1 {
+				t.Fatalf("got %d exemplars, want 1", len(exemplars))
+			}
+			want := span.SpanContext().TraceID()
+			if got := trace.TraceID(exemplars[0].TraceID); got != want {
+				t.Fatalf("exemplar trace_id = %s, want the recording span's %s", got, want)
+			}
+		})
+	}
+}
+
+func TestResourceAttributesFromEnv(t *testing.T) {
+	setForTest(t, &config.DeploymentEnvironment, "staging")
+	t.Setenv("OTEL_RESOURCE_ATTRIBUTES", "team=checkout,owner=Jane%20Doe,malformed,deployment.environment=prod")
+
+	attrs := initResource("cart").Set()
+	for key, want := range map[string]string{
+		"team":                   "checkout",
+		"owner":                  "Jane Doe",
+		"deployment.environment": "prod",
+		"container.runtime":      "docker",
+		"service.name":           "cart",
+	} {
+		if v, ok := attrs.Value(attribute.Key(key)); !ok || v.AsString() != want {
+			t.Errorf("%s = %q (set %v), want %q", key, v.AsString(), ok, want)
+		}
+	}
+	if _, ok := attrs.Value("malformed"); ok {
+		t.Error("malformed entry was not skipped")
+	}
+}
+
+func TestDeploymentEnvironmentOverridesDefault(t *testing.T) {
+	setForTest(t, &config.DeploymentEnvironment, "staging")
+	t.Setenv("OTEL_RESOURCE_ATTRIBUTES", "")
+
+	if v, _ := initResource("cart").Set().Value("deployment.environment"); v.AsString() != "staging" {
+		t.Fatalf("deployment.environment = %q, want staging", v.AsString())
+	}
+}
+
+func TestOTelServiceNameDoesNotRenameService(t *testing.T) {
+	t.Setenv("OTEL_SERVICE_NAME", "everything")
+
+	if v, _ := initResource("cart").Set().Value(semconv.ServiceNameKey); v.AsString() != "cart" {
+		t.Fatalf("service.name = %q, want cart", v.AsString())
+	}
+}
+
+func TestSpanBatchOptionsApplyTuning(t *testing.T) {
+	setForTest(t, &config.BSPMaxQueueSize, 8192)
+	setForTest(t, &config.BSPMaxExportBatchSize, 1024)
+	setForTest(t, &config.BSPScheduleDelayMs, 250)
+
+	var got sdktrace.BatchSpanProcessorOptions
+	for _, opt := range spanBatchOptions() {
+		opt(&got)
+	}
+	if got.MaxQueueSize != 8192 || got.MaxExportBatchSize != 1024 || got.BatchTimeout != 250*time.Millisecond {
+		t.Fatalf("options = queue %d, batch %d, timeout %v; want 8192, 1024, 250ms",
+			got.MaxQueueSize, got.MaxExportBatchSize, got.BatchTimeout)
+	}
+}
+
+func TestSpanBatchOptionsKeepSDKDefaultsWhenUnset(t *testing.T) {
+	setForTest(t, &config.BSPMaxQueueSize, 0)
+	setForTest(t, &config.BSPMaxExportBatchSize, 0)
+	setForTest(t, &config.BSPScheduleDelayMs, 0)
+
+	if opts := spanBatchOptions(); len(opts) != 0 {
+		t.Fatalf("got %d options with nothing set, want none", len(opts))
+	}
+}
+
+// logCounter is a log exporter that reports each batch it receives
+type logCounter struct{ batches chan int }
+
+func (l *logCounter) Export(_ context.Context, records []sdklog.Record) error {
+	l.batches <- len(records)
+	return nil
+}
+func (l *logCounter) Shutdown(context.Context) error   { return nil }
+func (l *logCounter) ForceFlush(context.Context) error { return nil }
+
+func TestLogBatchOptionsApplyTuning(t *testing.T) {
+	setForTest(t, &config.BLRPMaxQueueSize, 16)
+	setForTest(t, &config.BLRPMaxExportBatchSize, 2)
+	setForTest(t, &config.BLRPScheduleDelayMs, int(time.Hour/time.Millisecond))
+	exporter := &logCounter{batches: make(chan int, 10)}
+	lp := sdklog.NewLoggerProvider(sdklog.WithProcessor(sdklog.NewBatchProcessor(exporter, logBatchOptions()...)))
+	t.Cleanup(func() { lp.Shutdown(context.Background()) })
+
+	// With an hour-long interval only the batch size can trigger an export
+	logger := lp.Logger("checkout")
+	logger.Emit(context.Background(), otellog.Record{})
+	logger.Emit(context.Background(), otellog.Record{})
+
+	select {
+	case n := <-exporter.batches:
+		if n != 2 {
+			t.Fatalf("exported a batch of %d, want 2", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("full batch of 2 was not exported before the hour-long interval")
+	}
+}
+
+var errExport = errors.New("collector unreachable")
+
+// failingSpanExporter fails to shut down, or blocks every export until the
+// export's context is done when block is set
+type failingSpanExporter struct{ block bool }
+
+func (e failingSpanExporter) ExportSpans(ctx context.Context, _ []sdktrace.ReadOnlySpan) error {
+	if e.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (e failingSpanExporter) Shutdown(context.Context) error {
+	if e.block {
+		return nil
+	}
+	return errExport
+}
+
+// failingLogExporter accepts records but fails to shut down
+type failingLogExporter struct{}
+
+func (failingLogExporter) Export(context.Context, []sdklog.Record) error { return nil }
+func (failingLogExporter) Shutdown(context.Context) error                { return errExport }
+func (failingLogExporter) ForceFlush(context.Context) error              { return nil }
+
+func TestShutdownReturnsEveryFailure(t *testing.T) {
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(failingSpanExporter{}))
+	providers := &TelemetryProviders{
+		TracerProvider: tp,
+		MeterProvider:  sdkmetric.NewMeterProvider(),
+		LoggerProvider: sdklog.NewLoggerProvider(sdklog.WithProcessor(sdklog.NewSimpleProcessor(failingLogExporter{}))),
+		serviceName:    "cart",
+	}
+
+	err := providers.Shutdown(context.Background())
+	if !errors.Is(err, errExport) {
+		t.Fatalf("Shutdown() = %v, want the export failure", err)
+	}
+	for _, want := range []string{"cart tracer provider", "cart logger provider"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Shutdown() = %q, want it to report the %s", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "meter provider") {
+		t.Errorf("Shutdown() = %q, but the meter provider shut down cleanly", err)
+	}
+}
+
+func TestShutdownRespectsDeadline(t *testing.T) {
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(failingSpanExporter{block: true}))
+	_, span := tp.Tracer("test").Start(context.Background(), "stuck")
+	span.End()
+	providers := &TelemetryProviders{TracerProvider: tp, serviceName: "cart"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := providers.Shutdown(ctx)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Shutdown took %v with a 100ms deadline", elapsed)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown() = %v, want the deadline to be reported", err)
+	}
+}
+
+func TestSpansFanOutToEveryExporter(t *testing.T) {
+	exports := startCollector(t)
+	setForTest(t, &config.TelemetryExporter, "otlp, stdout")
+
+	var stdout strings.Builder
+	setForTest(t, &stdoutSpans, io.Writer(&stdout))
+	tp := initTracerProvider(context.Background(), sdkresource.Empty())
+
+	_, span := tp.Tracer("test").Start(context.Background(), "PlaceOrder")
+	span.End()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tp.Shutdown(ctx) // the stub collector never answers, so its export fails
+
+	if !strings.Contains(stdout.String(), `"Name":"PlaceOrder"`) {
+		t.Errorf("stdout exporter wrote %q, want the PlaceOrder span", stdout.String())
+	}
+	select {
+	case <-exports:
+	default:
+		t.Error("OTLP exporter sent nothing to the collector")
+	}
+}
@@ -0,0 +1,103 @@
+package common
+
+import (
+	"log"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// dropRule removes key from instruments whose name matches pattern
+type dropRule struct {
+	pattern string
+	key     attribute.Key
+}
+
+// parseDropAttrs parses METRICS_DROP_ATTRS entries of the form
+// "instrument=attribute", where instrument may use * wildcards, e.g.
+// "app.currency_counter=from_currency,app.cart.*=app.user.id"
+func parseDropAttrs(raw string) []dropRule {
+	var rules []dropRule
+	for _, entry := range strings.Split(raw, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		pattern, key, ok := strings.Cut(entry, "=")
+		pattern, key = strings.TrimSpace(pattern), strings.TrimSpace(key)
+		if _, err := path.Match(pattern, ""); !ok || pattern == "" || key == "" || err != nil {
+			log.Printf("skipping malformed metric attribute drop %q", entry)
+			continue
+		}
+		rules = append(rules, dropRule{pattern: pattern, key: attribute.Key(key)})
+	}
+	return rules
+}
+
+// defaultLatencyBuckets suit the demo's millisecond-scale latencies better
+// than the SDK's default boundaries
+var defaultLatencyBuckets = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000}
+
+// parseBuckets parses METRICS_LATENCY_BUCKETS, a comma-separated ascending
+// list of millisecond boundaries, falling back to defaultLatencyBuckets
+func parseBuckets(raw string) []float64 {
+	if strings.TrimSpace(raw) == "" {
+		return defaultLatencyBuckets
+	}
+	var buckets []float64
+	for _, entry := range strings.Split(raw, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(entry), 64)
+		if err != nil {
+			log.Printf("invalid latency bucket %q, using defaults", entry)
+			return defaultLatencyBuckets
+		}
+		buckets = append(buckets, b)
+	}
+	if !slices.IsSorted(buckets) {
+		log.Printf("latency buckets %q are not ascending, using defaults", raw)
+		return defaultLatencyBuckets
+	}
+	return buckets
+}
+
+// isLatencyHistogram reports whether inst is one of our millisecond
+// *.latency or *.duration histograms
+func isLatencyHistogram(inst sdkmetric.Instrument) bool {
+	return inst.Kind == sdkmetric.InstrumentKindHistogram && inst.Unit == "ms" &&
+		(strings.HasSuffix(inst.Name, ".latency") || strings.HasSuffix(inst.Name, ".duration"))
+}
+
+// metricView applies the configured attribute drops and gives latency
+// histograms explicit bucket boundaries. It is a single view rather than one
+// per concern because every matching view adds its own stream, and an
+// instrument matched twice would be exported twice.
+func metricView(rules []dropRule, buckets []float64) sdkmetric.View {
+	return func(inst sdkmetric.Instrument) (sdkmetric.Stream, bool) {
+		var drop []attribute.Key
+		for _, r := range rules {
+			if ok, _ := path.Match(r.pattern, inst.Name); ok {
+				drop = append(drop, r.key)
+			}
+		}
+		latency := isLatencyHistogram(inst)
+		if len(drop) == 0 && !latency {
+			return sdkmetric.Stream{}, false
+		}
+
+		stream := sdkmetric.Stream{
+			Name:        inst.Name,
+			Description: inst.Description,
+			Unit:        inst.Unit,
+		}
+		if len(drop) > 0 {
+			stream.AttributeFilter = attribute.NewDenyKeysFilter(drop...)
+		}
+		if latency {
+			stream.Aggregation = sdkmetric.AggregationExplicitBucketHistogram{Boundaries: buckets}
+		}
+		return stream, true
+	}
+}
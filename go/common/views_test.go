@@ -0,0 +1,114 @@
+package common
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// collectWithView records through a meter provider with view and
+// returns the named metric as collected
+func collectWithView(t *testing.T, view sdkmetric.View, name string, record func(metric.Meter)) metricdata.Metrics {
+	t.Helper()
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader), sdkmetric.WithView(view))
+	t.Cleanup(func() { mp.Shutdown(context.Background()) })
+	record(mp.Meter("test"))
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == name {
+				return m
+			}
+		}
+	}
+	t.Fatalf("no %s metric collected", name)
+	return metricdata.Metrics{}
+}
+
+func TestMetricViewDropsConfiguredAttribute(t *testing.T) {
+	view := metricView(parseDropAttrs("app.currency_counter=from_currency"), defaultLatencyBuckets)
+	m := collectWithView(t, view, "app.currency_counter", func(meter metric.Meter) {
+		counter, _ := meter.Int64Counter("app.currency_counter")
+		for _, from := range []string{"USD", "EUR", "JPY"} {
+			counter.Add(context.Background(), 1, metric.WithAttributes(
+				attribute.String("currency_code", "GBP"),
+				attribute.String("from_currency", from),
+			))
+		}
+	})
+
+	points := m.Data.(metricdata.Sum[int64]).DataPoints
+	if len(points) != 1 {
+		t.Fatalf("got %d series, want the three from_currency values merged into one", len(points))
+	}
+	attrs := points[0].Attributes
+	if _, ok := attrs.Value("from_currency"); ok {
+		t.Fatalf("from_currency still recorded: %v", attrs.ToSlice())
+	}
+	if v, ok := attrs.Value("currency_code"); !ok || v.AsString() != "GBP" {
+		t.Fatalf("currency_code = %v, want it kept as GBP", v)
+	}
+	if points[0].Value != 3 {
+		t.Fatalf("merged value = %d, want 3", points[0].Value)
+	}
+}
+
+func TestMetricViewLeavesOtherInstrumentsAlone(t *testing.T) {
+	view := metricView(parseDropAttrs("app.cart.*=app.user.id"), defaultLatencyBuckets)
+	m := collectWithView(t, view, "app.checkout.orders", func(meter metric.Meter) {
+		counter, _ := meter.Int64Counter("app.checkout.orders")
+		counter.Add(context.Background(), 1, metric.WithAttributes(attribute.String("app.user.id", "u1")))
+	})
+
+	attrs := m.Data.(metricdata.Sum[int64]).DataPoints[0].Attributes
+	if _, ok := attrs.Value("app.user.id"); !ok {
+		t.Fatal("app.user.id dropped from an instrument the rule doesn't match")
+	}
+}
+
+func TestLatencyHistogramsUseConfiguredBuckets(t *testing.T) {
+	for _, tt := range []struct {
+		name, raw string
+		want      []float64
+	}{
+		{name: "defaults", want: defaultLatencyBuckets},
+		{name: "configured", raw: "2, 20, 200", want: []float64{2, 20, 200}},
+		{name: "invalid", raw: "20,2", want: defaultLatencyBuckets},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			view := metricView(nil, parseBuckets(tt.raw))
+			m := collectWithView(t, view, "app.payment.latency", func(meter metric.Meter) {
+				hist, _ := meter.Float64Histogram("app.payment.latency", metric.WithUnit("ms"))
+				hist.Record(context.Background(), 7)
+			})
+
+			bounds := m.Data.(metricdata.Histogram[float64]).DataPoints[0].Bounds
+			if !slices.Equal(bounds, tt.want) {
+				t.Fatalf("bounds = %v, want %v", bounds, tt.want)
+			}
+		})
+	}
+}
+
+func TestNonLatencyHistogramKeepsSDKBuckets(t *testing.T) {
+	view := metricView(nil, []float64{2, 20, 200})
+	m := collectWithView(t, view, "app.cart.size", func(meter metric.Meter) {
+		hist, _ := meter.Int64Histogram("app.cart.size")
+		hist.Record(context.Background(), 3)
+	})
+
+	bounds := m.Data.(metricdata.Histogram[int64]).DataPoints[0].Bounds
+	if slices.Equal(bounds, []float64{2, 20, 200}) {
+		t.Fatalf("app.cart.size got the latency buckets %v", bounds)
+	}
+}
@@ -1,6 +1,16 @@
 package config
 
-import "os"
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
 
 func getEnv(key, fallback string) string {
 	if v := os.Getenv(key); v != "" {
@@ -9,18 +19,392 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+func getEnvInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("invalid integer for %s=%q, using %d: %v", key, v, fallback, err)
+		return fallback
+	}
+	return n
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Printf("invalid number for %s=%q, using %g: %v", key, v, fallback, err)
+		return fallback
+	}
+	return f
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("invalid boolean for %s=%q, using %t: %v", key, v, fallback, err)
+		return fallback
+	}
+	return b
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("invalid duration for %s=%q, using %s: %v", key, v, fallback, err)
+		return fallback
+	}
+	return d
+}
+
+// Region is stamped on the resource as cloud.region and selects the
+// region-specific downstream URLs; empty means a single, untagged region
+var Region = getEnv("REGION", "")
+
+// getRegionalEnv prefers KEY_<REGION> (e.g. CART_URL_EU for REGION=eu) over
+// KEY when REGION is set, so one environment can describe every region
+func getRegionalEnv(key, fallback string) string {
+	if Region != "" {
+		suffix := strings.ToUpper(strings.ReplaceAll(Region, "-", "_"))
+		if v := os.Getenv(key + "_" + suffix); v != "" {
+			return v
+		}
+	}
+	return getEnv(key, fallback)
+}
+
 var (
-	FrontendURL       = getEnv("FRONTEND_URL", "http://localhost:8080")
-	PaymentURL        = getEnv("PAYMENT_URL", "http://localhost:8081")
-	ShippingURL       = getEnv("SHIPPING_URL", "http://localhost:8082")
-	CheckoutURL       = getEnv("CHECKOUT_URL", "http://localhost:8083")
-	CartURL           = getEnv("CART_URL", "http://localhost:8084")
-	ProductCatalogURL = getEnv("PRODUCT_CATALOG_URL", "http://localhost:8085")
-	RecommendationURL = getEnv("RECOMMENDATION_URL", "http://localhost:8086")
-	AdURL             = getEnv("AD_URL", "http://localhost:8087")
-	EmailURL          = getEnv("EMAIL_URL", "http://localhost:8088")
-	CurrencyURL       = getEnv("CURRENCY_URL", "http://localhost:8089")
-	AccountingURL     = getEnv("ACCOUNTING_URL", "http://localhost:8091")
-	FraudDetectionURL = getEnv("FRAUD_DETECTION_URL", "http://localhost:8092")
-	QuoteURL          = getEnv("QUOTE_URL", "http://localhost:8094")
+	FrontendURL       = getRegionalEnv("FRONTEND_URL", "http://localhost:8080")
+	PaymentURL        = getRegionalEnv("PAYMENT_URL", "http://localhost:8081")
+	ShippingURL       = getRegionalEnv("SHIPPING_URL", "http://localhost:8082")
+	CheckoutURL       = getRegionalEnv("CHECKOUT_URL", "http://localhost:8083")
+	CartURL           = getRegionalEnv("CART_URL", "http://localhost:8084")
+	ProductCatalogURL = getRegionalEnv("PRODUCT_CATALOG_URL", "http://localhost:8085")
+	RecommendationURL = getRegionalEnv("RECOMMENDATION_URL", "http://localhost:8086")
+	AdURL             = getRegionalEnv("AD_URL", "http://localhost:8087")
+	EmailURL          = getRegionalEnv("EMAIL_URL", "http://localhost:8088")
+	CurrencyURL       = getRegionalEnv("CURRENCY_URL", "http://localhost:8089")
+	AccountingURL     = getRegionalEnv("ACCOUNTING_URL", "http://localhost:8091")
+	FraudDetectionURL = getRegionalEnv("FRAUD_DETECTION_URL", "http://localhost:8092")
+	QuoteURL          = getRegionalEnv("QUOTE_URL", "http://localhost:8094")
+	// FraudDLQURL receives fraudulent orders; empty makes the publish a no-op
+	FraudDLQURL = getEnv("FRAUD_DLQ_URL", "")
 )
+
+// serviceURLs names the downstream URL variables above
+func serviceURLs() []struct {
+	name string
+	v    *string
+} {
+	return []struct {
+		name string
+		v    *string
+	}{
+		{"frontend", &FrontendURL},
+		{"payment", &PaymentURL},
+		{"shipping", &ShippingURL},
+		{"checkout", &CheckoutURL},
+		{"cart", &CartURL},
+		{"product-catalog", &ProductCatalogURL},
+		{"recommendation", &RecommendationURL},
+		{"ad", &AdURL},
+		{"email", &EmailURL},
+		{"currency", &CurrencyURL},
+		{"accounting", &AccountingURL},
+		{"fraud-detection", &FraudDetectionURL},
+		{"quote", &QuoteURL},
+	}
+}
+
+// ServiceURLs returns the effective downstream URLs keyed by service name
+func ServiceURLs() map[string]string {
+	urls := make(map[string]string)
+	for _, u := range serviceURLs() {
+		urls[u.name] = *u.v
+	}
+	return urls
+}
+
+// URLFlags registers a -<name>-url flag on fs for each downstream URL, bound to
+// the variables above. Their defaults are the env-derived values, so after
+// fs.Parse the precedence is flag > env > built-in default.
+func URLFlags(fs *flag.FlagSet) {
+	for _, u := range serviceURLs() {
+		fs.StringVar(u.v, u.name+"-url", *u.v, "Base URL of the "+u.name+" service")
+	}
+}
+
+// Validate checks that every downstream URL is absolute (scheme and host), so
+// a typo such as "localhost:8084" fails at startup rather than deep inside a
+// request. All bad entries are reported together.
+func Validate() error {
+	var errs []error
+	for _, u := range serviceURLs() {
+		if err := validateURL(*u.v); err != nil {
+			errs = append(errs, fmt.Errorf("%s URL: %w", u.name, err))
+		}
+	}
+	if FraudDLQURL != "" {
+		if err := validateURL(FraudDLQURL); err != nil {
+			errs = append(errs, fmt.Errorf("fraud DLQ URL: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validateURL(raw string) error {
+	u, err := url.Parse(raw)
+	switch {
+	case err != nil:
+		return err
+	case u.Scheme == "" || u.Opaque != "": // "localhost:8084" parses as scheme "localhost"
+		return fmt.Errorf("%q has no scheme (want e.g. http://host:port)", raw)
+	case u.Host == "":
+		return fmt.Errorf("%q has no host", raw)
+	}
+	return nil
+}
+
+// RedisAddr is the Redis server used by cart and accounting
+var RedisAddr = getEnv("REDIS_ADDR", "localhost:6379")
+
+// OTLPCompression is "gzip" or "none" (default) for all OTLP exporters
+var OTLPCompression = getEnv("OTEL_EXPORTER_OTLP_COMPRESSION", "none")
+
+// OTLP endpoint and protocol from the standard variables, as reported at
+// startup. The Go exporters only speak gRPC, so another protocol is ignored.
+var (
+	OTLPEndpoint = getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "localhost:4317")
+	OTLPProtocol = getEnv("OTEL_EXPORTER_OTLP_PROTOCOL", "grpc")
+)
+
+// Trace sampler settings from the standard variables, as reported at startup
+var (
+	TracesSampler    = getEnv("OTEL_TRACES_SAMPLER", "parentbased_always_on")
+	TracesSamplerArg = getEnv("OTEL_TRACES_SAMPLER_ARG", "")
+)
+
+// DeploymentEnvironment is the deployment.environment resource attribute;
+// an entry in OTEL_RESOURCE_ATTRIBUTES (read by the SDK) overrides it
+var DeploymentEnvironment = getEnv("DEPLOYMENT_ENVIRONMENT", "demo")
+
+// SampleErrors exports spans that end with an error status or
+// app.force_sample=true even when OTEL_TRACES_SAMPLER dropped them. Off by
+// default: every dropped span is then still recorded until it ends.
+var SampleErrors = getEnvBool("SAMPLE_ERRORS", false)
+
+// TelemetryExporter selects the span exporters, each with its own batch
+// processor: "otlp", "stdout", or both as a comma-separated list ("otlp,stdout")
+var TelemetryExporter = getEnv("TELEMETRY_EXPORTER", "otlp")
+
+var (
+	// MetricsExporter selects the metric readers: "otlp", "prometheus", or both
+	// as a comma-separated list ("otlp,prometheus")
+	MetricsExporter = getEnv("METRICS_EXPORTER", "otlp")
+	PrometheusAddr  = getEnv("PROMETHEUS_ADDR", ":9464")
+	// MetricsExemplarFilter is "trace_based" (default), "always_on", or "always_off"
+	MetricsExemplarFilter = getEnv("OTEL_METRICS_EXEMPLAR_FILTER", "trace_based")
+	// MetricsDropAttrs strips attributes from matching instruments to cap
+	// cardinality, e.g. "app.currency_counter=from_currency,app.cart.*=app.user.id"
+	MetricsDropAttrs = getEnv("METRICS_DROP_ATTRS", "")
+	// MetricsLatencyBuckets overrides the millisecond bucket boundaries of the
+	// *.latency and *.duration histograms; empty uses 1,5,10,...,1000
+	MetricsLatencyBuckets = getEnv("METRICS_LATENCY_BUCKETS", "")
+)
+
+// RandSeed seeds the mock data generator for reproducible runs; empty seeds
+// from the clock. main replaces it with the resolved seed once flags are parsed.
+var RandSeed = getEnv("RAND_SEED", "")
+
+// AttrCardinalityLimit buckets high-cardinality span attributes (user IDs)
+// into this many values; 0 keeps raw values
+var AttrCardinalityLimit = getEnvInt("ATTR_CARDINALITY_LIMIT", 0)
+
+// RedactAttrs lists span attribute keys whose values are hashed before export,
+// e.g. "app.user.id,app.user.email"
+var RedactAttrs = getEnv("REDACT_ATTRS", "")
+
+// ProductWeights sets product popularity as "ID=weight,..."; unlisted products
+// weigh 1, so the default is uniform
+var ProductWeights = getEnv("PRODUCT_WEIGHTS", "")
+
+// ProductCatalogSize grows the catalog to this many products by appending
+// synthetic ones to the built-in nine; smaller values keep the built-ins
+var ProductCatalogSize = getEnvInt("PRODUCT_CATALOG_SIZE", 0)
+
+// ProductNotFoundRate is the fraction of product lookups answered with 404
+// even though the product exists, to populate error dashboards
+var ProductNotFoundRate = getEnvFloat("PRODUCT_NOTFOUND_RATE", 0)
+
+// KafkaBrokers is a comma-separated broker list; when empty the orders topic
+// is mocked over HTTP
+var KafkaBrokers = getEnv("KAFKA_BROKERS", "")
+
+// KafkaPartitions is how many partitions the mocked orders topic has; each
+// order is assigned one by hashing its ID
+var KafkaPartitions = getEnvInt("KAFKA_PARTITIONS", 3)
+
+// TraceDepth nests this many synthetic level-N spans under checkout's
+// getProductDetails for demoing deep traces; 0 adds none
+var TraceDepth = getEnvInt("TRACE_DEPTH", 0)
+
+// BaseCurrency anchors the currency service's rate table at 1.0 and is what
+// checkout converts from; it must be one of the supported currencies
+var BaseCurrency = getEnv("BASE_CURRENCY", "USD")
+
+// CurrencyFuzz makes the currency service random-walk each rate within 1% of
+// its base value, like a live market feed
+var CurrencyFuzz = getEnvBool("CURRENCY_FUZZ", false)
+
+// CurrencyLatency delays conversions into specific currencies, e.g.
+// "JPY=200ms,INR=50ms"; empty adds no delay
+var CurrencyLatency = getEnv("CURRENCY_LATENCY", "")
+
+// CurrencyFail makes /convert answer 500 for conversions into this currency,
+// e.g. "JPY"; empty fails none
+var CurrencyFail = getEnv("CURRENCY_FAIL", "")
+
+// CurrencyCacheSize and CurrencyCacheTTL bound the /convert rate cache; a
+// size of 0 disables it. The cache is bypassed while CurrencyFuzz is on.
+var (
+	CurrencyCacheSize = getEnvInt("CURRENCY_CACHE_SIZE", 64)
+	CurrencyCacheTTL  = getEnvDuration("CURRENCY_CACHE_TTL", time.Minute)
+)
+
+// CartTTL is how long a cart lives in Redis after its first item is added
+var CartTTL = getEnvDuration("CART_TTL", time.Hour)
+
+// IdempotencyTTL is how long checkout remembers an Idempotency-Key's result
+var IdempotencyTTL = getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour)
+
+// OrderStatusTTL is how long checkout keeps an order's status for GET /orders/{id}
+var OrderStatusTTL = getEnvDuration("ORDER_STATUS_TTL", 24*time.Hour)
+
+// HTTP server timeouts shared by every service (see common.NewServer)
+var (
+	HTTPReadTimeout  = getEnvDuration("HTTP_READ_TIMEOUT", 10*time.Second)
+	HTTPWriteTimeout = getEnvDuration("HTTP_WRITE_TIMEOUT", 30*time.Second)
+	HTTPIdleTimeout  = getEnvDuration("HTTP_IDLE_TIMEOUT", 120*time.Second)
+)
+
+// RequestTimeout bounds each service endpoint; slower requests get a 503 and
+// a request_timeout span event (see common.Timeout). Keep it under
+// HTTPWriteTimeout so the 503 reaches the client; 0 disables it.
+var RequestTimeout = getEnvDuration("REQUEST_TIMEOUT", 25*time.Second)
+
+// DryRun makes checkout log its downstream requests and answer them with
+// canned responses instead of calling out (also settable via -dry-run)
+var DryRun = getEnvBool("DRY_RUN", false)
+
+// DebugSpans keeps the last DebugSpansSize finished spans in memory and serves
+// them from GET /debug/spans on every Go service, for checking instrumentation
+// without a backend
+var (
+	DebugSpans     = getEnvBool("DEBUG_SPANS", false)
+	DebugSpansSize = getEnvInt("DEBUG_SPANS_SIZE", 100)
+)
+
+// ExposeTraceID makes every service echo the request's trace ID in an
+// X-Trace-Id response header (see common.ExposeTraceID)
+var ExposeTraceID = getEnvBool("EXPOSE_TRACE_ID", false)
+
+// PaddingBytes appends this much whitespace to successful product-catalog and
+// cart responses to simulate larger payloads (see common.PadResponse)
+var PaddingBytes = getEnvInt("PADDING_BYTES", 0)
+
+// HTTPClientTimeout bounds each outgoing call made with common.NewHTTPClient
+var HTTPClientTimeout = getEnvDuration("HTTP_CLIENT_TIMEOUT", 30*time.Second)
+
+// Connection pool limits per downstream host for common.NewHTTPClient; 0 keeps
+// Go's defaults (2 idle, unlimited total)
+var (
+	HTTPMaxIdleConnsPerHost = getEnvInt("HTTP_MAX_IDLE_CONNS_PER_HOST", 0)
+	HTTPMaxConnsPerHost     = getEnvInt("HTTP_MAX_CONNS_PER_HOST", 0)
+)
+
+// HealthProbeTimeout bounds each dependency probe made by checkout's /status
+var HealthProbeTimeout = getEnvDuration("HEALTH_PROBE_TIMEOUT", 2*time.Second)
+
+// StartupTimeout bounds how long batch checkout waits for its Go dependencies
+var StartupTimeout = getEnvDuration("STARTUP_TIMEOUT", 30*time.Second)
+
+// ShutdownTimeout bounds how long telemetry gets to flush on exit
+var ShutdownTimeout = getEnvDuration("SHUTDOWN_TIMEOUT", 5*time.Second)
+
+// Retry policy for checkout's downstream calls (see common.DoWithRetry)
+var (
+	RetryMaxAttempts = getEnvInt("RETRY_MAX_ATTEMPTS", 3)
+	RetryBaseBackoff = getEnvDuration("RETRY_BASE_BACKOFF", 100*time.Millisecond)
+)
+
+// Circuit breaker applied per downstream by common.NewHTTPClient
+var (
+	CircuitFailureThreshold = getEnvInt("CIRCUIT_FAILURE_THRESHOLD", 5)
+	CircuitCooldown         = getEnvDuration("CIRCUIT_COOLDOWN", 10*time.Second)
+)
+
+// QuoteDeterministic drops the random jitter from locally calculated
+// shipping quotes, so equal item counts always get equal quotes
+var QuoteDeterministic = getEnvBool("QUOTE_DETERMINISTIC", false)
+
+// FreeShippingThreshold makes shipping quote zero for orders whose amount
+// param, converted to USD, exceeds it; 0 disables free shipping
+var FreeShippingThreshold = getEnvFloat("FREE_SHIPPING_THRESHOLD", 0)
+
+// Fraud detection rules; a zero threshold or limit disables that rule
+var (
+	FraudRate            = getEnvFloat("FRAUD_RATE", 0.02)
+	FraudAmountThreshold = getEnvFloat("FRAUD_AMOUNT_THRESHOLD", 0)
+	FraudVelocityLimit   = getEnvInt("FRAUD_VELOCITY_LIMIT", 0)
+	FraudVelocityWindow  = getEnvDuration("FRAUD_VELOCITY_WINDOW", time.Minute)
+)
+
+// ConsumerFailureRate is the fraction of mocked orders deliveries that the
+// accounting and fraud consumers fail with a 500, forcing checkout to retry
+var ConsumerFailureRate = getEnvFloat("CONSUMER_FAILURE_RATE", 0)
+
+// Accounting's /consume worker pool: messages queue for AccountingWorkers
+// workers, each taking AccountingProcessDelay extra per message; when
+// AccountingQueueSize are waiting, /consume answers 429
+var (
+	AccountingWorkers      = getEnvInt("ACCOUNTING_WORKERS", 4)
+	AccountingQueueSize    = getEnvInt("ACCOUNTING_QUEUE_SIZE", 100)
+	AccountingProcessDelay = getEnvDuration("ACCOUNTING_PROCESS_DELAY", 0)
+)
+
+// Batch processor tuning for spans (OTEL_BSP_*) and logs (OTEL_BLRP_*).
+// Delays are in milliseconds as in the OTel spec; 0 keeps the SDK default.
+var (
+	BSPMaxQueueSize       = getEnvInt("OTEL_BSP_MAX_QUEUE_SIZE", 0)
+	BSPMaxExportBatchSize = getEnvInt("OTEL_BSP_MAX_EXPORT_BATCH_SIZE", 0)
+	BSPScheduleDelayMs    = getEnvInt("OTEL_BSP_SCHEDULE_DELAY", 0)
+
+	BLRPMaxQueueSize       = getEnvInt("OTEL_BLRP_MAX_QUEUE_SIZE", 0)
+	BLRPMaxExportBatchSize = getEnvInt("OTEL_BLRP_MAX_EXPORT_BATCH_SIZE", 0)
+	BLRPScheduleDelayMs    = getEnvInt("OTEL_BLRP_SCHEDULE_DELAY", 0)
+)
+
+// LogLevelFor returns the log level for a service: LOG_LEVEL_<SERVICE> (e.g.
+// LOG_LEVEL_PRODUCT_CATALOG), then LOG_LEVEL, then "info"
+func LogLevelFor(service string) string {
+	key := "LOG_LEVEL_" + strings.ToUpper(strings.ReplaceAll(service, "-", "_"))
+	return getEnv(key, getEnv("LOG_LEVEL", "info"))
+}
+
+// AdminToken enables POST /admin/outage on every Go service; requests must
+// send it as "Authorization: Bearer <token>". Empty leaves the endpoint off.
+var AdminToken = getEnv("ADMIN_TOKEN", "")
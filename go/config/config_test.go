@@ -0,0 +1,109 @@
+package config
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+func TestGetRegionalEnv(t *testing.T) {
+	old := Region
+	t.Cleanup(func() { Region = old })
+	t.Setenv("CART_URL", "http://cart:8084")
+	t.Setenv("CART_URL_EU_WEST", "http://cart.eu-west:8084")
+
+	tests := []struct {
+		region, key, want string
+	}{
+		{"", "CART_URL", "http://cart:8084"},
+		{"eu-west", "CART_URL", "http://cart.eu-west:8084"},
+		{"EU-West", "CART_URL", "http://cart.eu-west:8084"},
+		{"us-east", "CART_URL", "http://cart:8084"},
+		{"eu-west", "QUOTE_URL", "http://localhost:8094"},
+	}
+	for _, tt := range tests {
+		Region = tt.region
+		if got := getRegionalEnv(tt.key, "http://localhost:8094"); got != tt.want {
+			t.Errorf("REGION=%q %s = %q, want %q", tt.region, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestGetEnvDurationRejectsInvalid(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", time.Hour},
+		{"90m", 90 * time.Minute},
+		{"soon", time.Hour},
+		{"30", time.Hour},
+	}
+	for _, tt := range tests {
+		t.Setenv("CART_TTL", tt.value)
+		if got := getEnvDuration("CART_TTL", time.Hour); got != tt.want {
+			t.Errorf("CART_TTL=%q gives %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestURLFlagPrecedence(t *testing.T) {
+	oldCart, oldRegion := CartURL, Region
+	t.Cleanup(func() { CartURL, Region = oldCart, oldRegion })
+	Region = ""
+
+	tests := []struct {
+		name, env string
+		args      []string
+		want      string
+	}{
+		{name: "default", want: "http://localhost:8084"},
+		{name: "env over default", env: "http://cart.env:8084", want: "http://cart.env:8084"},
+		{name: "flag over env", env: "http://cart.env:8084", args: []string{"-cart-url", "http://cart.flag:8084"}, want: "http://cart.flag:8084"},
+		{name: "flag over default", args: []string{"-cart-url=http://cart.flag:8084"}, want: "http://cart.flag:8084"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CART_URL", tt.env)
+			// As at startup: env first, then flags on top
+			CartURL = getRegionalEnv("CART_URL", "http://localhost:8084")
+			fs := flag.NewFlagSet("otel-mock", flag.ContinueOnError)
+			URLFlags(fs)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if CartURL != tt.want {
+				t.Fatalf("CartURL = %q, want %q", CartURL, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateURLs(t *testing.T) {
+	old := CartURL
+	t.Cleanup(func() { CartURL = old })
+
+	tests := []struct {
+		url, wantErr string
+	}{
+		{"http://cart:8084", ""},
+		{"https://cart.example.com", ""},
+		{"cart:8084", `cart URL: "cart:8084" has no scheme (want e.g. http://host:port)`},
+		{"localhost:8084", `cart URL: "localhost:8084" has no scheme (want e.g. http://host:port)`},
+		{"/cart", `cart URL: "/cart" has no scheme (want e.g. http://host:port)`},
+		{"http://", `cart URL: "http://" has no host`},
+		{"http:///cart", `cart URL: "http:///cart" has no host`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			CartURL = tt.url
+			err := Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Validate() = %v, want nil", err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Fatalf("Validate() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -3,50 +3,141 @@ package main
 import (
 	"context"
 	"flag"
+	"hash/fnv"
 	"log"
+	"os"
+	"os/signal"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"otel-mock/common"
+	"otel-mock/config"
 	"otel-mock/services"
 )
 
 func main() {
-	service := flag.String("service", "all", "Service to run: all, checkout, shipping, product-catalog, cart, currency")
+	service := flag.String("service", "all", "Service to run: all, checkout, shipping, product-catalog, cart, currency, loadgen")
 	count := flag.Int("count", 1, "Number of orders to place (only for checkout)")
+	concurrency := flag.Int("concurrency", 1, "Number of workers placing the -count orders concurrently (only for checkout)")
+	orderTimeout := flag.Duration("order-timeout", 30*time.Second, "Maximum time for each batch checkout order")
+	rps := flag.Int("rps", 10, "Target checkout requests per second (only for loadgen)")
+	duration := flag.Duration("duration", 30*time.Second, "How long to generate load (only for loadgen)")
+	workers := flag.Int("workers", 10, "Number of concurrent load generator workers (only for loadgen)")
+	synthetic := flag.Bool("synthetic", false, "Tag load generator requests as synthetic via baggage (only for loadgen)")
+	seed := flag.String("seed", config.RandSeed, "Seed for reproducible mock data (default: RAND_SEED, else time-based)")
+	flag.BoolVar(&config.DryRun, "dry-run", config.DryRun, "Log checkout's downstream calls and return canned responses instead of making them (default: DRY_RUN)")
+	config.URLFlags(flag.CommandLine)
 	flag.Parse()
 
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+
+	if *seed != "" {
+		n, err := strconv.ParseInt(*seed, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid seed %q: %v", *seed, err)
+		}
+		baseSeed = n
+	}
+	// Record the seed actually used so the startup banner can reproduce a
+	// time-seeded run
+	config.RandSeed = strconv.FormatInt(baseSeed, 10)
+
 	ctx := context.Background()
+	defer exitOnTelemetryFailure()
+
+	// The first SIGINT/SIGTERM stops a checkout batch between orders and
+	// drains every server, after which telemetry is flushed on the way out
+	runCtx, stop := signalContext(ctx)
+	defer stop()
+	context.AfterFunc(runCtx, common.ShutdownServers)
+
+	if *concurrency <= 0 {
+		log.Fatalf("-concurrency must be positive")
+	}
 
 	switch *service {
 	case "all":
-		runAllServices(ctx, *count)
+		runAllServices(ctx, runCtx, *count, *concurrency, *orderTimeout)
 	case "checkout":
 		tel := common.InitTelemetry(ctx, "checkout")
-		defer tel.Shutdown(ctx)
-		services.RunCheckoutService(*count, tel.TracerProvider, tel.LoggerProvider)
+		defer shutdownTelemetry(ctx, tel)
+		services.RunCheckoutService(runCtx, *count, *concurrency, *orderTimeout, newRNG("checkout-batch"), tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
 	case "shipping":
 		tel := common.InitTelemetry(ctx, "shipping")
-		defer tel.Shutdown(ctx)
-		services.RunShippingService(tel.TracerProvider, tel.LoggerProvider)
+		defer shutdownTelemetry(ctx, tel)
+		services.RunShippingService(newRNG("shipping"), tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
 	case "product-catalog":
 		tel := common.InitTelemetry(ctx, "product-catalog")
-		defer tel.Shutdown(ctx)
-		services.RunProductCatalogService(tel.TracerProvider, tel.LoggerProvider)
+		defer shutdownTelemetry(ctx, tel)
+		services.RunProductCatalogService(newRNG("product-catalog"), tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
 	case "cart":
 		tel := common.InitTelemetry(ctx, "cart")
-		defer tel.Shutdown(ctx)
-		services.RunCartService(tel.TracerProvider, tel.LoggerProvider)
+		defer shutdownTelemetry(ctx, tel)
+		services.RunCartService(newRNG("cart"), tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
 	case "currency":
 		tel := common.InitTelemetry(ctx, "currency")
-		defer tel.Shutdown(ctx)
-		services.RunCurrencyService(tel.TracerProvider, tel.LoggerProvider)
+		defer shutdownTelemetry(ctx, tel)
+		services.RunCurrencyService(newRNG("currency"), tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
+	case "loadgen":
+		if *rps <= 0 || *workers <= 0 {
+			log.Fatalf("-rps and -workers must be positive")
+		}
+		tel := common.InitTelemetry(ctx, "loadgen")
+		defer shutdownTelemetry(ctx, tel)
+		res := services.RunLoadGenerator(runCtx, *rps, *workers, *duration, *synthetic, tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
+		log.Printf("Load generator: %d requests in %s (%.1f rps), %d errors (%.1f%%)",
+			res.Requests, res.Elapsed.Round(time.Millisecond), res.AchievedRPS, res.Errors, res.ErrorRate*100)
 	default:
 		log.Fatalf("Unknown service: %s", *service)
 	}
 }
 
-func runAllServices(ctx context.Context, count int) {
+// telemetryFailed is set when any service's telemetry failed to flush
+var telemetryFailed atomic.Bool
+
+// shutdownTelemetry shuts tel down, noting a failed flush for exitOnTelemetryFailure
+func shutdownTelemetry(ctx context.Context, tel *common.TelemetryProviders) {
+	if err := tel.Shutdown(ctx); err != nil {
+		telemetryFailed.Store(true)
+	}
+}
+
+// exitOnTelemetryFailure exits nonzero if telemetry couldn't be flushed; it
+// is deferred first in main so it runs after every shutdown
+func exitOnTelemetryFailure() {
+	if telemetryFailed.Load() {
+		log.Printf("Telemetry was not fully flushed")
+		os.Exit(1)
+	}
+}
+
+// signalContext returns a context cancelled by the first SIGINT or SIGTERM.
+// The default handling is restored once it fires, so a second signal exits.
+func signalContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+	context.AfterFunc(ctx, stop)
+	return ctx, stop
+}
+
+// baseSeed seeds every service's RNG; time-based unless -seed/RAND_SEED is set
+var baseSeed = time.Now().UnixNano()
+
+// newRNG gives each service its own random sequence derived from baseSeed, so
+// a seeded run is reproducible regardless of how services interleave
+func newRNG(service string) services.RNG {
+	h := fnv.New64a()
+	h.Write([]byte(service))
+	return services.NewRNG(baseSeed ^ int64(h.Sum64()))
+}
+
+// runAllServices runs every service in this process; ctx is used for
+// telemetry setup and shutdown, runCtx stops the checkout batch
+func runAllServices(ctx, runCtx context.Context, count, concurrency int, orderTimeout time.Duration) {
 	var wg sync.WaitGroup
 
 	// Start servers first
@@ -54,32 +145,32 @@ func runAllServices(ctx context.Context, count int) {
 	go func() {
 		defer wg.Done()
 		tel := common.InitTelemetry(ctx, "shipping")
-		defer tel.Shutdown(ctx)
-		services.RunShippingService(tel.TracerProvider, tel.LoggerProvider)
+		defer shutdownTelemetry(ctx, tel)
+		services.RunShippingService(newRNG("shipping"), tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
 	}()
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		tel := common.InitTelemetry(ctx, "product-catalog")
-		defer tel.Shutdown(ctx)
-		services.RunProductCatalogService(tel.TracerProvider, tel.LoggerProvider)
+		defer shutdownTelemetry(ctx, tel)
+		services.RunProductCatalogService(newRNG("product-catalog"), tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
 	}()
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		tel := common.InitTelemetry(ctx, "cart")
-		defer tel.Shutdown(ctx)
-		services.RunCartService(tel.TracerProvider, tel.LoggerProvider)
+		defer shutdownTelemetry(ctx, tel)
+		services.RunCartService(newRNG("cart"), tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
 	}()
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		tel := common.InitTelemetry(ctx, "currency")
-		defer tel.Shutdown(ctx)
-		services.RunCurrencyService(tel.TracerProvider, tel.LoggerProvider)
+		defer shutdownTelemetry(ctx, tel)
+		services.RunCurrencyService(newRNG("currency"), tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
 	}()
 
 	// Kafka consumer services (accounting and fraud-detection)
@@ -87,18 +178,18 @@ func runAllServices(ctx context.Context, count int) {
 	go func() {
 		defer wg.Done()
 		tel := common.InitTelemetry(ctx, "accounting")
-		defer tel.Shutdown(ctx)
-		server := services.InitAccountingService(":8091", tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
-		server.ListenAndServe()
+		defer shutdownTelemetry(ctx, tel)
+		server := services.InitAccountingService(":8091", newRNG("accounting"), tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
+		common.ListenAndServe(server)
 	}()
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		tel := common.InitTelemetry(ctx, "fraud-detection")
-		defer tel.Shutdown(ctx)
-		server := services.InitFraudDetectionService(":8092", tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
-		server.ListenAndServe()
+		defer shutdownTelemetry(ctx, tel)
+		server := services.InitFraudDetectionService(":8092", newRNG("fraud-detection"), tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
+		common.ListenAndServe(server)
 	}()
 
 	// Checkout HTTP server
@@ -106,15 +197,11 @@ func runAllServices(ctx context.Context, count int) {
 	go func() {
 		defer wg.Done()
 		tel := common.InitTelemetry(ctx, "checkout")
-		defer tel.Shutdown(ctx)
-		server := services.InitCheckoutServer(":8083", tel.TracerProvider, tel.LoggerProvider)
-		server.ListenAndServe()
+		defer shutdownTelemetry(ctx, tel)
+		server := services.InitCheckoutServer(":8083", newRNG("checkout-server"), tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
+		common.ListenAndServe(server)
 	}()
 
-	// Wait for servers to start
-	log.Println("Waiting for Go services to start...")
-	time.Sleep(2 * time.Second)
-
 	// Only run batch checkout if count > 0
 	// When count=0, just run as HTTP servers (frontend drives the traces)
 	if count > 0 {
@@ -122,8 +209,8 @@ func runAllServices(ctx context.Context, count int) {
 		go func() {
 			defer wg.Done()
 			tel := common.InitTelemetry(ctx, "checkout")
-			defer tel.Shutdown(ctx)
-			services.RunCheckoutService(count, tel.TracerProvider, tel.LoggerProvider)
+			defer shutdownTelemetry(ctx, tel)
+			services.RunCheckoutService(runCtx, count, concurrency, orderTimeout, newRNG("checkout-batch"), tel.TracerProvider, tel.MeterProvider, tel.LoggerProvider)
 		}()
 	} else {
 		log.Println("Count=0: Running as HTTP servers only")
@@ -3,77 +3,203 @@ package services
 import (
 	"context"
 	"encoding/json"
+	"io"
 	"log/slog"
-	"math/rand"
+	"maps"
 	"net/http"
+	"otel-mock/common"
+	"otel-mock/config"
+	"strconv"
+	"sync"
+	"time"
 
-	"go.opentelemetry.io/contrib/bridges/otelslog"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"github.com/redis/go-redis/v9"
 	"go.opentelemetry.io/otel/attribute"
 	otellog "go.opentelemetry.io/otel/log"
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
 )
 
-var (
-	accountingTracer trace.Tracer
-	accountingMeter  metric.Meter
-	accountingLogger *slog.Logger
-)
+// accountingService holds one accounting instance's telemetry and state, so
+// instances (and the other services sharing this package) never share
+// counters or revenue totals
+type accountingService struct {
+	tracer trace.Tracer
+	logger *slog.Logger
+	rng    RNG
+	redis  *redis.Client
 
-var (
-	ordersProcessed metric.Int64Counter
-	revenueTotal    metric.Float64Counter
-)
+	ordersProcessed  metric.Int64Counter
+	revenueTotal     metric.Float64Counter
+	messagesConsumed metric.Int64Counter
+	consumeLatency   metric.Float64Histogram
+
+	// revenueByCurrency mirrors the revenue_total counter so /revenue can
+	// report it without a metrics backend
+	revenueMu         sync.Mutex
+	revenueByCurrency map[string]float64
+
+	// queue holds /consume work for the worker pool; when it is full the
+	// handler pushes back with 429
+	queue      chan consumeJob
+	queueDepth metric.Int64UpDownCounter
+}
+
+// consumeJob is one /consume request waiting for a worker
+type consumeJob struct {
+	ctx   context.Context
+	span  trace.Span
+	order *OrderMessage
+	done  chan struct{}
+}
 
-func InitAccountingService(port string, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) *http.Server {
-	accountingTracer = tp.Tracer("accounting")
-	accountingMeter = mp.Meter("accounting")
+func newAccountingService(rng RNG, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) *accountingService {
+	meter := mp.Meter("accounting")
+	s := &accountingService{
+		tracer:            tp.Tracer("accounting"),
+		logger:            common.NewLogger("accounting", lp),
+		rng:               rng,
+		redis:             common.NewRedisClient("accounting"),
+		revenueByCurrency: map[string]float64{},
+		queue:             make(chan consumeJob, max(config.AccountingQueueSize, 1)),
+	}
 
 	var err error
-	ordersProcessed, err = accountingMeter.Int64Counter("app.accounting.orders_processed",
+	s.ordersProcessed, err = meter.Int64Counter("app.accounting.orders_processed",
 		metric.WithDescription("Total orders processed by accounting"),
 		metric.WithUnit("{orders}"))
 	if err != nil {
-		slog.Error("Failed to create orders_processed counter", "error", err)
+		s.logger.Error("Failed to create orders_processed counter", "error", err)
 	}
 
-	revenueTotal, err = accountingMeter.Float64Counter("app.accounting.revenue_total",
+	s.revenueTotal, err = meter.Float64Counter("app.accounting.revenue_total",
 		metric.WithDescription("Total revenue processed"),
 		metric.WithUnit("USD"))
 	if err != nil {
-		slog.Error("Failed to create revenue_total counter", "error", err)
+		s.logger.Error("Failed to create revenue_total counter", "error", err)
 	}
 
-	mux := http.NewServeMux()
-	// Wrap with otelhttp to extract trace context from incoming requests
-	mux.Handle("/consume", otelhttp.NewHandler(
-		http.HandlerFunc(handleAccountingConsume),
-		"orders receive",
-		otelhttp.WithTracerProvider(tp),
-	))
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"status":"ok"}`))
-	})
+	s.messagesConsumed, err = meter.Int64Counter("app.messaging.consumed",
+		metric.WithDescription("Messages consumed from Kafka"),
+		metric.WithUnit("{messages}"))
+	if err != nil {
+		s.logger.Error("Failed to create messaging.consumed counter", "error", err)
+	}
+
+	s.consumeLatency, err = meter.Float64Histogram("app.messaging.consume.latency",
+		metric.WithDescription("Time taken to process a consumed message"),
+		metric.WithUnit("ms"))
+	if err != nil {
+		s.logger.Error("Failed to create messaging.consume.latency histogram", "error", err)
+	}
 
-	server := &http.Server{
-		Addr:    port,
-		Handler: mux,
+	s.queueDepth, err = meter.Int64UpDownCounter("app.accounting.queue.depth",
+		metric.WithDescription("Consumed messages waiting for an accounting worker"),
+		metric.WithUnit("{messages}"))
+	if err != nil {
+		s.logger.Error("Failed to create accounting.queue.depth counter", "error", err)
 	}
 
-	accountingLogger = otelslog.NewLogger("accounting", otelslog.WithLoggerProvider(lp))
-	accountingLogger.Info("Accounting Service starting", "port", port)
+	for i := 0; i < max(config.AccountingWorkers, 1); i++ {
+		go s.worker()
+	}
+	return s
+}
+
+// worker processes queued /consume jobs, taking ACCOUNTING_PROCESS_DELAY
+// extra per message to simulate a slow consumer
+func (s *accountingService) worker() {
+	for job := range s.queue {
+		s.queueDepth.Add(job.ctx, -1)
+		if config.AccountingProcessDelay > 0 {
+			time.Sleep(config.AccountingProcessDelay)
+		}
+		s.consumeOrder(job.ctx, job.span, job.order)
+		close(job.done)
+	}
+}
+
+func InitAccountingService(port string, rng RNG, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) *http.Server {
+	s := newAccountingService(rng, tp, mp, lp)
+
+	server := common.NewServer(port, s.newMux(tp))
+
+	logEffectiveConfig(s.logger)
+	s.logger.Info("Accounting Service starting", "port", port)
+
+	if kafkaBrokers() != nil {
+		go runKafkaConsumer("accountingservice", s.tracer, s.logger, s.consumeOrder)
+	}
 	return server
 }
 
-func handleAccountingConsume(w http.ResponseWriter, r *http.Request) {
+// newMux routes accounting's consumer and query endpoints
+func (s *accountingService) newMux(tp trace.TracerProvider) *http.ServeMux {
+	mux := http.NewServeMux()
+	// Wrap with otelhttp to extract trace context from incoming requests
+	mux.Handle("/consume", newConsumeHandler(http.HandlerFunc(s.handleConsume), tp))
+	mux.Handle("GET /orders", common.NewHandler(
+		http.HandlerFunc(s.listOrdersHandler),
+		"ListOrders",
+		tp,
+	))
+	mux.Handle("GET /revenue", common.NewHandler(
+		http.HandlerFunc(s.revenueHandler),
+		"GetRevenue",
+		tp,
+	))
+	mux.HandleFunc("/health", healthHandler)
+	return mux
+}
+
+func (s *accountingService) handleConsume(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
 	// Get span from otelhttp handler (already creates "orders receive" span)
 	span := trace.SpanFromContext(ctx)
+	setPartitionFromHeader(span, r.Header)
+
+	body, _ := io.ReadAll(r.Body)
+	order, err := decodeOrderMessage(body)
+	if err != nil {
+		common.RecordSpanError(span, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := simulateConsumeFailure(s.rng, span); err != nil {
+		s.logger.WarnContext(ctx, "Failing order delivery", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Hand the message to a worker, or push back when they can't keep up
+	job := consumeJob{ctx: ctx, span: span, order: order, done: make(chan struct{})}
+	s.queueDepth.Add(ctx, 1)
+	select {
+	case s.queue <- job:
+	default:
+		s.queueDepth.Add(ctx, -1)
+		span.SetAttributes(attribute.Bool("app.accounting.queue.full", true))
+		s.logger.WarnContext(ctx, "Accounting queue full, rejecting message", "queue_size", cap(s.queue))
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "accounting queue full", http.StatusTooManyRequests)
+		return
+	}
+	<-job.done
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "processed"})
+}
+
+// consumeOrder handles one orders message, whether it arrived over the HTTP
+// mock or a real Kafka consumer. A nil order is replaced by a random one.
+func (s *accountingService) consumeOrder(ctx context.Context, span trace.Span, order *OrderMessage) {
+	start := time.Now()
+	if order == nil {
+		order = randomOrderMessage(ctx, s.rng)
+	}
 
-	// Add Kafka messaging attributes to the existing span
+	// Add Kafka messaging attributes to the receive span
 	span.SetAttributes(
 		attribute.String("messaging.system", "kafka"),
 		attribute.String("messaging.destination.name", "orders"),
@@ -81,24 +207,30 @@ func handleAccountingConsume(w http.ResponseWriter, r *http.Request) {
 		attribute.String("messaging.consumer.group.name", "accountingservice"),
 	)
 
-	accountingLogger.InfoContext(ctx, "Received order from Kafka", "topic", "orders", "consumer_group", "accountingservice")
+	setOrderAttributes(ctx, span, order)
 
-	// Simulate processing order for accounting
-	processOrder(ctx)
+	s.logger.InfoContext(ctx, "Received order from Kafka", "topic", "orders", "consumer_group", "accountingservice", "order_id", order.OrderID)
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "processed"})
+	// Record the order for accounting
+	s.processOrder(ctx, order)
+
+	consumeAttrs := metric.WithAttributes(
+		attribute.String("messaging.destination.name", "orders"),
+		attribute.String("messaging.consumer.group.name", "accountingservice"),
+	)
+	s.messagesConsumed.Add(ctx, 1, consumeAttrs)
+	s.consumeLatency.Record(ctx, float64(time.Since(start).Milliseconds()), consumeAttrs)
 }
 
-func processOrder(ctx context.Context) {
-	ctx, span := accountingTracer.Start(ctx, "processOrder")
+func (s *accountingService) processOrder(ctx context.Context, order *OrderMessage) {
+	ctx, span := s.tracer.Start(ctx, "processOrder")
 	defer span.End()
 
-	orderID := "order-" + randomString(8)
-	amount := float64(rand.Intn(50000)+1000) / 100.0
-	currency := []string{"USD", "EUR", "GBP", "JPY"}[rand.Intn(4)]
+	orderID := order.OrderID
+	amount := order.Amount
+	currency := order.Currency
 
-	accountingLogger.InfoContext(ctx, "ProcessOrder started", "order_id", orderID, "amount", amount, "currency", currency)
+	s.logger.InfoContext(ctx, "ProcessOrder started", "order_id", orderID, "amount", amount, "currency", currency)
 
 	span.SetAttributes(
 		attribute.String("app.order.id", orderID),
@@ -106,29 +238,134 @@ func processOrder(ctx context.Context) {
 		attribute.String("app.order.currency", currency),
 	)
 
-	ordersProcessed.Add(ctx, 1, metric.WithAttributes(
+	s.ordersProcessed.Add(ctx, 1, metric.WithAttributes(
 		attribute.String("currency", currency),
 	))
-	revenueTotal.Add(ctx, amount, metric.WithAttributes(
+	s.revenueTotal.Add(ctx, amount, metric.WithAttributes(
 		attribute.String("currency", currency),
 	))
+	s.addRevenue(currency, amount)
+
+	s.recordOrderHistory(ctx, order)
 
 	span.AddEvent("order_recorded", trace.WithAttributes(
 		attribute.String("app.order.id", orderID),
 	))
 
-	accountingLogger.InfoContext(ctx, "Order processed for accounting",
+	s.logger.InfoContext(ctx, "Order processed for accounting",
 		"order_id", orderID,
 		"amount", amount,
 		"currency", currency,
 	)
 }
 
-func randomString(n int) string {
-	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+const (
+	// orderHistoryKey is a Redis sorted set of OrderRecord JSON scored by
+	// processing time in milliseconds
+	orderHistoryKey = "accounting:orders"
+	// orderHistoryMax bounds the history; older orders are trimmed
+	orderHistoryMax = 1000
+
+	defaultOrdersLimit = 10
+	maxOrdersLimit     = 100
+)
+
+// OrderRecord is a processed order as stored in the order history
+type OrderRecord struct {
+	OrderID     string    `json:"order_id"`
+	Amount      float64   `json:"amount"`
+	Currency    string    `json:"currency"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+// recordOrderHistory appends the order to the Redis history. Failures are
+// logged only: accounting must not drop an order because Redis is down.
+func (s *accountingService) recordOrderHistory(ctx context.Context, order *OrderMessage) {
+	now := time.Now()
+	record, _ := json.Marshal(OrderRecord{
+		OrderID:     order.OrderID,
+		Amount:      order.Amount,
+		Currency:    order.Currency,
+		ProcessedAt: now,
+	})
+
+	pipe := s.redis.TxPipeline()
+	pipe.ZAdd(ctx, orderHistoryKey, redis.Z{Score: float64(now.UnixMilli()), Member: record})
+	pipe.ZRemRangeByRank(ctx, orderHistoryKey, 0, -orderHistoryMax-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		common.RecordSpanError(trace.SpanFromContext(ctx), err)
+		s.logger.WarnContext(ctx, "Failed to record order history", "order_id", order.OrderID, "error", err)
 	}
-	return string(b)
+}
+
+// listOrdersHandler serves GET /orders?limit=N, newest first
+func (s *accountingService) listOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := trace.SpanFromContext(ctx)
+
+	limit := defaultOrdersLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxOrdersLimit)
+	}
+
+	members, err := s.redis.ZRevRange(ctx, orderHistoryKey, 0, int64(limit-1)).Result()
+	if err != nil {
+		common.RecordSpanError(span, err)
+		s.logger.ErrorContext(ctx, "Failed to list orders", "error", err)
+		http.Error(w, "Failed to list orders", http.StatusInternalServerError)
+		return
+	}
+
+	orders := make([]OrderRecord, 0, len(members))
+	for _, m := range members {
+		var record OrderRecord
+		if json.Unmarshal([]byte(m), &record) == nil {
+			orders = append(orders, record)
+		}
+	}
+
+	span.SetAttributes(
+		attribute.Int("app.orders.limit", limit),
+		attribute.Int("app.orders.count", len(orders)),
+	)
+
+	s.logger.InfoContext(ctx, "ListOrders", "limit", limit, "count", len(orders))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(orders)
+}
+
+func (s *accountingService) addRevenue(currency string, amount float64) {
+	s.revenueMu.Lock()
+	defer s.revenueMu.Unlock()
+	s.revenueByCurrency[currency] += amount
+}
+
+// revenueSnapshot returns a copy of the per-currency totals
+func (s *accountingService) revenueSnapshot() map[string]float64 {
+	s.revenueMu.Lock()
+	defer s.revenueMu.Unlock()
+	return maps.Clone(s.revenueByCurrency)
+}
+
+// revenueHandler serves GET /revenue: revenue processed since startup, by currency
+func (s *accountingService) revenueHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := trace.SpanFromContext(ctx)
+
+	totals := s.revenueSnapshot()
+
+	span.SetAttributes(attribute.Int("app.accounting.currencies.count", len(totals)))
+
+	s.logger.InfoContext(ctx, "GetRevenue", "currencies", len(totals))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"revenue": totals})
 }
@@ -0,0 +1,204 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"otel-mock/config"
+
+	lognoop "go.opentelemetry.io/otel/log/noop"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestAccountingConsumeBackpressure(t *testing.T) {
+	newTestRedis(t)
+	setForTest(t, &config.AccountingWorkers, 1)
+	setForTest(t, &config.AccountingQueueSize, 1)
+	setForTest(t, &config.AccountingProcessDelay, 200*time.Millisecond)
+	setForTest(t, &config.ConsumerFailureRate, 0)
+
+	s := newAccountingService(NewRNG(1), tracenoop.NewTracerProvider(), metricnoop.NewMeterProvider(), lognoop.NewLoggerProvider())
+
+	const flood = 10
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		statuses = map[int]int{}
+	)
+	for i := 0; i < flood; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := `{"order_id":"o-1","user_id":"u-1","amount":10,"currency":"USD"}`
+			rec := httptest.NewRecorder()
+			s.handleConsume(rec, httptest.NewRequest("POST", "/consume", strings.NewReader(body)))
+			if rec.Code == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+				t.Error("429 without Retry-After")
+			}
+			mu.Lock()
+			statuses[rec.Code]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if statuses[http.StatusTooManyRequests] == 0 {
+		t.Fatalf("no 429 after flooding a queue of 1, statuses %v", statuses)
+	}
+	if statuses[http.StatusOK] == 0 {
+		t.Fatalf("no message was processed, statuses %v", statuses)
+	}
+	if statuses[http.StatusOK]+statuses[http.StatusTooManyRequests] != flood {
+		t.Fatalf("unexpected statuses %v", statuses)
+	}
+}
+
+func TestConsumerServicesKeepIndependentCounters(t *testing.T) {
+	newTestRedis(t)
+	mpA, readerA := newTestMeterProvider(t)
+	mpB, readerB := newTestMeterProvider(t)
+	mpFraud, readerFraud := newTestMeterProvider(t)
+	a := newAccountingService(NewRNG(1), tracenoop.NewTracerProvider(), mpA, lognoop.NewLoggerProvider())
+	// B never consumes, so anything it reports leaked from A
+	newAccountingService(NewRNG(1), tracenoop.NewTracerProvider(), mpB, lognoop.NewLoggerProvider())
+	fraud := newFraudDetectionService(fixedRNG{f: 1}, tracenoop.NewTracerProvider(), mpFraud, lognoop.NewLoggerProvider())
+
+	span := trace.SpanFromContext(context.Background())
+	order := &OrderMessage{OrderID: "o-1", UserID: "u-1", Amount: 10, Currency: "USD"}
+	a.consumeOrder(context.Background(), span, order)
+	a.consumeOrder(context.Background(), span, order)
+	fraud.consumeOrder(context.Background(), span, order)
+
+	for name, want := range map[string]struct {
+		reader *sdkmetric.ManualReader
+		n      int64
+	}{"accounting A": {readerA, 2}, "accounting B": {readerB, 0}, "fraud detection": {readerFraud, 1}} {
+		if got := counterValue(t, want.reader, "app.messaging.consumed"); got != want.n {
+			t.Errorf("%s app.messaging.consumed = %d, want %d", name, got, want.n)
+		}
+	}
+}
+
+// newTestAccounting starts an accounting service that processes consumed
+// orders immediately, recording its history in a fresh in-memory Redis
+func newTestAccounting(t *testing.T) *accountingService {
+	t.Helper()
+	newTestRedis(t)
+	setForTest(t, &config.AccountingProcessDelay, 0)
+	setForTest(t, &config.ConsumerFailureRate, 0)
+	s := newAccountingService(NewRNG(1), tracenoop.NewTracerProvider(), metricnoop.NewMeterProvider(), lognoop.NewLoggerProvider())
+	t.Cleanup(func() { s.redis.Close() })
+	return s
+}
+
+// consume posts an order to the accounting /consume mock
+func consume(t *testing.T, s *accountingService, body string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.handleConsume(rec, httptest.NewRequest("POST", "/consume", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/consume returned %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestConsumedOrderIsListed(t *testing.T) {
+	s := newTestAccounting(t)
+
+	consume(t, s, `{"order_id":"o-1","user_id":"u-1","amount":10.5,"currency":"EUR"}`)
+	time.Sleep(2 * time.Millisecond) // history is scored by millisecond
+	consume(t, s, `{"order_id":"o-2","user_id":"u-1","amount":20,"currency":"USD"}`)
+
+	rec := httptest.NewRecorder()
+	s.listOrdersHandler(rec, httptest.NewRequest("GET", "/orders?limit=5", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/orders returned %d: %s", rec.Code, rec.Body)
+	}
+	var orders []OrderRecord
+	if err := json.Unmarshal(rec.Body.Bytes(), &orders); err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 2 {
+		t.Fatalf("listed %d orders, want 2: %s", len(orders), rec.Body)
+	}
+	// Newest first
+	if got := orders[1]; got.OrderID != "o-1" || got.Amount != 10.5 || got.Currency != "EUR" || got.ProcessedAt.IsZero() {
+		t.Fatalf("first order listed as %+v, want o-1 for 10.5 EUR with a timestamp", got)
+	}
+	if orders[0].OrderID != "o-2" {
+		t.Fatalf("newest order = %s, want o-2", orders[0].OrderID)
+	}
+}
+
+func TestListOrdersLimit(t *testing.T) {
+	s := newTestAccounting(t)
+	for i := range 3 {
+		consume(t, s, fmt.Sprintf(`{"order_id":"o-%d","amount":1,"currency":"USD"}`, i))
+	}
+
+	for target, want := range map[string]int{"/orders?limit=2": 2, "/orders": 3, "/orders?limit=0": -1, "/orders?limit=x": -1} {
+		rec := httptest.NewRecorder()
+		s.listOrdersHandler(rec, httptest.NewRequest("GET", target, nil))
+		if want < 0 {
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("%s returned %d, want 400", target, rec.Code)
+			}
+			continue
+		}
+		var orders []OrderRecord
+		json.Unmarshal(rec.Body.Bytes(), &orders)
+		if len(orders) != want {
+			t.Errorf("%s listed %d orders, want %d", target, len(orders), want)
+		}
+	}
+}
+
+func TestRevenueTotalsPerCurrency(t *testing.T) {
+	s := newTestAccounting(t)
+	consume(t, s, `{"order_id":"o-1","amount":10.25,"currency":"USD"}`)
+	consume(t, s, `{"order_id":"o-2","amount":5,"currency":"EUR"}`)
+	consume(t, s, `{"order_id":"o-3","amount":4.75,"currency":"USD"}`)
+
+	rec := httptest.NewRecorder()
+	s.revenueHandler(rec, httptest.NewRequest("GET", "/revenue", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/revenue returned %d: %s", rec.Code, rec.Body)
+	}
+	var got struct {
+		Revenue map[string]float64 `json:"revenue"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]float64{"USD": 15, "EUR": 5}; !maps.Equal(got.Revenue, want) {
+		t.Fatalf("revenue = %v, want %v", got.Revenue, want)
+	}
+}
+
+func TestRevenueConcurrentAdds(t *testing.T) {
+	s := newTestAccounting(t)
+
+	var wg sync.WaitGroup
+	for range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.addRevenue("USD", 1)
+		}()
+	}
+	wg.Wait()
+
+	if got := s.revenueSnapshot()["USD"]; got != 100 {
+		t.Fatalf("USD revenue = %v after 100 concurrent adds, want 100", got)
+	}
+}
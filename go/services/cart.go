@@ -3,19 +3,16 @@ package services
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
-	"math/rand"
 	"net/http"
-	"os"
+	"otel-mock/common"
+	"otel-mock/config"
 	"time"
 
-	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
-	"go.opentelemetry.io/contrib/bridges/otelslog"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
-	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	otellog "go.opentelemetry.io/otel/log"
 	"go.opentelemetry.io/otel/metric"
@@ -28,7 +25,13 @@ var (
 	addItemLatency metric.Float64Histogram
 	getCartLatency metric.Float64Histogram
 	cartOperations metric.Int64Counter
+	cartSize       metric.Int64Histogram
+	redisErrors    metric.Int64Counter
 	redisClient    *redis.Client
+	cartRand       RNG
+	// cartClock times cart operations; tests may replace it
+	cartClock Clock = SystemClock
+	cartTTL   time.Duration
 )
 
 type CartItem struct {
@@ -36,8 +39,15 @@ type CartItem struct {
 	Quantity  int    `json:"quantity"`
 }
 
-func initCartMetrics() {
-	cartMeter = otel.Meter("cart")
+// cartStatus is the response to cart updates
+type cartStatus struct {
+	Status    string `json:"status"`
+	UserID    string `json:"user_id"`
+	ProductID string `json:"product_id,omitempty"`
+}
+
+func initCartMetrics(mp metric.MeterProvider) {
+	cartMeter = mp.Meter("cart")
 	var err error
 
 	addItemLatency, err = cartMeter.Float64Histogram("app.cart.add_item.latency",
@@ -60,115 +70,136 @@ func initCartMetrics() {
 	if err != nil {
 		panic(err)
 	}
-}
 
-func initRedisClient() {
-	redisAddr := os.Getenv("REDIS_ADDR")
-	if redisAddr == "" {
-		redisAddr = "localhost:6379"
+	cartSize, err = cartMeter.Int64Histogram("app.cart.size",
+		metric.WithDescription("Distinct products per cart, recorded on get and empty"),
+		metric.WithUnit("{products}"),
+		metric.WithExplicitBucketBoundaries(0, 1, 2, 3, 5, 8, 13, 20))
+	if err != nil {
+		panic(err)
 	}
 
-	redisClient = redis.NewClient(&redis.Options{
-		Addr:     redisAddr,
-		Password: "",
-		DB:       0,
-	})
+	redisErrors, err = cartMeter.Int64Counter("app.cart.redis.errors",
+		metric.WithDescription("Failed Redis calls by cart operation"),
+		metric.WithUnit("{errors}"))
+	if err != nil {
+		panic(err)
+	}
+}
 
-	// Add OpenTelemetry auto-instrumentation for Redis
-	if err := redisotel.InstrumentTracing(redisClient,
-		redisotel.WithAttributes(
-			attribute.String("db.system", "redis"),
-			attribute.String("db.name", "cart"),
-		),
-	); err != nil {
-		log.Printf("Failed to instrument Redis: %v", err)
+// validCartTTL returns ttl, or 1h when CART_TTL isn't a positive duration
+func validCartTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		log.Printf("invalid CART_TTL %s, using 1h", ttl)
+		return time.Hour
 	}
+	return ttl
+}
 
-	// Test connection
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+func RunCartService(rng RNG, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) {
+	cartRand = rng
+	cartLogger = common.NewLogger("cart", lp)
+	logEffectiveConfig(cartLogger)
+	cartTTL = validCartTTL(config.CartTTL)
+	initCartMetrics(mp)
+	redisClient = common.NewRedisClient("cart")
 
-	if err := redisClient.Ping(ctx).Err(); err != nil {
-		log.Printf("Warning: Redis not available at %s: %v", redisAddr, err)
-	} else {
-		log.Printf("Connected to Redis at %s", redisAddr)
+	mux := newCartMux(tp)
+
+	port := ":8084"
+	cartLogger.Info("Cart Service starting", "port", port)
+	if err := common.ListenAndServe(common.NewServer(port, mux)); err != nil {
+		cartLogger.Error("Cart Service failed", "error", err)
 	}
 }
 
-func RunCartService(tp trace.TracerProvider, lp otellog.LoggerProvider) {
-	cartLogger = otelslog.NewLogger("cart", otelslog.WithLoggerProvider(lp))
-	initCartMetrics()
-	initRedisClient()
-
-	addHandler := otelhttp.NewHandler(
-		http.HandlerFunc(addItemHandler),
+// newCartMux routes the cart endpoints, each in its own server span
+func newCartMux(tp trace.TracerProvider) *http.ServeMux {
+	addHandler := common.NewHandler(
+		common.PadResponse(http.HandlerFunc(addItemHandler)),
 		"AddItem",
-		otelhttp.WithTracerProvider(tp),
+		tp,
 	)
 
-	getHandler := otelhttp.NewHandler(
-		http.HandlerFunc(getCartHandler),
+	getHandler := common.NewHandler(
+		common.PadResponse(http.HandlerFunc(getCartHandler)),
 		"GetCart",
-		otelhttp.WithTracerProvider(tp),
+		tp,
 	)
 
-	emptyHandler := otelhttp.NewHandler(
-		http.HandlerFunc(emptyCartHandler),
+	emptyHandler := common.NewHandler(
+		common.PadResponse(http.HandlerFunc(emptyCartHandler)),
 		"EmptyCart",
-		otelhttp.WithTracerProvider(tp),
+		tp,
+	)
+
+	getItemHandler := common.NewHandler(
+		common.PadResponse(http.HandlerFunc(getItemHandler)),
+		"GetItem",
+		tp,
+	)
+
+	addBulkHandler := common.NewHandler(
+		common.PadResponse(http.HandlerFunc(addItemsBulkHandler)),
+		"AddItemsBulk",
+		tp,
+	)
+
+	mergeHandler := common.NewHandler(
+		common.PadResponse(http.HandlerFunc(mergeCartHandler)),
+		"MergeCart",
+		tp,
 	)
 
 	mux := http.NewServeMux()
 	mux.Handle("/cart/add", addHandler)
+	mux.Handle("POST /cart/add/bulk", addBulkHandler)
 	mux.Handle("/cart", getHandler)
 	mux.Handle("/cart/empty", emptyHandler)
-
-	port := ":8084"
-	cartLogger.Info("Cart Service starting", "port", port)
-	if err := http.ListenAndServe(port, mux); err != nil {
-		cartLogger.Error("Cart Service failed", "error", err)
-	}
+	mux.Handle("GET /cart/item", getItemHandler)
+	mux.Handle("POST /cart/merge", mergeHandler)
+	mux.HandleFunc("/health", healthHandler)
+	return mux
 }
 
 func addItemHandler(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
+	start := cartClock.Now()
 	ctx := r.Context()
 	span := trace.SpanFromContext(ctx)
 
 	userID := r.URL.Query().Get("user_id")
 	if userID == "" {
-		userID = fmt.Sprintf("user-%d", rand.Intn(1000))
+		userID = fmt.Sprintf("user-%d", cartRand.Intn(1000))
 	}
 	productID := r.URL.Query().Get("product_id")
 	if productID == "" {
-		productID = GetProductID()
+		productID = GetProductID(cartRand)
 	}
-	quantity := rand.Intn(3) + 1
+	quantity := cartRand.Intn(3) + 1
 
 	span.SetAttributes(
-		attribute.String("app.user.id", userID),
+		common.BoundedAttr("app.user.id", userID),
 		attribute.String("app.product.id", productID),
 		attribute.Int("app.product.quantity", quantity),
 	)
 
-	// Create cart item
-	item := CartItem{ProductID: productID, Quantity: quantity}
-	itemJSON, _ := json.Marshal(item)
-
-	// Use Redis HSET - auto-instrumented by otelredis
+	// Add to whatever quantity the cart already holds, atomically
 	cartKey := fmt.Sprintf("cart:%s", userID)
-	err := redisClient.HSet(ctx, cartKey, productID, itemJSON).Err()
+	updated, ops, err := incrementCartItems(ctx, cartKey, []CartItem{{ProductID: productID, Quantity: quantity}})
 	if err != nil {
-		span.RecordError(err)
+		common.RecordSpanError(span, err)
+		redisErrors.Add(ctx, 1, metric.WithAttributes(attribute.String("operation", "add_item")))
 		cartLogger.ErrorContext(ctx, "Failed to add item to cart", "error", err)
-		http.Error(w, "Failed to add item", http.StatusInternalServerError)
+		http.Error(w, "Failed to add item", cartErrorStatus(err))
 		return
 	}
+	span.SetAttributes(
+		attribute.Int("app.cart.pipeline.ops", ops),
+		attribute.Int("app.cart.item.quantity", updated[productID].Quantity),
+		attribute.Int64("app.cart.ttl_seconds", int64(cartTTL.Seconds())),
+	)
 
-	// Set expiration (1 hour) - auto-instrumented
-	redisClient.Expire(ctx, cartKey, time.Hour)
-
-	duration := float64(time.Since(start).Milliseconds())
+	duration := float64(cartClock.Since(start).Milliseconds())
 	addItemLatency.Record(ctx, duration)
 	cartOperations.Add(ctx, 1, metric.WithAttributes(
 		attribute.String("operation", "add_item"),
@@ -180,44 +211,131 @@ func addItemHandler(w http.ResponseWriter, r *http.Request) {
 		"quantity", quantity,
 	)
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"status": "added", "user_id": "%s", "product_id": "%s"}`, userID, productID)
+	json.NewEncoder(w).Encode(cartStatus{Status: "added", UserID: userID, ProductID: productID})
+}
+
+// addItemsBulkHandler serves POST /cart/add/bulk?user_id=, adding a JSON
+// array of items in one Redis transaction instead of one /cart/add call each.
+// Items without a quantity get 1-3 like /cart/add, and quantities add to what
+// the cart already holds.
+func addItemsBulkHandler(w http.ResponseWriter, r *http.Request) {
+	start := cartClock.Now()
+	ctx := r.Context()
+	span := trace.SpanFromContext(ctx)
+
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		userID = fmt.Sprintf("user-%d", cartRand.Intn(1000))
+	}
+
+	var reqItems []CartItem
+	if err := json.NewDecoder(r.Body).Decode(&reqItems); err != nil {
+		http.Error(w, fmt.Sprintf("invalid bulk request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(reqItems) == 0 {
+		http.Error(w, "at least one item is required", http.StatusBadRequest)
+		return
+	}
+
+	for i, req := range reqItems {
+		if req.ProductID == "" {
+			http.Error(w, "every item needs a product_id", http.StatusBadRequest)
+			return
+		}
+		if req.Quantity <= 0 {
+			reqItems[i].Quantity = cartRand.Intn(3) + 1
+		}
+	}
+
+	cartKey := fmt.Sprintf("cart:%s", userID)
+	updated, ops, err := incrementCartItems(ctx, cartKey, reqItems)
+	if err != nil {
+		common.RecordSpanError(span, err)
+		redisErrors.Add(ctx, 1, metric.WithAttributes(attribute.String("operation", "add_items_bulk")))
+		cartLogger.ErrorContext(ctx, "Failed to add items to cart", "error", err)
+		http.Error(w, "Failed to add items", cartErrorStatus(err))
+		return
+	}
+
+	totalItems := 0
+	for _, item := range updated {
+		totalItems += item.Quantity
+	}
+	span.SetAttributes(
+		common.BoundedAttr("app.user.id", userID),
+		attribute.Int("app.cart.bulk.count", len(reqItems)),
+		attribute.Int("app.cart.items.count", totalItems),
+		attribute.Int("app.cart.pipeline.ops", ops),
+		attribute.Int64("app.cart.ttl_seconds", int64(cartTTL.Seconds())),
+	)
+
+	duration := float64(cartClock.Since(start).Milliseconds())
+	addItemLatency.Record(ctx, duration, metric.WithAttributes(
+		attribute.Bool("bulk", true),
+	))
+	cartOperations.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("operation", "add_items_bulk"),
+	))
+
+	cartLogger.InfoContext(ctx, "AddItemsBulk",
+		"user_id", userID,
+		"count", len(reqItems),
+		"items_count", totalItems,
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      "added",
+		"user_id":     userID,
+		"count":       len(reqItems),
+		"items_count": totalItems,
+	})
 }
 
 func getCartHandler(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
+	start := cartClock.Now()
 	ctx := r.Context()
 	span := trace.SpanFromContext(ctx)
 
 	userID := r.URL.Query().Get("user_id")
 	if userID == "" {
-		userID = fmt.Sprintf("user-%d", rand.Intn(1000))
+		userID = fmt.Sprintf("user-%d", cartRand.Intn(1000))
 	}
 
-	span.SetAttributes(attribute.String("app.user.id", userID))
+	span.SetAttributes(common.BoundedAttr("app.user.id", userID))
 	span.AddEvent("Fetch cart")
 
 	// Use Redis HGETALL - auto-instrumented by otelredis
 	cartKey := fmt.Sprintf("cart:%s", userID)
 	items, err := redisClient.HGetAll(ctx, cartKey).Result()
-	if err != nil {
-		span.RecordError(err)
+	if redisFailed(err) {
+		common.RecordSpanError(span, err)
+		redisErrors.Add(ctx, 1, metric.WithAttributes(attribute.String("operation", "get_cart")))
 		cartLogger.ErrorContext(ctx, "Failed to get cart", "error", err)
 		http.Error(w, "Failed to get cart", http.StatusInternalServerError)
 		return
 	}
 
 	totalItems := 0
+	cartItems := make([]CartItem, 0, len(items))
 	for _, itemJSON := range items {
 		var item CartItem
 		if json.Unmarshal([]byte(itemJSON), &item) == nil {
 			totalItems += item.Quantity
+			cartItems = append(cartItems, item)
 		}
 	}
 
 	span.SetAttributes(attribute.Int("app.cart.items.count", totalItems))
+	cartSize.Record(ctx, int64(len(cartItems)), metric.WithAttributes(
+		attribute.String("operation", "get_cart"),
+	))
 
-	duration := float64(time.Since(start).Milliseconds())
+	duration := float64(cartClock.Since(start).Milliseconds())
 	getCartLatency.Record(ctx, duration)
 	cartOperations.Add(ctx, 1, metric.WithAttributes(
 		attribute.String("operation", "get_cart"),
@@ -228,8 +346,163 @@ func getCartHandler(w http.ResponseWriter, r *http.Request) {
 		"items_count", totalItems,
 	)
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"user_id": "%s", "items_count": %d}`, userID, totalItems)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":     userID,
+		"items_count": totalItems,
+		"items":       cartItems,
+	})
+}
+
+// cartWatchRetries bounds how often incrementCartItems and mergeCarts retry
+// after a concurrent write to a cart they watch
+const cartWatchRetries = 5
+
+var errCartContended = errors.New("cart modified concurrently, retries exhausted")
+
+// incrementCartItems adds each item's quantity to the one already stored for
+// that product (repeats in items are summed) and returns the resulting cart
+// entries for those products. The read and the write run under WATCH, so a
+// concurrent update to the cart makes the transaction fail and retry rather
+// than lose an increment; all fields go out in one HSET alongside the
+// first-item TTL. ops is the number of commands in the committed transaction.
+func incrementCartItems(ctx context.Context, cartKey string, items []CartItem) (updated map[string]CartItem, ops int, err error) {
+	productIDs := make([]string, 0, len(items))
+	for _, item := range items {
+		productIDs = append(productIDs, item.ProductID)
+	}
+
+	txf := func(tx *redis.Tx) error {
+		current, err := tx.HMGet(ctx, cartKey, productIDs...).Result()
+		if redisFailed(err) {
+			return err
+		}
+		updated = make(map[string]CartItem, len(items))
+		for i, productID := range productIDs {
+			if _, seen := updated[productID]; seen {
+				continue
+			}
+			item := CartItem{ProductID: productID}
+			if itemJSON, ok := current[i].(string); ok {
+				json.Unmarshal([]byte(itemJSON), &item)
+				item.ProductID = productID
+			}
+			updated[productID] = item
+		}
+		for _, add := range items {
+			item := updated[add.ProductID]
+			item.Quantity += add.Quantity
+			updated[add.ProductID] = item
+		}
+
+		fields := make([]interface{}, 0, 2*len(updated))
+		for productID, item := range updated {
+			itemJSON, _ := json.Marshal(item)
+			fields = append(fields, productID, itemJSON)
+		}
+		var hset *redis.IntCmd
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			hset = pipe.HSet(ctx, cartKey, fields...)
+			// Start the cart's TTL on its first item only (EXPIRE NX), so
+			// adding more items doesn't keep extending it
+			pipe.ExpireNX(ctx, cartKey, cartTTL)
+			ops = pipe.Len()
+			return nil
+		})
+		if err != nil && !errors.Is(err, redis.TxFailedErr) && hset.Err() == nil {
+			// The items were written; only the TTL failed
+			common.RecordSpanError(trace.SpanFromContext(ctx), err)
+			cartLogger.WarnContext(ctx, "Failed to set cart TTL", "error", err)
+			return nil
+		}
+		return err
+	}
+
+	// Use WATCH/MULTI/EXEC - auto-instrumented by otelredis
+	for attempt := 0; attempt < cartWatchRetries; attempt++ {
+		err = redisClient.Watch(ctx, txf, cartKey)
+		if !errors.Is(err, redis.TxFailedErr) {
+			if redisFailed(err) {
+				return nil, 0, err
+			}
+			return updated, ops, nil
+		}
+		trace.SpanFromContext(ctx).AddEvent("cart_watch_conflict", trace.WithAttributes(
+			attribute.Int("app.cart.pipeline.attempt", attempt+1),
+		))
+	}
+	return nil, 0, errCartContended
+}
+
+// cartErrorStatus answers 409 when concurrent writers kept winning, so the
+// caller knows a retry may succeed, and 500 for real Redis failures
+func cartErrorStatus(err error) int {
+	if errors.Is(err, errCartContended) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// redisFailed reports whether err is a real Redis failure. redis.Nil only
+// means the key or field is missing, which cart treats as empty data rather
+// than a server error.
+func redisFailed(err error) bool {
+	return err != nil && !errors.Is(err, redis.Nil)
+}
+
+// getItemHandler serves GET /cart/item?user_id=&product_id=, returning 404
+// when the product isn't in the user's cart
+func getItemHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := trace.SpanFromContext(ctx)
+
+	userID := r.URL.Query().Get("user_id")
+	productID := r.URL.Query().Get("product_id")
+	if userID == "" || productID == "" {
+		http.Error(w, "user_id and product_id are required", http.StatusBadRequest)
+		return
+	}
+
+	span.SetAttributes(
+		common.BoundedAttr("app.user.id", userID),
+		attribute.String("app.product.id", productID),
+	)
+
+	// Use Redis HGET - auto-instrumented by otelredis
+	cartKey := fmt.Sprintf("cart:%s", userID)
+	itemJSON, err := redisClient.HGet(ctx, cartKey, productID).Result()
+	if errors.Is(err, redis.Nil) {
+		span.AddEvent("item_not_found")
+		cartLogger.InfoContext(ctx, "GetItem not found", "user_id", userID, "product_id", productID)
+		http.Error(w, "item not in cart", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		common.RecordSpanError(span, err)
+		redisErrors.Add(ctx, 1, metric.WithAttributes(attribute.String("operation", "get_item")))
+		cartLogger.ErrorContext(ctx, "Failed to get cart item", "error", err)
+		http.Error(w, "Failed to get item", http.StatusInternalServerError)
+		return
+	}
+
+	var item CartItem
+	if err := json.Unmarshal([]byte(itemJSON), &item); err != nil {
+		common.RecordSpanError(span, err)
+		cartLogger.ErrorContext(ctx, "Corrupt cart item", "product_id", productID, "error", err)
+		http.Error(w, "Failed to get item", http.StatusInternalServerError)
+		return
+	}
+
+	cartOperations.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("operation", "get_item"),
+	))
+
+	cartLogger.InfoContext(ctx, "GetItem", "user_id", userID, "product_id", productID, "quantity", item.Quantity)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(item)
 }
 
 func emptyCartHandler(w http.ResponseWriter, r *http.Request) {
@@ -238,17 +511,18 @@ func emptyCartHandler(w http.ResponseWriter, r *http.Request) {
 
 	userID := r.URL.Query().Get("user_id")
 	if userID == "" {
-		userID = fmt.Sprintf("user-%d", rand.Intn(1000))
+		userID = fmt.Sprintf("user-%d", cartRand.Intn(1000))
 	}
 
-	span.SetAttributes(attribute.String("app.user.id", userID))
+	span.SetAttributes(common.BoundedAttr("app.user.id", userID))
 	span.AddEvent("Empty cart")
 
 	// Use Redis DEL - auto-instrumented by otelredis
 	cartKey := fmt.Sprintf("cart:%s", userID)
 	err := redisClient.Del(ctx, cartKey).Err()
-	if err != nil {
-		span.RecordError(err)
+	if redisFailed(err) {
+		common.RecordSpanError(span, err)
+		redisErrors.Add(ctx, 1, metric.WithAttributes(attribute.String("operation", "empty_cart")))
 		cartLogger.ErrorContext(ctx, "Failed to empty cart", "error", err)
 		http.Error(w, "Failed to empty cart", http.StatusInternalServerError)
 		return
@@ -257,9 +531,136 @@ func emptyCartHandler(w http.ResponseWriter, r *http.Request) {
 	cartOperations.Add(ctx, 1, metric.WithAttributes(
 		attribute.String("operation", "empty_cart"),
 	))
+	cartSize.Record(ctx, 0, metric.WithAttributes(
+		attribute.String("operation", "empty_cart"),
+	))
 
 	cartLogger.InfoContext(ctx, "EmptyCart", "user_id", userID)
 
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(cartStatus{Status: "emptied", UserID: userID})
+}
+
+// decodeCartItems parses a cart hash, skipping malformed entries
+func decodeCartItems(hash map[string]string) map[string]CartItem {
+	items := make(map[string]CartItem, len(hash))
+	for productID, itemJSON := range hash {
+		var item CartItem
+		if json.Unmarshal([]byte(itemJSON), &item) == nil {
+			items[productID] = item
+		}
+	}
+	return items
+}
+
+// mergeCartHandler serves POST /cart/merge?from_user=&to_user=, folding a
+// guest cart into a user's: quantities are summed per product, the merged cart
+// is written under to_user and from_user's cart is deleted
+func mergeCartHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := trace.SpanFromContext(ctx)
+
+	fromUser := r.URL.Query().Get("from_user")
+	toUser := r.URL.Query().Get("to_user")
+	if fromUser == "" || toUser == "" || fromUser == toUser {
+		http.Error(w, "from_user and to_user are required and must differ", http.StatusBadRequest)
+		return
+	}
+
+	span.SetAttributes(
+		common.BoundedAttr("app.cart.merge.from_user", fromUser),
+		common.BoundedAttr("app.user.id", toUser),
+	)
+
+	mergedItems, totalItems, err := mergeCarts(ctx, fmt.Sprintf("cart:%s", fromUser), fmt.Sprintf("cart:%s", toUser))
+	if err != nil {
+		common.RecordSpanError(span, err)
+		redisErrors.Add(ctx, 1, metric.WithAttributes(attribute.String("operation", "merge_cart")))
+		cartLogger.ErrorContext(ctx, "Failed to merge carts", "error", err)
+		http.Error(w, "Failed to merge carts", cartErrorStatus(err))
+		return
+	}
+	span.SetAttributes(
+		attribute.Int("app.cart.merge.items", mergedItems),
+		attribute.Int("app.cart.items.count", totalItems),
+	)
+
+	cartOperations.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("operation", "merge_cart"),
+	))
+
+	cartLogger.InfoContext(ctx, "MergeCart",
+		"from_user", fromUser,
+		"to_user", toUser,
+		"merged_items", mergedItems,
+		"items_count", totalItems,
+	)
+
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"status": "emptied", "user_id": "%s"}`, userID)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":      toUser,
+		"merged_items": mergedItems,
+		"items_count":  totalItems,
+	})
+}
+
+// mergeCarts adds fromKey's items to toKey's and deletes fromKey, watching
+// both so an add to either cart mid-merge retries instead of being lost. It
+// returns how many products the source cart held and the merged item count.
+func mergeCarts(ctx context.Context, fromKey, toKey string) (mergedItems, totalItems int, err error) {
+	txf := func(tx *redis.Tx) error {
+		fromHash, err := tx.HGetAll(ctx, fromKey).Result()
+		if redisFailed(err) {
+			return err
+		}
+		toHash, err := tx.HGetAll(ctx, toKey).Result()
+		if redisFailed(err) {
+			return err
+		}
+
+		merged := decodeCartItems(toHash)
+		for productID, item := range decodeCartItems(fromHash) {
+			m := merged[productID]
+			m.ProductID = productID
+			m.Quantity += item.Quantity
+			merged[productID] = m
+		}
+
+		mergedItems, totalItems = len(fromHash), 0
+		fields := make([]interface{}, 0, 2*len(merged))
+		for productID, item := range merged {
+			totalItems += item.Quantity
+			itemJSON, _ := json.Marshal(item)
+			fields = append(fields, productID, itemJSON)
+		}
+
+		// Write the merged cart and drop the source in one transaction; with
+		// both carts empty there is nothing to write
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if len(fields) > 0 {
+				pipe.HSet(ctx, toKey, fields...)
+				pipe.ExpireNX(ctx, toKey, cartTTL)
+			}
+			pipe.Del(ctx, fromKey)
+			return nil
+		})
+		return err
+	}
+
+	// Use WATCH/MULTI/EXEC - auto-instrumented by otelredis
+	for attempt := 0; attempt < cartWatchRetries; attempt++ {
+		err = redisClient.Watch(ctx, txf, fromKey, toKey)
+		if !errors.Is(err, redis.TxFailedErr) {
+			if redisFailed(err) {
+				return 0, 0, err
+			}
+			return mergedItems, totalItems, nil
+		}
+		trace.SpanFromContext(ctx).AddEvent("cart_watch_conflict", trace.WithAttributes(
+			attribute.Int("app.cart.pipeline.attempt", attempt+1),
+		))
+	}
+	return 0, 0, errCartContended
 }
@@ -0,0 +1,321 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// commandLog records the name of every command sent through a Redis client,
+// and how many pipelines (MULTI/EXEC included) carried them
+type commandLog struct {
+	mu        sync.Mutex
+	commands  []string
+	pipelines int
+}
+
+func (l *commandLog) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (l *commandLog) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		l.record(cmd)
+		return next(ctx, cmd)
+	}
+}
+
+func (l *commandLog) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		l.mu.Lock()
+		l.pipelines++
+		l.mu.Unlock()
+		for _, cmd := range cmds {
+			l.record(cmd)
+		}
+		return next(ctx, cmds)
+	}
+}
+
+func (l *commandLog) record(cmd redis.Cmder) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.commands = append(l.commands, cmd.Name())
+}
+
+func (l *commandLog) count(name string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, c := range l.commands {
+		if c == name {
+			n++
+		}
+	}
+	return n
+}
+
+// cartItem reads one product's entry from the user's cart
+func cartItem(t *testing.T, userID, productID string) CartItem {
+	t.Helper()
+	raw, err := redisClient.HGet(context.Background(), "cart:"+userID, productID).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var item CartItem
+	if err := json.Unmarshal([]byte(raw), &item); err != nil {
+		t.Fatal(err)
+	}
+	return item
+}
+
+func TestBulkAddWritesCartInOneCall(t *testing.T) {
+	newTestRedis(t)
+	useTestCart(t, fixedRNG{n: 1})
+	log := &commandLog{}
+	redisClient.AddHook(log)
+
+	body := `[{"product_id":"OLJCESPC7Z"},{"product_id":"66VCHSJNUP","quantity":3},{"product_id":"OLJCESPC7Z"}]`
+	rec := httptest.NewRecorder()
+	addItemsBulkHandler(rec, httptest.NewRequest("POST", "/cart/add/bulk?user_id=u-1", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("bulk add returned %d: %s", rec.Code, rec.Body)
+	}
+
+	if log.count("hset") != 1 || log.count("hmget") != 1 || log.pipelines != 1 {
+		t.Fatalf("bulk add sent %v in %d pipelines, want one HMGET and one HSET in one transaction", log.commands, log.pipelines)
+	}
+	// fixedRNG{n: 1} picks a quantity of 2 for items that don't give one
+	if got := cartItem(t, "u-1", "OLJCESPC7Z").Quantity; got != 4 {
+		t.Fatalf("repeated product quantity = %d, want 4", got)
+	}
+	if got := cartItem(t, "u-1", "66VCHSJNUP").Quantity; got != 3 {
+		t.Fatalf("explicit quantity = %d, want 3", got)
+	}
+}
+
+func TestConcurrentAddsLoseNoUpdate(t *testing.T) {
+	newTestRedis(t)
+	useTestCart(t, fixedRNG{})
+	const writers, adds = 2, 25
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < adds; {
+				_, _, err := incrementCartItems(context.Background(), "cart:u-1", []CartItem{{ProductID: "OLJCESPC7Z", Quantity: 1}})
+				switch {
+				case errors.Is(err, errCartContended):
+					// The other writer kept winning; 409 tells callers to retry
+				case err != nil:
+					errs <- err
+					return
+				default:
+					i++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if got := cartItem(t, "u-1", "OLJCESPC7Z").Quantity; got != writers*adds {
+		t.Fatalf("quantity = %d after %d adds, want no update lost", got, writers*adds)
+	}
+}
+
+func TestCartTTLStartsOnFirstAddOnly(t *testing.T) {
+	mr := newTestRedis(t)
+	useTestCart(t, fixedRNG{})
+	setForTest(t, &cartTTL, 30*time.Minute)
+
+	add := func(productID string) {
+		rec := httptest.NewRecorder()
+		addItemHandler(rec, httptest.NewRequest("POST", "/cart/add?user_id=u-1&product_id="+productID, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("add returned %d: %s", rec.Code, rec.Body)
+		}
+	}
+
+	add("OLJCESPC7Z")
+	if got := mr.TTL("cart:u-1"); got != 30*time.Minute {
+		t.Fatalf("TTL after first add = %v, want CART_TTL of 30m", got)
+	}
+	mr.FastForward(10 * time.Minute)
+	add("66VCHSJNUP")
+	if got := mr.TTL("cart:u-1"); got != 20*time.Minute {
+		t.Fatalf("TTL after second add = %v, want the first add's 20m left, not refreshed", got)
+	}
+}
+
+func TestInvalidCartTTLFallsBackToHour(t *testing.T) {
+	for _, ttl := range []time.Duration{0, -time.Minute} {
+		if got := validCartTTL(ttl); got != time.Hour {
+			t.Errorf("validCartTTL(%v) = %v, want 1h", ttl, got)
+		}
+	}
+	if got := validCartTTL(15 * time.Minute); got != 15*time.Minute {
+		t.Errorf("validCartTTL(15m) = %v, want it kept", got)
+	}
+}
+
+func TestRedisErrorsCounted(t *testing.T) {
+	newTestRedis(t)
+	useTestCart(t, fixedRNG{n: 1})
+	mp, reader := newTestMeterProvider(t)
+	initCartMetrics(mp)
+	redisClient.Close()
+
+	for _, tt := range []struct {
+		operation, target, body string
+		handler                 http.HandlerFunc
+	}{
+		{"add_item", "/cart/add?user_id=u-1", "", addItemHandler},
+		{"add_items_bulk", "/cart/add/bulk?user_id=u-1", `[{"product_id":"OLJCESPC7Z"}]`, addItemsBulkHandler},
+		{"get_cart", "/cart?user_id=u-1", "", getCartHandler},
+	} {
+		rec := httptest.NewRecorder()
+		tt.handler(rec, httptest.NewRequest("POST", tt.target, strings.NewReader(tt.body)))
+		if rec.Code != http.StatusInternalServerError {
+			t.Fatalf("%s with Redis closed returned %d, want 500", tt.operation, rec.Code)
+		}
+		if got := counterValueWith(t, reader, "app.cart.redis.errors", attribute.String("operation", tt.operation)); got != 1 {
+			t.Errorf("app.cart.redis.errors{operation=%s} = %d, want 1", tt.operation, got)
+		}
+	}
+}
+
+// interleaveOnce runs write the first time the client sends command for key,
+// as if another request changed the cart mid-transaction
+type interleaveOnce struct {
+	command, key string
+	write        func()
+	once         sync.Once
+}
+
+func (h *interleaveOnce) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *interleaveOnce) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		if args := cmd.Args(); cmd.Name() == h.command && len(args) > 1 && args[1] == h.key {
+			h.once.Do(h.write)
+		}
+		return err
+	}
+}
+
+func (h *interleaveOnce) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestMergeRetriesOnConcurrentAdd(t *testing.T) {
+	mr := newTestRedis(t)
+	useTestCart(t, fixedRNG{})
+	mr.HSet("cart:guest", "OLJCESPC7Z", `{"product_id":"OLJCESPC7Z","quantity":1}`)
+	mr.HSet("cart:u-1", "OLJCESPC7Z", `{"product_id":"OLJCESPC7Z","quantity":2}`)
+
+	// Another request adds to the target cart after the merge has read it
+	other := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { other.Close() })
+	redisClient.AddHook(&interleaveOnce{command: "hgetall", key: "cart:u-1", write: func() {
+		other.HSet(context.Background(), "cart:u-1", "OLJCESPC7Z", `{"product_id":"OLJCESPC7Z","quantity":6}`)
+	}})
+
+	rec := httptest.NewRecorder()
+	mergeCartHandler(rec, httptest.NewRequest("POST", "/cart/merge?from_user=guest&to_user=u-1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("merge returned %d: %s", rec.Code, rec.Body)
+	}
+
+	// 6 after the concurrent add + 1 merged from guest
+	if got := cartItem(t, "u-1", "OLJCESPC7Z").Quantity; got != 7 {
+		t.Fatalf("merged quantity = %d, want 7 with the concurrent add kept", got)
+	}
+	if mr.Exists("cart:guest") {
+		t.Fatal("source cart not deleted after merge")
+	}
+}
+
+func TestMissingCartDataIsNotAServerError(t *testing.T) {
+	mr := newTestRedis(t)
+	useTestCart(t, fixedRNG{})
+	mp, reader := newTestMeterProvider(t)
+	initCartMetrics(mp)
+	mr.HSet("cart:u-2", "OLJCESPC7Z", `{"product_id":"OLJCESPC7Z","quantity":1}`)
+
+	for _, tt := range []struct {
+		name, method, target string
+		handler              http.HandlerFunc
+		want                 int
+	}{
+		{"get missing cart", "GET", "/cart?user_id=nobody", getCartHandler, http.StatusOK},
+		{"get item from missing cart", "GET", "/cart/item?user_id=nobody&product_id=OLJCESPC7Z", getItemHandler, http.StatusNotFound},
+		{"get missing item", "GET", "/cart/item?user_id=u-2&product_id=66VCHSJNUP", getItemHandler, http.StatusNotFound},
+		{"empty missing cart", "POST", "/cart/empty?user_id=nobody", emptyCartHandler, http.StatusOK},
+		{"merge missing carts", "POST", "/cart/merge?from_user=nobody&to_user=nobody-else", mergeCartHandler, http.StatusOK},
+		{"add to missing cart", "POST", "/cart/add?user_id=new-user&product_id=OLJCESPC7Z", addItemHandler, http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		tt.handler(rec, httptest.NewRequest(tt.method, tt.target, nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s returned %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body)
+		}
+	}
+	if got := counterValue(t, reader, "app.cart.redis.errors"); got != 0 {
+		t.Fatalf("app.cart.redis.errors = %d, want missing data not counted as a failure", got)
+	}
+}
+
+func TestCartSizeCountsDistinctProducts(t *testing.T) {
+	newTestRedis(t)
+	useTestCart(t, fixedRNG{})
+	mp, reader := newTestMeterProvider(t)
+	initCartMetrics(mp)
+
+	// Three distinct products, one of them added twice
+	for _, productID := range []string{"OLJCESPC7Z", "66VCHSJNUP", "1YMWWN1N4O", "OLJCESPC7Z"} {
+		rec := httptest.NewRecorder()
+		addItemHandler(rec, httptest.NewRequest("POST", "/cart/add?user_id=u-1&product_id="+productID, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("add %s returned %d: %s", productID, rec.Code, rec.Body)
+		}
+	}
+	getCartHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/cart?user_id=u-1", nil))
+	emptyCartHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/cart/empty?user_id=u-1", nil))
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]metricdata.HistogramDataPoint[int64]{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if h, ok := m.Data.(metricdata.Histogram[int64]); ok && m.Name == "app.cart.size" {
+				for _, dp := range h.DataPoints {
+					op, _ := dp.Attributes.Value("operation")
+					got[op.AsString()] = dp
+				}
+			}
+		}
+	}
+	for op, want := range map[string]int64{"get_cart": 3, "empty_cart": 0} {
+		if dp, ok := got[op]; !ok || dp.Count != 1 || dp.Sum != want {
+			t.Errorf("app.cart.size{operation=%s} = %+v, want one recording of %d", op, dp, want)
+		}
+	}
+}
@@ -1,37 +1,72 @@
 package services
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"math/rand"
+	"math"
 	"net/http"
+	"otel-mock/common"
 	"otel-mock/config"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
-	"go.opentelemetry.io/contrib/bridges/otelslog"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/baggage"
 	otellog "go.opentelemetry.io/otel/log"
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
 )
 
 var (
-	checkoutTracer  trace.Tracer
-	checkoutLogger  *slog.Logger
-	checkoutMeter   metric.Meter
-	ordersCounter   metric.Int64Counter
-	checkoutLatency metric.Float64Histogram
+	checkoutTracer    trace.Tracer
+	checkoutLogger    *slog.Logger
+	checkoutMeter     metric.Meter
+	ordersCounter     metric.Int64Counter
+	checkoutLatency   metric.Float64Histogram
+	messagesPublished metric.Int64Counter
+	ordersInFlight    metric.Int64UpDownCounter
+	kafkaWriter       *kafka.Writer
+	// checkoutClock times saga steps and order latency; tests may replace it
+	checkoutClock Clock = SystemClock
+
+	checkoutInitOnce sync.Once
 )
 
-func initCheckoutMetrics() {
-	checkoutMeter = otel.Meter("checkout")
+// checkoutService is one checkout instance. The batch runner and the HTTP
+// server both run in -service=all, so each gets its own RNG while the
+// telemetry and clients above are set up once and shared.
+type checkoutService struct {
+	rng RNG
+	// redis stores order statuses and idempotent results; nil in batch mode
+	redis *redis.Client
+}
+
+// initCheckout sets up checkout's shared state on first use
+func initCheckout(tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) {
+	checkoutInitOnce.Do(func() {
+		checkoutLogger = common.NewLogger("checkout", lp)
+		checkoutTracer = tp.Tracer("checkout")
+		initCheckoutMetrics(mp)
+		kafkaWriter = newKafkaWriter()
+	})
+}
+
+func initCheckoutMetrics(mp metric.MeterProvider) {
+	checkoutMeter = mp.Meter("checkout")
 	var err error
 	ordersCounter, err = checkoutMeter.Int64Counter("app.checkout.orders_total",
 		metric.WithDescription("Total number of orders placed"),
@@ -46,79 +81,379 @@ func initCheckoutMetrics() {
 	if err != nil {
 		panic(err)
 	}
-}
 
-func RunCheckoutService(count int, tp trace.TracerProvider, lp otellog.LoggerProvider) {
-	checkoutLogger = otelslog.NewLogger("checkout", otelslog.WithLoggerProvider(lp))
-	checkoutTracer = tp.Tracer("checkout")
-	initCheckoutMetrics()
+	messagesPublished, err = checkoutMeter.Int64Counter("app.messaging.published",
+		metric.WithDescription("Messages published to Kafka"),
+		metric.WithUnit("{messages}"))
+	if err != nil {
+		panic(err)
+	}
 
-	// Create HTTP client with tracing
-	httpClient := &http.Client{
-		Transport: otelhttp.NewTransport(
-			http.DefaultTransport,
-			otelhttp.WithTracerProvider(tp),
-		),
+	ordersInFlight, err = checkoutMeter.Int64UpDownCounter("app.checkout.in_flight",
+		metric.WithDescription("Orders currently being placed"),
+		metric.WithUnit("{orders}"))
+	if err != nil {
+		panic(err)
 	}
+}
+
+// RunCheckoutService places count orders spread across concurrency workers,
+// each placing its orders in sequence and giving each at most orderTimeout
+// before moving on to the next. Cancelling ctx stops handing out orders,
+// aborts those in flight and returns after logging how many were placed.
+func RunCheckoutService(ctx context.Context, count, concurrency int, orderTimeout time.Duration, rng RNG, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) {
+	initCheckout(tp, mp, lp)
+	logEffectiveConfig(checkoutLogger)
+	c := &checkoutService{rng: rng}
 
-	checkoutLogger.Info("Checkout Service starting", "count", count)
+	// Create HTTP client with tracing
+	httpClient := newCheckoutClient(tp, mp)
 
-	// Wait for other services to start
-	time.Sleep(2 * time.Second)
+	checkoutLogger.Info("Checkout Service starting", "count", count, "concurrency", concurrency, "order_timeout", orderTimeout.String(), "dry_run", config.DryRun)
 
-	ctx := context.Background()
-	for i := 0; i < count; i++ {
-		placeOrder(ctx, httpClient)
-		time.Sleep(time.Duration(rand.Intn(300)+100) * time.Millisecond)
+	// Wait for other services to start (nothing is called in dry-run mode)
+	if !config.DryRun {
+		if err := waitForHealthy(ctx, startupDependencies(), config.StartupTimeout); err != nil {
+			checkoutLogger.Warn("Starting orders before all dependencies are up", "error", err)
+		}
 	}
 
-	checkoutLogger.Info("Checkout Service completed all orders", "total", count)
+	placed := c.runBatch(ctx, httpClient, count, concurrency, orderTimeout)
+	if ctx.Err() != nil {
+		checkoutLogger.Warn("Checkout Service cancelled before placing all orders",
+			"placed", placed, "total", count, "error", context.Cause(ctx))
+		return
+	}
+	checkoutLogger.Info("Checkout Service completed all orders", "total", placed)
 	time.Sleep(2 * time.Second) // Allow telemetry to flush
 }
 
+// runBatch places up to count orders across concurrency workers and returns
+// how many were placed successfully. Once ctx is cancelled no further orders
+// start, and the order it interrupted isn't counted.
+func (c *checkoutService) runBatch(ctx context.Context, httpClient *http.Client, count, concurrency int, orderTimeout time.Duration) int64 {
+	// Each order number is handed to exactly one worker, so exactly count
+	// orders are placed whatever the concurrency
+	orders := make(chan int)
+	go func() {
+		defer close(orders)
+		for i := 1; i <= count; i++ {
+			select {
+			case orders <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var placed atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < max(concurrency, 1); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range orders {
+				if ctx.Err() != nil {
+					return
+				}
+				orderCtx, cancel := context.WithTimeout(ctx, orderTimeout)
+				_, err := c.placeOrder(orderCtx, httpClient, OrderRequest{})
+				if errors.Is(orderCtx.Err(), context.DeadlineExceeded) {
+					checkoutLogger.Warn("Order timed out, continuing with next order", "order", i, "error", err)
+				}
+				cancel()
+				if ctx.Err() != nil {
+					return
+				}
+				if err == nil {
+					placed.Add(1)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Duration(c.rng.Intn(300)+100) * time.Millisecond):
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return placed.Load()
+}
+
 // InitCheckoutServer creates an HTTP server for checkout (receives requests from frontend)
-func InitCheckoutServer(port string, tp trace.TracerProvider, lp otellog.LoggerProvider) *http.Server {
-	checkoutLogger = otelslog.NewLogger("checkout", otelslog.WithLoggerProvider(lp))
-	checkoutTracer = tp.Tracer("checkout")
-	initCheckoutMetrics()
+func InitCheckoutServer(port string, rng RNG, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) *http.Server {
+	initCheckout(tp, mp, lp)
+	logEffectiveConfig(checkoutLogger)
+	c := &checkoutService{rng: rng, redis: common.NewRedisClient("checkout")}
 
 	// HTTP client for calling downstream services
-	httpClient := &http.Client{
-		Transport: otelhttp.NewTransport(
-			http.DefaultTransport,
-			otelhttp.WithTracerProvider(tp),
-		),
-	}
-
-	handler := otelhttp.NewHandler(
-		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			placeOrder(r.Context(), httpClient)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			fmt.Fprintf(w, `{"status": "order_placed"}`)
-		}),
+	httpClient := newCheckoutClient(tp, mp)
+
+	server := common.NewServer(port, c.newMux(httpClient, tp))
+
+	checkoutLogger.Info("Checkout HTTP Server starting", "port", port)
+	return server
+}
+
+// newMux routes the checkout endpoints, calling downstreams with httpClient
+func (c *checkoutService) newMux(httpClient *http.Client, tp trace.TracerProvider) *http.ServeMux {
+	handler := common.NewHandler(
+		c.placeOrderHandler(httpClient),
 		"PlaceOrder",
-		otelhttp.WithTracerProvider(tp),
+		tp,
+	)
+
+	statusHandler := common.NewHandler(
+		dependencyStatusHandler(httpClient),
+		"GetStatus",
+		tp,
 	)
 
 	mux := http.NewServeMux()
 	mux.Handle("/checkout", handler)
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"status":"ok"}`))
-	})
+	mux.Handle("/status", statusHandler)
+	mux.Handle("GET /orders/{id}", common.NewHandler(http.HandlerFunc(c.getOrderHandler), "GetOrder", tp))
+	mux.HandleFunc("/health", healthHandler)
+	return mux
+}
+
+// DependencyStatus is the /status response: each downstream's state plus overall
+type DependencyStatus struct {
+	Status       string            `json:"status"`
+	Dependencies map[string]string `json:"dependencies"`
+}
+
+// placeOrderHandler serves /checkout. With an Idempotency-Key header, repeats
+// of a request are answered from the first one's stored result.
+func (c *checkoutService) placeOrderHandler(httpClient *http.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orderReq, err := decodeOrderRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		key := r.Header.Get(IdempotencyKeyHeader)
+		saved := false
+		if key != "" {
+			if stored, claimed := c.claimIdempotencyKey(r.Context(), key); !claimed {
+				replayIdempotentResult(w, r, key, stored)
+				return
+			}
+			// Free the key unless a result is stored below, so an
+			// aborted or panicking order can be retried straight away
+			defer func() {
+				if !saved {
+					c.releaseIdempotencyKey(context.WithoutCancel(r.Context()), key)
+				}
+			}()
+		}
+		result, err := c.placeOrder(r.Context(), httpClient, orderReq)
+		status := http.StatusOK
+		if err != nil {
+			status = orderFailureStatus(err)
+		}
+		if key != "" && r.Context().Err() == nil {
+			saved = c.storeIdempotentResult(context.WithoutCancel(r.Context()), key, status, result)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(result)
+	}
+}
 
-	server := &http.Server{
-		Addr:    port,
-		Handler: mux,
+// dependencyStatusHandler serves /status, answering 503 when any dependency is down
+func dependencyStatusHandler(client *http.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := checkDependencies(r.Context(), client)
+		code := http.StatusOK
+		if status.Status != "up" {
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(status)
 	}
+}
 
-	checkoutLogger.Info("Checkout HTTP Server starting", "port", port)
-	return server
+// checkoutDependencies returns the downstreams probed by /status. It reads
+// config at call time so URL flags parsed in main take effect.
+func checkoutDependencies() map[string]string {
+	return map[string]string{
+		"cart":            config.CartURL,
+		"shipping":        config.ShippingURL,
+		"product-catalog": config.ProductCatalogURL,
+		"currency":        config.CurrencyURL,
+		"payment":         config.PaymentURL,
+		"email":           config.EmailURL,
+	}
+}
+
+// startupDependencies are the Go downstreams the batch waits for before its
+// first order. Payment and email are Node services a Go-only run never
+// starts, so waiting on them would stall for the whole STARTUP_TIMEOUT;
+// orders placed before they are up fail like any other outage.
+func startupDependencies() []string {
+	return []string{config.CartURL, config.ShippingURL, config.ProductCatalogURL, config.CurrencyURL}
+}
+
+// checkDependencies probes every dependency's /health concurrently
+func checkDependencies(ctx context.Context, client *http.Client) DependencyStatus {
+	deps := checkoutDependencies()
+	result := DependencyStatus{Status: "up", Dependencies: make(map[string]string, len(deps))}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, baseURL := range deps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			state := "down"
+			if probeHealth(ctx, client, name, baseURL) {
+				state = "up"
+			}
+			mu.Lock()
+			result.Dependencies[name] = state
+			if state == "down" {
+				result.Status = "down"
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return result
+}
+
+// probeHealth reports whether a dependency answered its /health probe with a
+// 2xx response
+func probeHealth(ctx context.Context, client *http.Client, name, baseURL string) bool {
+	ctx, span := checkoutTracer.Start(ctx, "probe "+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("app.dependency.name", name)))
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, config.HealthProbeTimeout)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", baseURL+"/health", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		common.RecordSpanError(span, err)
+		span.SetAttributes(attribute.Bool("app.dependency.up", false))
+		checkoutLogger.WarnContext(ctx, "Health probe failed", "dependency", name, "error", err)
+		return false
+	}
+	resp.Body.Close()
+
+	up := resp.StatusCode >= 200 && resp.StatusCode < 300
+	span.SetAttributes(
+		attribute.Bool("app.dependency.up", up),
+		attribute.Int("http.response.status_code", resp.StatusCode),
+	)
+	return up
+}
+
+// waitForHealthy polls each URL's /health until all answer 2xx or timeout
+// passes, the same test /status applies
+func waitForHealthy(ctx context.Context, urls []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	client := &http.Client{Timeout: time.Second}
+	pending := slices.Clone(urls)
+	for {
+		pending = slices.DeleteFunc(pending, func(baseURL string) bool {
+			req, _ := http.NewRequestWithContext(ctx, "GET", baseURL+"/health", nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				return false
+			}
+			resp.Body.Close()
+			return resp.StatusCode >= 200 && resp.StatusCode < 300
+		})
+		if len(pending) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("dependencies not ready after %s: %v", timeout, pending)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// OrderRequest is the optional /checkout body; empty fields are randomized
+type OrderRequest struct {
+	UserID   string   `json:"user_id"`
+	Currency string   `json:"currency"`
+	Items    []string `json:"items"`
+}
+
+func decodeOrderRequest(r *http.Request) (OrderRequest, error) {
+	var orderReq OrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&orderReq); err != nil && err != io.EOF {
+		return orderReq, fmt.Errorf("invalid order request: %w", err)
+	}
+	if orderReq.Currency != "" && !slices.Contains(checkoutCurrencies, orderReq.Currency) {
+		return orderReq, fmt.Errorf("unsupported currency %q", orderReq.Currency)
+	}
+	return orderReq, nil
+}
+
+// OrderResult describes a placed order, or how far a failed one got
+type OrderResult struct {
+	Status        string  `json:"status"`
+	OrderID       string  `json:"order_id"`
+	UserID        string  `json:"user_id"`
+	Currency      string  `json:"currency"`
+	Amount        float64 `json:"amount"`
+	ShippingCost  float64 `json:"shipping_cost"`
+	ItemsCount    int     `json:"items_count"`
+	TransactionID string  `json:"transaction_id,omitempty"`
+	TrackingID    string  `json:"tracking_id,omitempty"`
+	DeclineReason string  `json:"decline_reason,omitempty"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// paymentDeclinedError is a charge the payment service refused with 402,
+// carrying its reason (insufficient_funds, card_expired, fraud_hold)
+type paymentDeclinedError struct {
+	Reason string
+}
+
+func (e *paymentDeclinedError) Error() string {
+	return "payment declined: " + e.Reason
+}
+
+// stepDuration is the app.step.duration_ms attribute for a saga step begun
+// at start, so the order span's event timeline shows where time went
+func stepDuration(start time.Time) attribute.KeyValue {
+	return attribute.Int64("app.step.duration_ms", checkoutClock.Since(start).Milliseconds())
+}
+
+// failed marks the result as failed at the given step
+func (o *OrderResult) failed(step string, err error) (*OrderResult, error) {
+	o.Status = step + "_failed"
+	o.Error = err.Error()
+	return o, err
+}
+
+// orderFailureStatus maps a failed order to the HTTP status returned to the
+// caller: 402 when payment declined the card, 502 when any downstream
+// (payment included) failed or couldn't be reached
+func orderFailureStatus(err error) int {
+	var declined *paymentDeclinedError
+	if errors.As(err, &declined) {
+		return http.StatusPaymentRequired
+	}
+	return http.StatusBadGateway
 }
 
-func placeOrder(ctx context.Context, client *http.Client) {
-	start := time.Now()
+func (c *checkoutService) placeOrder(ctx context.Context, client *http.Client, orderReq OrderRequest) (*OrderResult, error) {
+	start := checkoutClock.Now()
+	ordersInFlight.Add(ctx, 1)
+	defer ordersInFlight.Add(context.WithoutCancel(ctx), -1)
 
 	// Get the span from context (created by otelhttp handler or create new one for batch mode)
 	span := trace.SpanFromContext(ctx)
@@ -130,13 +465,31 @@ func placeOrder(ctx context.Context, client *http.Client) {
 		defer span.End()
 	}
 
-	userID := fmt.Sprintf("user-%d", rand.Intn(10000))
-	currency := randomCurrency()
+	// Deferred after span.End so it runs first and lands on the span
+	defer func() {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			span.AddEvent("order_timeout", trace.WithAttributes(
+				attribute.Int64("app.order.elapsed_ms", checkoutClock.Since(start).Milliseconds()),
+			))
+		}
+	}()
+
+	userID := orderReq.UserID
+	if userID == "" {
+		userID = fmt.Sprintf("user-%d", c.rng.Intn(10000))
+	}
+	currency := orderReq.Currency
+	if currency == "" {
+		currency = c.randomCurrency()
+	}
 	orderID := uuid.New().String()
+	ctx = contextWithOrderID(ctx, orderID)
+	result := &OrderResult{OrderID: orderID, UserID: userID, Currency: currency}
+	c.recordOrderStatus(ctx, orderID, orderPlaced)
 
 	// Set main span attributes (like real checkout service)
 	span.SetAttributes(
-		attribute.String("app.user.id", userID),
+		common.BoundedAttr("app.user.id", userID),
 		attribute.String("app.user.currency", currency),
 	)
 
@@ -148,69 +501,125 @@ func placeOrder(ctx context.Context, client *http.Client) {
 	if m := bag.Member("session.id"); m.Value() != "" {
 		span.SetAttributes(attribute.String("session.id", m.Value()))
 	}
+	if config.DryRun {
+		span.SetAttributes(attribute.Bool("app.dry_run", true))
+	}
+
+	// Feature flags carried in baggage steer this trace's behavior
+	if featureEnabled(ctx, "feature.slow_payment") {
+		span.SetAttributes(attribute.Bool("app.feature.slow_payment", true))
+	}
+	if featureEnabled(ctx, "feature.fail_shipping") {
+		span.SetAttributes(attribute.Bool("app.feature.fail_shipping", true))
+	}
 
 	checkoutLogger.InfoContext(ctx, "PlaceOrder started", "user_id", userID, "currency", currency)
 
 	// Step 1: Prepare order items (calls cart service with Redis)
-	prep, err := prepareOrderItems(ctx, client, userID, currency)
+	stepStart := checkoutClock.Now()
+	prep, err := c.prepareOrderItems(ctx, client, userID, currency, orderReq.Items)
 	if err != nil {
-		span.RecordError(err)
+		common.RecordSpanError(span, err)
 		checkoutLogger.ErrorContext(ctx, "Prepare failed", "error", err)
-		return
+		return result.failed("prepare", err)
 	}
+	result.Amount = prep.total
+	result.ShippingCost = prep.shippingCost
+	result.ItemsCount = prep.itemCount
 	span.AddEvent("prepared", trace.WithAttributes(
 		attribute.Int("app.order.items.count", prep.itemCount),
+		stepDuration(stepStart),
 	))
 
+	// Steps 1b-1e are independent lookups, so they run concurrently as sibling
+	// spans under the order span; each adds its event as it finishes. They
+	// are best effort (failures are recorded on their own spans), so none
+	// returns an error and the order goes on once all have finished.
+	g, gctx := errgroup.WithContext(ctx)
 	// Step 1b: Get product details from product-catalog
-	getProductDetails(ctx, client, prep.productIDs)
-	span.AddEvent("product_details_fetched")
-
+	g.Go(func() error {
+		start := checkoutClock.Now()
+		getProductDetails(gctx, client, prep.productIDs)
+		span.AddEvent("product_details_fetched", trace.WithAttributes(stepDuration(start)))
+		return nil
+	})
 	// Step 1c: Convert currency
-	getCurrencyConversion(ctx, client, currency, prep.total)
-	span.AddEvent("currency_converted")
-
+	g.Go(func() error {
+		start := checkoutClock.Now()
+		getCurrencyConversion(gctx, client, currency, prep.total)
+		span.AddEvent("currency_converted", trace.WithAttributes(stepDuration(start)))
+		return nil
+	})
 	// Step 1d: Get recommendations (like real demo)
-	getRecommendations(ctx, client, userID, prep.productIDs)
-	span.AddEvent("recommendations_fetched")
-
+	g.Go(func() error {
+		start := checkoutClock.Now()
+		getRecommendations(gctx, client, userID, prep.productIDs)
+		span.AddEvent("recommendations_fetched", trace.WithAttributes(stepDuration(start)))
+		return nil
+	})
 	// Step 1e: Get ads (like real demo)
-	getAds(ctx, client)
-	span.AddEvent("ads_fetched")
+	g.Go(func() error {
+		start := checkoutClock.Now()
+		c.getAds(gctx, client)
+		span.AddEvent("ads_fetched", trace.WithAttributes(stepDuration(start)))
+		return nil
+	})
+	g.Wait()
 
 	// Step 2: Charge payment
-	txID, err := chargeCard(ctx, client, prep.total, currency)
+	stepStart = checkoutClock.Now()
+	txID, err := c.chargeCard(ctx, client, prep.total, currency)
 	if err != nil {
-		span.RecordError(err)
-		checkoutLogger.ErrorContext(ctx, "Payment failed", "error", err)
-		return
+		common.RecordSpanError(span, err)
+		var declined *paymentDeclinedError
+		if errors.As(err, &declined) {
+			result.DeclineReason = declined.Reason
+			span.SetAttributes(attribute.String("app.payment.decline.reason", declined.Reason))
+		}
+		checkoutLogger.ErrorContext(ctx, "Payment failed", "error", err, "decline_reason", result.DeclineReason)
+		return result.failed("payment", err)
 	}
+	result.TransactionID = txID
+	c.recordOrderStatus(ctx, orderID, orderCharged)
 	span.AddEvent("charged", trace.WithAttributes(
 		attribute.String("app.payment.transaction.id", txID),
+		stepDuration(stepStart),
 	))
 
 	// Step 3: Ship order
-	trackingID, err := shipOrder(ctx, client, prep.itemCount)
+	stepStart = checkoutClock.Now()
+	trackingID, err := shipOrder(ctx, client, prep.itemCount, prep.total, currency)
 	if err != nil {
-		span.RecordError(err)
+		common.RecordSpanError(span, err)
 		checkoutLogger.ErrorContext(ctx, "Shipping failed", "error", err)
-		return
+		return result.failed("shipping", err)
 	}
+	result.TrackingID = trackingID
+	c.recordOrderStatus(ctx, orderID, orderShipped)
 	span.AddEvent("shipped", trace.WithAttributes(
 		attribute.String("app.shipping.tracking.id", trackingID),
+		stepDuration(stepStart),
 	))
 
 	// Step 4: Send confirmation email
+	stepStart = checkoutClock.Now()
 	err = sendOrderConfirmation(ctx, client, orderID, userID)
 	if err != nil {
 		checkoutLogger.WarnContext(ctx, "Email failed", "error", err)
 	}
-	span.AddEvent("email_sent")
-
-	// Step 5: Mock Kafka publish (orders topic)
-	publishToKafka(ctx, client, orderID)
+	span.AddEvent("email_sent", trace.WithAttributes(stepDuration(stepStart)))
+
+	// Step 5: Kafka publish (orders topic)
+	stepStart = checkoutClock.Now()
+	c.publishToKafka(ctx, client, OrderMessage{
+		OrderID:  orderID,
+		UserID:   userID,
+		Amount:   prep.total,
+		Currency: currency,
+	})
 	span.AddEvent("published_to_kafka", trace.WithAttributes(
 		attribute.String("messaging.destination.name", "orders"),
+		stepDuration(stepStart),
 	))
 
 	// Final attributes
@@ -223,7 +632,7 @@ func placeOrder(ctx context.Context, client *http.Client) {
 	)
 
 	// Record metrics
-	duration := float64(time.Since(start).Milliseconds())
+	duration := float64(checkoutClock.Since(start).Milliseconds())
 	ordersCounter.Add(ctx, 1, metric.WithAttributes(
 		attribute.String("currency", currency),
 		attribute.String("status", "success"),
@@ -238,6 +647,10 @@ func placeOrder(ctx context.Context, client *http.Client) {
 		"tracking_id", trackingID,
 		"duration_ms", duration,
 	)
+
+	c.recordOrderStatus(ctx, orderID, orderConfirmed)
+	result.Status = "order_placed"
+	return result, nil
 }
 
 type orderPrep struct {
@@ -247,28 +660,30 @@ type orderPrep struct {
 	productIDs   []string
 }
 
-func prepareOrderItems(ctx context.Context, client *http.Client, userID, currency string) (*orderPrep, error) {
+func (c *checkoutService) prepareOrderItems(ctx context.Context, client *http.Client, userID, currency string, items []string) (*orderPrep, error) {
 	ctx, span := checkoutTracer.Start(ctx, "prepareOrderItemsAndShippingQuoteFromCart")
 	defer span.End()
 
 	checkoutLogger.InfoContext(ctx, "PrepareOrderItems started", "user_id", userID, "currency", currency)
 
 	span.SetAttributes(
-		attribute.String("app.user.id", userID),
+		common.BoundedAttr("app.user.id", userID),
 		attribute.String("app.user.currency", currency),
 	)
 
 	// Step 1: Add items to cart (calls Redis via cart service)
-	// Fixed item count for consistent trace depth
-	itemCount := 3
-	productIDs := make([]string, 0, itemCount)
-	for i := 0; i < itemCount; i++ {
-		productID := GetProductID()
-		productIDs = append(productIDs, productID)
-		if err := addToCart(ctx, client, userID, productID); err != nil {
-			checkoutLogger.WarnContext(ctx, "Failed to add item to cart", "error", err)
+	// Fixed item count for consistent trace depth unless the caller chose items
+	productIDs := items
+	if len(productIDs) == 0 {
+		productIDs = make([]string, 0, 3)
+		for i := 0; i < 3; i++ {
+			productIDs = append(productIDs, GetWeightedProductID(c.rng))
 		}
 	}
+	itemCount := len(productIDs)
+	if err := addItemsToCart(ctx, client, userID, productIDs); err != nil {
+		checkoutLogger.WarnContext(ctx, "Failed to add items to cart", "error", err)
+	}
 	span.AddEvent("items_added_to_cart", trace.WithAttributes(
 		attribute.Int("app.cart.items.count", itemCount),
 	))
@@ -278,13 +693,32 @@ func prepareOrderItems(ctx context.Context, client *http.Client, userID, currenc
 	if err != nil {
 		checkoutLogger.WarnContext(ctx, "Failed to get cart", "error", err)
 	}
+	cartCount := 0
+	for _, item := range cartItems {
+		cartCount += item.Quantity
+	}
 	span.AddEvent("cart_retrieved", trace.WithAttributes(
-		attribute.String("app.user.id", userID),
-		attribute.Int("app.cart.items.count", cartItems),
+		common.BoundedAttr("app.user.id", userID),
+		attribute.Int("app.cart.items.count", cartCount),
 	))
 
-	total := float64(rand.Intn(50000)+1000) / 100.0
-	shippingCost := float64(rand.Intn(1000)+100) / 100.0
+	// The subtotal is what the cart holds at catalog prices; if the cart or
+	// catalog can't be read the order still goes through at a made-up price
+	subtotal, err := cartSubtotal(ctx, client, cartItems)
+	switch {
+	case err != nil:
+		checkoutLogger.WarnContext(ctx, "Failed to price cart, using a random subtotal", "error", err)
+		subtotal = float64(c.rng.Intn(50000)+1000) / 100.0
+	case len(cartItems) == 0:
+		checkoutLogger.WarnContext(ctx, "Cart is empty, using a random subtotal", "user_id", userID)
+		subtotal = float64(c.rng.Intn(50000)+1000) / 100.0
+	}
+	shippingCost := float64(c.rng.Intn(1000)+100) / 100.0
+	total := math.Round((subtotal+shippingCost)*100) / 100
+	span.SetAttributes(
+		attribute.Float64("app.order.subtotal", subtotal),
+		attribute.Float64("app.order.shipping_cost", shippingCost),
+	)
 
 	// Step 3: Empty cart after checkout (calls Redis via cart service)
 	if err := emptyCart(ctx, client, userID); err != nil {
@@ -300,37 +734,64 @@ func prepareOrderItems(ctx context.Context, client *http.Client, userID, currenc
 	}, nil
 }
 
-func addToCart(ctx context.Context, client *http.Client, userID, productID string) error {
-	checkoutLogger.InfoContext(ctx, "AddItem", "user_id", userID, "product_id", productID)
-	url := fmt.Sprintf("%s/cart/add?user_id=%s&product_id=%s", config.CartURL, userID, productID)
-	req, _ := http.NewRequestWithContext(ctx, "POST", url, nil)
+// addItemsToCart adds every product to the user's cart in one
+// /cart/add/bulk call, leaving the cart service to pick quantities
+func addItemsToCart(ctx context.Context, client *http.Client, userID string, productIDs []string) error {
+	checkoutLogger.InfoContext(ctx, "AddItemsBulk", "user_id", userID, "count", len(productIDs))
+	items := make([]CartItem, len(productIDs))
+	for i, productID := range productIDs {
+		items[i] = CartItem{ProductID: productID}
+	}
+	body, _ := json.Marshal(items)
+	url := fmt.Sprintf("%s/cart/add/bulk?user_id=%s", config.CartURL, userID)
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
 	resp, err := client.Do(req)
 	if err != nil {
-		checkoutLogger.ErrorContext(ctx, "AddItem failed", "error", err)
+		checkoutLogger.ErrorContext(ctx, "AddItemsBulk failed", "error", err)
 		return err
 	}
 	defer resp.Body.Close()
 	return nil
 }
 
-func getCart(ctx context.Context, client *http.Client, userID string) (int, error) {
+func getCart(ctx context.Context, client *http.Client, userID string) ([]CartItem, error) {
 	checkoutLogger.InfoContext(ctx, "GetCart", "user_id", userID)
 	url := fmt.Sprintf("%s/cart?user_id=%s", config.CartURL, userID)
 	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
 	resp, err := client.Do(req)
 	if err != nil {
 		checkoutLogger.ErrorContext(ctx, "GetCart failed", "error", err)
-		return 0, err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	body, _ := io.ReadAll(resp.Body)
 	var res struct {
-		ItemsCount int `json:"items_count"`
+		ItemsCount int        `json:"items_count"`
+		Items      []CartItem `json:"items"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		err = fmt.Errorf("invalid cart response: %w", err)
+		common.RecordSpanError(trace.SpanFromContext(ctx), err)
+		checkoutLogger.ErrorContext(ctx, "GetCart failed", "error", err)
+		return nil, err
 	}
-	json.Unmarshal(body, &res)
 	checkoutLogger.InfoContext(ctx, "GetCart result", "items_count", res.ItemsCount)
-	return res.ItemsCount, nil
+	return res.Items, nil
+}
+
+// cartSubtotal sums quantity x catalog price over the cart's items
+func cartSubtotal(ctx context.Context, client *http.Client, items []CartItem) (float64, error) {
+	subtotal := 0.0
+	for _, item := range items {
+		price, err := fetchProductPrice(ctx, client, item.ProductID)
+		if err != nil {
+			return 0, fmt.Errorf("pricing %s: %w", item.ProductID, err)
+		}
+		subtotal += float64(item.Quantity) * price
+	}
+	return subtotal, nil
 }
 
 func emptyCart(ctx context.Context, client *http.Client, userID string) error {
@@ -346,7 +807,7 @@ func emptyCart(ctx context.Context, client *http.Client, userID string) error {
 	return nil
 }
 
-func chargeCard(ctx context.Context, client *http.Client, amount float64, currency string) (string, error) {
+func (c *checkoutService) chargeCard(ctx context.Context, client *http.Client, amount float64, currency string) (string, error) {
 	ctx, span := checkoutTracer.Start(ctx, "chargeCard", trace.WithSpanKind(trace.SpanKindInternal))
 	defer span.End()
 
@@ -358,32 +819,58 @@ func chargeCard(ctx context.Context, client *http.Client, amount float64, curren
 		attribute.String("payment.currency", currency),
 	)
 
+	if featureEnabled(ctx, "feature.slow_payment") {
+		delay := time.Duration(c.rng.Intn(1000)+1500) * time.Millisecond
+		span.SetAttributes(attribute.Bool("app.feature.slow_payment", true))
+		span.AddEvent("slow_payment_injected", trace.WithAttributes(
+			attribute.Int64("app.feature.delay_ms", delay.Milliseconds()),
+		))
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
 	req, _ := http.NewRequestWithContext(ctx, "POST", config.PaymentURL+"/charge", nil)
-	resp, err := client.Do(req)
+	resp, err := common.DoWithRetry(client, req)
 	if err != nil {
 		checkoutLogger.ErrorContext(ctx, "ChargeCard failed", "error", err)
 		return "", err
 	}
 	defer resp.Body.Close()
 
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusPaymentRequired {
+		var declined struct {
+			Reason string `json:"reason"`
+		}
+		json.Unmarshal(body, &declined)
+		// placeOrder logs the decline and tags the order span with its reason
+		return "", &paymentDeclinedError{Reason: cmp.Or(declined.Reason, "unknown")}
+	}
 	if resp.StatusCode != http.StatusOK {
 		err := fmt.Errorf("payment service returned %d", resp.StatusCode)
 		checkoutLogger.ErrorContext(ctx, "ChargeCard failed", "error", err)
 		return "", err
 	}
 
-	body, _ := io.ReadAll(resp.Body)
 	var res struct {
 		TransactionID string `json:"transaction_id"`
 	}
-	json.Unmarshal(body, &res)
+	if err := json.Unmarshal(body, &res); err != nil {
+		err = fmt.Errorf("invalid payment response: %w", err)
+		common.RecordSpanError(span, err)
+		checkoutLogger.ErrorContext(ctx, "ChargeCard failed", "error", err)
+		return "", err
+	}
 
 	checkoutLogger.InfoContext(ctx, "ChargeCard success", "transaction_id", res.TransactionID)
 	span.SetAttributes(attribute.String("payment.transaction.id", res.TransactionID))
 	return res.TransactionID, nil
 }
 
-func shipOrder(ctx context.Context, client *http.Client, itemCount int) (string, error) {
+func shipOrder(ctx context.Context, client *http.Client, itemCount int, amount float64, currency string) (string, error) {
 	ctx, span := checkoutTracer.Start(ctx, "shipOrder", trace.WithSpanKind(trace.SpanKindInternal))
 	defer span.End()
 
@@ -394,8 +881,16 @@ func shipOrder(ctx context.Context, client *http.Client, itemCount int) (string,
 		attribute.Int("shipping.items.count", itemCount),
 	)
 
-	req, _ := http.NewRequestWithContext(ctx, "POST", config.ShippingURL+"/ship", nil)
-	resp, err := client.Do(req)
+	if featureEnabled(ctx, "feature.fail_shipping") {
+		err := fmt.Errorf("shipping failed: forced by feature.fail_shipping")
+		span.SetAttributes(attribute.Bool("app.feature.fail_shipping", true))
+		common.RecordSpanError(span, err)
+		checkoutLogger.ErrorContext(ctx, "ShipOrder failed", "error", err)
+		return "", err
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/ship?currency=%s&amount=%.2f", config.ShippingURL, currency, amount), nil)
+	resp, err := common.DoWithRetry(client, req)
 	if err != nil {
 		checkoutLogger.ErrorContext(ctx, "ShipOrder failed", "error", err)
 		return "", err
@@ -412,7 +907,12 @@ func shipOrder(ctx context.Context, client *http.Client, itemCount int) (string,
 	var res struct {
 		TrackingID string `json:"tracking_id"`
 	}
-	json.Unmarshal(body, &res)
+	if err := json.Unmarshal(body, &res); err != nil {
+		err = fmt.Errorf("invalid shipping response: %w", err)
+		common.RecordSpanError(span, err)
+		checkoutLogger.ErrorContext(ctx, "ShipOrder failed", "error", err)
+		return "", err
+	}
 
 	checkoutLogger.InfoContext(ctx, "ShipOrder success", "tracking_id", res.TrackingID)
 	span.SetAttributes(attribute.String("shipping.tracking.id", res.TrackingID))
@@ -428,11 +928,11 @@ func sendOrderConfirmation(ctx context.Context, client *http.Client, orderID, us
 	span.SetAttributes(
 		attribute.String("saga.step", "email"),
 		attribute.String("app.order.id", orderID),
-		attribute.String("app.user.id", userID),
+		common.BoundedAttr("app.user.id", userID),
 	)
 
 	req, _ := http.NewRequestWithContext(ctx, "POST", config.EmailURL+"/send", nil)
-	resp, err := client.Do(req)
+	resp, err := common.DoWithRetry(client, req)
 	if err != nil {
 		checkoutLogger.ErrorContext(ctx, "SendOrderConfirmation failed", "error", err)
 		return err
@@ -449,38 +949,82 @@ func sendOrderConfirmation(ctx context.Context, client *http.Client, orderID, us
 	return nil
 }
 
-func publishToKafka(ctx context.Context, client *http.Client, orderID string) {
+func (c *checkoutService) publishToKafka(ctx context.Context, client *http.Client, order OrderMessage) {
+	orderID := order.OrderID
+	payload, _ := json.Marshal(order)
+
 	ctx, span := checkoutTracer.Start(ctx, "orders publish",
 		trace.WithSpanKind(trace.SpanKindProducer),
 		trace.WithAttributes(
 			attribute.String("messaging.system", "kafka"),
 			attribute.String("messaging.destination.name", "orders"),
 			attribute.String("messaging.operation.type", "publish"),
-			attribute.String("messaging.kafka.destination.partition", "0"),
 			attribute.String("app.order.id", orderID),
 		))
 	defer span.End()
 
 	checkoutLogger.InfoContext(ctx, "PublishToKafka", "order_id", orderID, "topic", "orders")
+	// Only messages the topic accepted count as published
+	published := func() {
+		messagesPublished.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("messaging.destination.name", "orders"),
+		))
+	}
 
-	time.Sleep(time.Duration(rand.Intn(10)+5) * time.Millisecond)
-
-	req, _ := http.NewRequestWithContext(ctx, "POST", config.AccountingURL+"/consume", nil)
-	if resp, err := client.Do(req); err == nil {
-		resp.Body.Close()
+	if kafkaWriter != nil {
+		msg := kafka.Message{
+			Key:   []byte(orderID),
+			Value: payload,
+		}
+		otel.GetTextMapPropagator().Inject(ctx, kafkaHeaderCarrier{&msg.Headers})
+		if err := kafkaWriter.WriteMessages(ctx, msg); err != nil {
+			common.RecordSpanError(span, err)
+			checkoutLogger.ErrorContext(ctx, "PublishToKafka failed", "order_id", orderID, "error", err)
+			return
+		}
+		published()
+		return
 	}
 
-	req, _ = http.NewRequestWithContext(ctx, "POST", config.FraudDetectionURL+"/consume", nil)
-	if resp, err := client.Do(req); err == nil {
-		resp.Body.Close()
+	// No brokers configured - mock the topic by posting to each consumer
+	partition := orderPartition(orderID)
+	span.SetAttributes(attribute.Int("messaging.kafka.destination.partition", partition))
+	time.Sleep(time.Duration(c.rng.Intn(10)+5) * time.Millisecond)
+
+	retryCount := 0
+	delivered := true
+	for _, url := range []string{config.AccountingURL + "/consume", config.FraudDetectionURL + "/consume"} {
+		retries, err := deliverMockMessage(ctx, client, url, payload, partition)
+		retryCount += retries
+		if err != nil {
+			delivered = false
+			common.RecordSpanError(span, err)
+			checkoutLogger.ErrorContext(ctx, "PublishToKafka delivery failed", "order_id", orderID, "url", url, "retries", retries, "error", err)
+		}
+	}
+	span.SetAttributes(attribute.Int("messaging.retry_count", retryCount))
+	if delivered {
+		published()
 	}
 }
 
-func randomCurrency() string {
-	currencies := []string{"USD", "EUR", "GBP", "JPY", "CAD"}
-	return currencies[rand.Intn(len(currencies))]
+// featureEnabled reports whether a baggage feature flag is set to "true"
+func featureEnabled(ctx context.Context, name string) bool {
+	return baggage.FromContext(ctx).Member(name).Value() == "true"
 }
 
+// checkoutCurrencies are the currencies checkout places orders in: everything
+// the currency service can convert
+var checkoutCurrencies = supportedCurrencies()
+
+func (c *checkoutService) randomCurrency() string {
+	return checkoutCurrencies[c.rng.Intn(len(checkoutCurrencies))]
+}
+
+// getProductDetails fetches each product from the catalog and records its
+// unit price on the span. The order total itself comes from the cart's
+// quantities in prepareOrderItems (app.order.subtotal), so no total is
+// derived here.
 func getProductDetails(ctx context.Context, client *http.Client, productIDs []string) {
 	ctx, span := checkoutTracer.Start(ctx, "getProductDetails",
 		trace.WithSpanKind(trace.SpanKindClient))
@@ -494,15 +1038,57 @@ func getProductDetails(ctx context.Context, client *http.Client, productIDs []st
 	)
 
 	for _, productID := range productIDs {
-		checkoutLogger.InfoContext(ctx, "FetchProduct", "product_id", productID)
-		url := fmt.Sprintf("%s/products/%s", config.ProductCatalogURL, productID)
-		req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
-		resp, err := client.Do(req)
+		price, err := fetchProductPrice(ctx, client, productID)
 		if err != nil {
 			checkoutLogger.WarnContext(ctx, "FetchProduct failed", "product_id", productID, "error", err)
 			continue
 		}
-		resp.Body.Close()
+		span.AddEvent("product_priced", trace.WithAttributes(
+			attribute.String("app.product.id", productID),
+			attribute.Float64("app.product.price", price),
+		))
+	}
+
+	if depth := min(config.TraceDepth, maxTraceDepth); depth > 0 {
+		traceLevel(ctx, 1, depth)
+	}
+}
+
+// fetchProductPrice looks up a product's price in the catalog
+func fetchProductPrice(ctx context.Context, client *http.Client, productID string) (float64, error) {
+	checkoutLogger.InfoContext(ctx, "FetchProduct", "product_id", productID)
+	url := fmt.Sprintf("%s/products/%s", config.ProductCatalogURL, productID)
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("product catalog returned %d", resp.StatusCode)
+	}
+	var product struct {
+		Price float64 `json:"price"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&product); err != nil {
+		return 0, fmt.Errorf("invalid product response: %w", err)
+	}
+	return product.Price, nil
+}
+
+// maxTraceDepth caps TRACE_DEPTH so a typo can't produce an unbounded chain
+const maxTraceDepth = 32
+
+// traceLevel starts a level-N span and recurses inside it until depth, giving
+// a controllable chain of nested spans
+func traceLevel(ctx context.Context, level, depth int) {
+	ctx, span := checkoutTracer.Start(ctx, fmt.Sprintf("level-%d", level))
+	defer span.End()
+
+	span.SetAttributes(attribute.Int("app.trace.level", level))
+	if level < depth {
+		traceLevel(ctx, level+1, depth)
 	}
 }
 
@@ -511,15 +1097,15 @@ func getCurrencyConversion(ctx context.Context, client *http.Client, currency st
 		trace.WithSpanKind(trace.SpanKindClient))
 	defer span.End()
 
-	checkoutLogger.InfoContext(ctx, "GetCurrencyConversion", "from", "USD", "to", currency, "amount", amount)
+	checkoutLogger.InfoContext(ctx, "GetCurrencyConversion", "from", config.BaseCurrency, "to", currency, "amount", amount)
 
 	span.SetAttributes(
-		attribute.String("app.currency.from", "USD"),
+		attribute.String("app.currency.from", config.BaseCurrency),
 		attribute.String("app.currency.to", currency),
 		attribute.Float64("app.currency.amount", amount),
 	)
 
-	url := fmt.Sprintf("%s/convert?from=USD&to=%s&amount=%.2f", config.CurrencyURL, currency, amount)
+	url := fmt.Sprintf("%s/convert?from=%s&to=%s&amount=%.2f", config.CurrencyURL, config.BaseCurrency, currency, amount)
 	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
 	resp, err := client.Do(req)
 	if err != nil {
@@ -527,6 +1113,12 @@ func getCurrencyConversion(ctx context.Context, client *http.Client, currency st
 		return
 	}
 	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("currency service returned %d", resp.StatusCode)
+		common.RecordSpanError(span, err)
+		checkoutLogger.WarnContext(ctx, "GetCurrencyConversion failed", "currency", currency, "error", err)
+	}
 }
 
 func getRecommendations(ctx context.Context, client *http.Client, userID string, productIDs []string) {
@@ -537,11 +1129,11 @@ func getRecommendations(ctx context.Context, client *http.Client, userID string,
 	checkoutLogger.InfoContext(ctx, "GetRecommendations", "user_id", userID)
 
 	span.SetAttributes(
-		attribute.String("app.user.id", userID),
+		common.BoundedAttr("app.user.id", userID),
 		attribute.StringSlice("app.product.ids", productIDs),
 	)
 
-	url := fmt.Sprintf("%s/recommendations?user_id=%s", config.RecommendationURL, userID)
+	url := fmt.Sprintf("%s/recommendations?user_id=%s&productIds=%s", config.RecommendationURL, userID, strings.Join(productIDs, ","))
 	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
 	resp, err := client.Do(req)
 	if err != nil {
@@ -551,13 +1143,13 @@ func getRecommendations(ctx context.Context, client *http.Client, userID string,
 	resp.Body.Close()
 }
 
-func getAds(ctx context.Context, client *http.Client) {
+func (c *checkoutService) getAds(ctx context.Context, client *http.Client) {
 	ctx, span := checkoutTracer.Start(ctx, "getAds",
 		trace.WithSpanKind(trace.SpanKindClient))
 	defer span.End()
 
 	categories := []string{"clothing", "electronics", "home", "outdoor"}
-	category := categories[rand.Intn(len(categories))]
+	category := categories[c.rng.Intn(len(categories))]
 	checkoutLogger.InfoContext(ctx, "GetAds", "category", category)
 
 	span.SetAttributes(attribute.String("app.ads.category", category))
@@ -0,0 +1,853 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"otel-mock/config"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/codes"
+	otelprom "go.opentelemetry.io/otel/exporters/prometheus"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestCheckoutInstancesHaveIndependentRNGs(t *testing.T) {
+	server := &checkoutService{rng: NewRNG(1)}
+	batch := &checkoutService{rng: NewRNG(1)}
+
+	// Drawing from one instance must not move the other's sequence
+	for i := 0; i < 5; i++ {
+		server.randomCurrency()
+	}
+	fresh := &checkoutService{rng: NewRNG(1)}
+	for i := 0; i < 20; i++ {
+		if got, want := batch.randomCurrency(), fresh.randomCurrency(); got != want {
+			t.Fatalf("draw %d: batch instance got %s, want %s from an untouched sequence", i, got, want)
+		}
+	}
+}
+
+func TestRandomCurrencyWithFixedRNG(t *testing.T) {
+	c := &checkoutService{rng: fixedRNG{n: 0}}
+	if got := c.randomCurrency(); got != checkoutCurrencies[0] {
+		t.Fatalf("randomCurrency() = %s, want %s", got, checkoutCurrencies[0])
+	}
+}
+
+// statusServer answers every request with code and is closed with the test
+func statusServer(t *testing.T, code int) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestStatusWithMixedDependencies(t *testing.T) {
+	sr := useTestCheckout(t)
+	up := statusServer(t, http.StatusOK)
+	notFound := statusServer(t, http.StatusNotFound)
+	unreachable := statusServer(t, http.StatusOK)
+	unreachable.Close()
+
+	for _, p := range []*string{&config.CartURL, &config.ShippingURL, &config.ProductCatalogURL, &config.CurrencyURL} {
+		setForTest(t, p, up.URL)
+	}
+	setForTest(t, &config.PaymentURL, notFound.URL)
+	setForTest(t, &config.EmailURL, unreachable.URL)
+
+	rec := httptest.NewRecorder()
+	dependencyStatusHandler(http.DefaultClient)(rec, httptest.NewRequest("GET", "/status", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status code = %d, want 503", rec.Code)
+	}
+	var got DependencyStatus
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := DependencyStatus{Status: "down", Dependencies: map[string]string{
+		"cart": "up", "shipping": "up", "product-catalog": "up", "currency": "up",
+		"payment": "down", "email": "down",
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("status = %+v, want %+v", got, want)
+	}
+	if n := len(sr.Ended()); n != 6 {
+		t.Fatalf("recorded %d probe spans, want 6", n)
+	}
+}
+
+func TestStatusAllUp(t *testing.T) {
+	useTestCheckout(t)
+	up := statusServer(t, http.StatusOK)
+	for _, p := range []*string{&config.CartURL, &config.ShippingURL, &config.ProductCatalogURL, &config.CurrencyURL, &config.PaymentURL, &config.EmailURL} {
+		setForTest(t, p, up.URL)
+	}
+
+	rec := httptest.NewRecorder()
+	dependencyStatusHandler(http.DefaultClient)(rec, httptest.NewRequest("GET", "/status", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status code = %d, want 200: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestWaitForHealthyReturnsOnceDependencyIsUp(t *testing.T) {
+	readyAt := time.Now().Add(300 * time.Millisecond)
+	delayed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if time.Now().Before(readyAt) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer delayed.Close()
+	up := statusServer(t, http.StatusOK)
+
+	start := time.Now()
+	if err := waitForHealthy(context.Background(), []string{up.URL, delayed.URL}, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("returned after %s, want shortly after the dependency came up at 300ms", elapsed)
+	}
+}
+
+func TestWaitForHealthyTimesOut(t *testing.T) {
+	down := statusServer(t, http.StatusNotFound)
+
+	err := waitForHealthy(context.Background(), []string{down.URL}, 300*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), down.URL) {
+		t.Fatalf("err = %v, want a timeout naming %s", err, down.URL)
+	}
+}
+
+func TestStartupDependenciesSkipNodeServices(t *testing.T) {
+	for _, url := range startupDependencies() {
+		if url == config.PaymentURL || url == config.EmailURL {
+			t.Fatalf("startup waits on Node service %s", url)
+		}
+	}
+}
+
+// catalogServer serves /products/{id} with the given prices and 404s the rest
+func catalogServer(t *testing.T, prices map[string]float64) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /products/{id}", func(w http.ResponseWriter, r *http.Request) {
+		price, ok := prices[r.PathValue("id")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"id": r.PathValue("id"), "price": price})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGetProductDetailsRecordsCatalogPrices(t *testing.T) {
+	sr := useTestCheckout(t)
+	setForTest(t, &config.TraceDepth, 0)
+	setForTest(t, &config.ProductCatalogURL, catalogServer(t, map[string]float64{"A": 19.99, "B": 5}).URL)
+
+	getProductDetails(context.Background(), http.DefaultClient, []string{"A", "B", "missing"})
+
+	got := map[string]float64{}
+	for _, ev := range sr.Ended()[0].Events() {
+		var id string
+		var price float64
+		for _, kv := range ev.Attributes {
+			switch kv.Key {
+			case "app.product.id":
+				id = kv.Value.AsString()
+			case "app.product.price":
+				price = kv.Value.AsFloat64()
+			}
+		}
+		got[id] = price
+	}
+	if want := map[string]float64{"A": 19.99, "B": 5}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("priced products = %v, want %v", got, want)
+	}
+}
+
+// cartServer stubs the cart service, always returning items from GET /cart
+func cartServer(t *testing.T, items []CartItem) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /cart/add/bulk", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("POST /cart/empty", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("GET /cart", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"items_count": len(items), "items": items})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPrepareOrderTotalsCartAtCatalogPrices(t *testing.T) {
+	useTestCheckout(t)
+	setForTest(t, &config.CartURL, cartServer(t, []CartItem{{ProductID: "A", Quantity: 2}, {ProductID: "B", Quantity: 3}}).URL)
+	setForTest(t, &config.ProductCatalogURL, catalogServer(t, map[string]float64{"A": 10, "B": 2.5}).URL)
+
+	c := &checkoutService{rng: fixedRNG{n: 0}}
+	prep, err := c.prepareOrderItems(context.Background(), http.DefaultClient, "u-1", "USD", []string{"A", "B"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2 x 10 + 3 x 2.50, plus fixedRNG's 1.00 shipping
+	if prep.total != 28.5 || prep.shippingCost != 1 {
+		t.Fatalf("total = %v with shipping %v, want 28.5 with shipping 1", prep.total, prep.shippingCost)
+	}
+}
+
+func TestPrepareOrderLogsEmptyCart(t *testing.T) {
+	useTestCheckout(t)
+	var logs bytes.Buffer
+	setForTest(t, &checkoutLogger, slog.New(slog.NewTextHandler(&logs, nil)))
+	setForTest(t, &config.CartURL, cartServer(t, nil).URL)
+	setForTest(t, &config.ProductCatalogURL, catalogServer(t, nil).URL)
+
+	c := &checkoutService{rng: fixedRNG{n: 0}}
+	if _, err := c.prepareOrderItems(context.Background(), http.DefaultClient, "u-1", "USD", []string{"A"}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "Cart is empty") || strings.Contains(logs.String(), "Failed to price cart") {
+		t.Fatalf("logs do not report an empty cart distinctly:\n%s", logs.String())
+	}
+}
+
+func TestBatchPlacesExactlyCount(t *testing.T) {
+	useTestCheckout(t)
+	counter := &chargeCounter{}
+	c := &checkoutService{rng: fixedRNG{}}
+
+	placed := c.runBatch(context.Background(), &http.Client{Transport: counter}, 5, 3, time.Second)
+
+	if placed != 5 || counter.charges.Load() != 5 {
+		t.Fatalf("placed %d orders with %d charges, want 5 of each", placed, counter.charges.Load())
+	}
+}
+
+func TestBatchStopsWhenCancelledMidOrder(t *testing.T) {
+	useTestCheckout(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The batch is interrupted while charging its second order
+	counter := &chargeCounter{}
+	counter.onCharge = func(*http.Request) {
+		if counter.charges.Load() == 2 {
+			cancel()
+		}
+	}
+	c := &checkoutService{rng: fixedRNG{}}
+
+	done := make(chan int64)
+	go func() { done <- c.runBatch(ctx, &http.Client{Transport: counter}, 100, 1, time.Second) }()
+
+	select {
+	case placed := <-done:
+		if placed != 1 {
+			t.Fatalf("placed = %d, want only the order completed before cancelling", placed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch still running after cancel")
+	}
+	if n := counter.charges.Load(); n != 2 {
+		t.Fatalf("%d orders charged, want no order started after cancel", n)
+	}
+}
+
+// scriptedChargeTransport declines the first /charge, accepts the second
+// and calls cancel during the third, answering everything else like a dry run
+type scriptedChargeTransport struct {
+	charges atomic.Int32
+	cancel  func()
+}
+
+func (s *scriptedChargeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path == "/charge" {
+		switch s.charges.Add(1) {
+		case 1:
+			return declineTransport{reason: "card_declined"}.RoundTrip(req)
+		case 3:
+			s.cancel()
+		}
+	}
+	return dryRunTransport{}.RoundTrip(req)
+}
+
+func TestBatchCountsOnlyPlacedOrdersWhenCancelled(t *testing.T) {
+	useTestCheckout(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	transport := &scriptedChargeTransport{cancel: cancel}
+	c := &checkoutService{rng: fixedRNG{}}
+
+	placed := c.runBatch(ctx, &http.Client{Transport: transport}, 100, 1, time.Second)
+
+	// Three orders started: one declined, one placed, one interrupted
+	if n := transport.charges.Load(); n != 3 {
+		t.Fatalf("%d orders charged, want 3 before the cancel", n)
+	}
+	if placed != 1 {
+		t.Fatalf("placed = %d, want only the order that succeeded", placed)
+	}
+}
+
+// hungTransport never answers /charge, holding each request until it is
+// cancelled, and answers every other call like a dry run
+type hungTransport struct{ charges atomic.Int32 }
+
+func (h *hungTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path != "/charge" {
+		return dryRunTransport{}.RoundTrip(req)
+	}
+	h.charges.Add(1)
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func TestBatchTimesOutHungOrders(t *testing.T) {
+	sr := useTestCheckout(t)
+	setForTest(t, &config.RetryBaseBackoff, time.Millisecond)
+	hung := &hungTransport{}
+	c := &checkoutService{rng: fixedRNG{}}
+
+	start := time.Now()
+	placed := c.runBatch(context.Background(), &http.Client{Transport: hung}, 3, 1, 50*time.Millisecond)
+
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("batch took %v, want each hung order cut off after 50ms", elapsed)
+	}
+	if placed != 0 {
+		t.Fatalf("placed = %d, want no timed out order counted", placed)
+	}
+	if n := hung.charges.Load(); n < 3 {
+		t.Fatalf("%d charges attempted, want the batch to move on to every order", n)
+	}
+	timeouts := 0
+	for _, s := range sr.Ended() {
+		for _, e := range s.Events() {
+			if e.Name == "order_timeout" {
+				timeouts++
+			}
+		}
+	}
+	if timeouts != 3 {
+		t.Fatalf("%d order_timeout events, want one per order", timeouts)
+	}
+}
+
+// declineTransport answers /charge with a 402 decline for reason and every
+// other call like a dry run
+type declineTransport struct{ reason string }
+
+func (d declineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path != "/charge" {
+		return dryRunTransport{}.RoundTrip(req)
+	}
+	return &http.Response{
+		StatusCode: http.StatusPaymentRequired,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"reason":"` + d.reason + `"}`)),
+		Request:    req,
+	}, nil
+}
+
+func TestPaymentDeclineReasons(t *testing.T) {
+	for _, reason := range []string{"insufficient_funds", "card_expired", "fraud_hold"} {
+		t.Run(reason, func(t *testing.T) {
+			sr := useTestCheckout(t)
+			var logs bytes.Buffer
+			setForTest(t, &checkoutLogger, slog.New(slog.NewJSONHandler(&logs, nil)))
+			c := &checkoutService{rng: fixedRNG{}}
+
+			rec := httptest.NewRecorder()
+			c.placeOrderHandler(&http.Client{Transport: declineTransport{reason}}).
+				ServeHTTP(rec, httptest.NewRequest("POST", "/checkout", strings.NewReader(`{}`)))
+
+			var result OrderResult
+			json.NewDecoder(rec.Body).Decode(&result)
+			if rec.Code != http.StatusPaymentRequired || result.DeclineReason != reason {
+				t.Fatalf("response = %d %+v, want 402 declined for %s", rec.Code, result, reason)
+			}
+			if got := spanAttr(t, sr, "PlaceOrder", "app.payment.decline.reason").AsString(); got != reason {
+				t.Fatalf("order span decline reason = %q, want %q", got, reason)
+			}
+			for _, s := range sr.Ended() {
+				for _, kv := range s.Attributes() {
+					if kv.Key == "app.payment.decline.reason" && s.Name() != "PlaceOrder" {
+						t.Fatalf("decline reason also set on the %s span", s.Name())
+					}
+				}
+			}
+			if n := strings.Count(logs.String(), `"level":"ERROR"`); n != 1 || !strings.Contains(logs.String(), `"decline_reason":"`+reason+`"`) {
+				t.Fatalf("decline logged at Error %d times, want once with its reason:\n%s", n, logs.String())
+			}
+		})
+	}
+}
+
+func TestPlacedOrderIsScrapedFromPrometheus(t *testing.T) {
+	useTestCheckout(t)
+	reg := prometheus.NewRegistry()
+	exporter, err := otelprom.New(otelprom.WithRegisterer(reg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(exporter))
+	t.Cleanup(func() { mp.Shutdown(context.Background()) })
+	initCheckoutMetrics(mp)
+	c := &checkoutService{rng: fixedRNG{}}
+
+	if _, err := c.placeOrder(context.Background(), &http.Client{Transport: dryRunTransport{}}, OrderRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `app_checkout_orders_total{`) {
+		t.Fatalf("/metrics has no app_checkout_orders_total after an order:\n%s", body)
+	}
+}
+
+// withFeatureFlag returns a context whose baggage turns the named flag on
+func withFeatureFlag(t *testing.T, name string) context.Context {
+	t.Helper()
+	m, err := baggage.NewMember(name, "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bag, _ := baggage.New(m)
+	return baggage.ContextWithBaggage(context.Background(), bag)
+}
+
+func TestFailShippingFlagFailsOrder(t *testing.T) {
+	sr := useTestCheckout(t)
+	c := &checkoutService{rng: fixedRNG{}}
+
+	result, err := c.placeOrder(withFeatureFlag(t, "feature.fail_shipping"), &http.Client{Transport: dryRunTransport{}}, OrderRequest{})
+	if err == nil || result.Status != "shipping_failed" {
+		t.Fatalf("order = %+v (err %v), want it failed at shipping", result, err)
+	}
+	if !spanAttr(t, sr, "PlaceOrder", "app.feature.fail_shipping").AsBool() {
+		t.Fatal("order span is not tagged app.feature.fail_shipping")
+	}
+	if _, err := c.placeOrder(context.Background(), &http.Client{Transport: dryRunTransport{}}, OrderRequest{}); err != nil {
+		t.Fatalf("order without the flag failed: %v", err)
+	}
+}
+
+func TestSlowPaymentFlagDelaysCharge(t *testing.T) {
+	sr := useTestCheckout(t)
+	counter := &chargeCounter{}
+	c := &checkoutService{rng: fixedRNG{}}
+
+	// fixedRNG picks the minimum 1.5s delay, far past this deadline
+	ctx, cancel := context.WithTimeout(withFeatureFlag(t, "feature.slow_payment"), 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.chargeCard(ctx, &http.Client{Transport: counter}, 10, "USD"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want the charge still delayed at the deadline", err)
+	}
+	if n := counter.charges.Load(); n != 0 {
+		t.Fatalf("payment charged %d times during the injected delay", n)
+	}
+	events := sr.Ended()[0].Events()
+	if len(events) != 1 || events[0].Name != "slow_payment_injected" {
+		t.Fatalf("chargeCard events = %+v, want slow_payment_injected", events)
+	}
+
+	if _, err := c.chargeCard(context.Background(), &http.Client{Transport: counter}, 10, "USD"); err != nil || counter.charges.Load() != 1 {
+		t.Fatalf("charge without the flag: err %v after %d charges, want one immediate charge", err, counter.charges.Load())
+	}
+}
+
+// postCheckout serves one /checkout request with body through a dry-run client
+func postCheckout(t *testing.T, c *checkoutService, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c.placeOrderHandler(&http.Client{Transport: dryRunTransport{}}).
+		ServeHTTP(rec, httptest.NewRequest("POST", "/checkout", strings.NewReader(body)))
+	return rec
+}
+
+func TestCheckoutBodyDrivesOrder(t *testing.T) {
+	sr := useTestCheckout(t)
+	c := &checkoutService{rng: fixedRNG{}}
+
+	rec := postCheckout(t, c, `{"user_id":"user-42","currency":"EUR"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/checkout returned %d: %s", rec.Code, rec.Body)
+	}
+	if got := spanAttr(t, sr, "PlaceOrder", "app.user.id").AsString(); got != "user-42" {
+		t.Fatalf("app.user.id = %q, want the posted user-42", got)
+	}
+	if got := spanAttr(t, sr, "PlaceOrder", "app.user.currency").AsString(); got != "EUR" {
+		t.Fatalf("app.user.currency = %q, want the posted EUR", got)
+	}
+}
+
+func TestCheckoutRejectsUnknownCurrency(t *testing.T) {
+	sr := useTestCheckout(t)
+	c := &checkoutService{rng: fixedRNG{}}
+
+	if rec := postCheckout(t, c, `{"currency":"XYZ"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("/checkout with currency XYZ returned %d, want 400", rec.Code)
+	}
+	if n := len(sr.Ended()); n != 0 {
+		t.Fatalf("rejected request still placed an order (%d spans)", n)
+	}
+}
+
+func TestCheckoutReturnsOrderResult(t *testing.T) {
+	useTestCheckout(t)
+	c := &checkoutService{rng: fixedRNG{}}
+
+	rec := postCheckout(t, c, "")
+	var result map[string]any
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || result["status"] != "order_placed" {
+		t.Fatalf("/checkout = %d %v, want a placed order", rec.Code, result)
+	}
+	if id, _ := result["order_id"].(string); uuid.Validate(id) != nil {
+		t.Fatalf("order_id = %v, want a UUID", result["order_id"])
+	}
+	if amount, ok := result["amount"].(float64); !ok || amount <= 0 {
+		t.Fatalf("amount = %v, want a positive number", result["amount"])
+	}
+	if tx, _ := result["transaction_id"].(string); tx == "" {
+		t.Fatalf("transaction_id missing from %v", result)
+	}
+}
+
+// downstreamsFailing points every checkout downstream at one stub answering
+// like a dry run, except failPath which returns 500
+func downstreamsFailing(t *testing.T, failPath string) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == failPath {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dryRunResponse(r))
+	}))
+	t.Cleanup(srv.Close)
+	for _, p := range []*string{
+		&config.CartURL, &config.ShippingURL, &config.ProductCatalogURL, &config.CurrencyURL,
+		&config.PaymentURL, &config.EmailURL, &config.RecommendationURL, &config.AdURL,
+		&config.AccountingURL, &config.FraudDetectionURL,
+	} {
+		setForTest(t, p, srv.URL)
+	}
+}
+
+func TestCheckoutDownstreamFailureStatus(t *testing.T) {
+	setForTest(t, &config.RetryBaseBackoff, time.Millisecond)
+	for _, tt := range []struct {
+		failPath   string
+		wantStatus string
+	}{
+		{"/charge", "payment_failed"},
+		{"/ship", "shipping_failed"},
+	} {
+		t.Run(tt.failPath, func(t *testing.T) {
+			useTestCheckout(t)
+			tp, sr := newTestTracerProvider(t)
+			downstreamsFailing(t, tt.failPath)
+			c := &checkoutService{rng: fixedRNG{}}
+
+			rec := httptest.NewRecorder()
+			c.newMux(http.DefaultClient, tp).ServeHTTP(rec, httptest.NewRequest("POST", "/checkout", nil))
+
+			var result OrderResult
+			json.NewDecoder(rec.Body).Decode(&result)
+			if rec.Code != http.StatusBadGateway || result.Status != tt.wantStatus {
+				t.Fatalf("/checkout = %d %q, want 502 %s", rec.Code, result.Status, tt.wantStatus)
+			}
+			spans := sr.Ended()
+			if server := spans[len(spans)-1]; server.Name() != "PlaceOrder" || server.Status().Code != codes.Error {
+				t.Fatalf("server span %s status = %v, want PlaceOrder with Error", server.Name(), server.Status().Code)
+			}
+		})
+	}
+}
+
+func TestCheckoutRecordsSessionBaggage(t *testing.T) {
+	useTestCheckout(t)
+	usePropagators(t)
+	tp, sr := newTestTracerProvider(t)
+	c := &checkoutService{rng: fixedRNG{}}
+
+	// As forwarded by the frontend
+	req := httptest.NewRequest("POST", "/checkout", strings.NewReader(`{}`))
+	req.Header.Set("baggage", "session.id=3f2b9c1e-session")
+	rec := httptest.NewRecorder()
+	c.newMux(&http.Client{Transport: dryRunTransport{}}, tp).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/checkout returned %d: %s", rec.Code, rec.Body)
+	}
+	if v := spanAttr(t, sr, "PlaceOrder", "session.id"); v.AsString() != "3f2b9c1e-session" {
+		t.Fatalf("session.id = %q, want the baggage member's value", v.AsString())
+	}
+}
+
+// slowLookupTransport delays the catalog, currency, recommendation and ad
+// lookups by delay and answers every call like a dry run
+type slowLookupTransport struct{ delay time.Duration }
+
+func (s slowLookupTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch path := req.URL.Path; {
+	case strings.HasPrefix(path, "/products/"), path == "/convert", path == "/recommendations", path == "/ads":
+		time.Sleep(s.delay)
+	}
+	return dryRunTransport{}.RoundTrip(req)
+}
+
+func TestOrderLookupsRunConcurrently(t *testing.T) {
+	sr := useTestCheckout(t)
+	c := &checkoutService{rng: fixedRNG{}}
+
+	if _, err := c.placeOrder(context.Background(), &http.Client{Transport: slowLookupTransport{delay: 50 * time.Millisecond}}, OrderRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	lookups := map[string]bool{"getProductDetails": true, "getCurrencyConversion": true, "getRecommendations": true, "getAds": true}
+	var order sdktrace.ReadOnlySpan
+	var found []sdktrace.ReadOnlySpan
+	for _, s := range sr.Ended() {
+		if s.Name() == "PlaceOrder" {
+			order = s
+		}
+		if lookups[s.Name()] {
+			found = append(found, s)
+		}
+	}
+	if order == nil || len(found) != len(lookups) {
+		t.Fatalf("got PlaceOrder %v and %d lookup spans, want all 4", order != nil, len(found))
+	}
+
+	var serial time.Duration
+	first, last := found[0].StartTime(), found[0].EndTime()
+	for _, s := range found {
+		if s.Parent().SpanID() != order.SpanContext().SpanID() {
+			t.Errorf("%s is not a child of PlaceOrder", s.Name())
+		}
+		serial += s.EndTime().Sub(s.StartTime())
+		if s.StartTime().Before(first) {
+			first = s.StartTime()
+		}
+		if s.EndTime().After(last) {
+			last = s.EndTime()
+		}
+	}
+	if wall := last.Sub(first); wall >= serial {
+		t.Fatalf("lookups took %v end to end, want less than their %v serial sum", wall, serial)
+	}
+}
+
+func TestTraceDepthNestsLevelSpans(t *testing.T) {
+	tests := []struct {
+		depth, wantLevels int
+	}{
+		{depth: 0, wantLevels: 0},
+		{depth: 5, wantLevels: 5},
+		{depth: 1000, wantLevels: maxTraceDepth},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.depth), func(t *testing.T) {
+			sr := useTestCheckout(t)
+			setForTest(t, &config.TraceDepth, tt.depth)
+
+			getProductDetails(context.Background(), &http.Client{Transport: dryRunTransport{}}, []string{"OLJCESPC7Z"})
+
+			byID := map[trace.SpanID]sdktrace.ReadOnlySpan{}
+			levels := 0
+			for _, s := range sr.Ended() {
+				byID[s.SpanContext().SpanID()] = s
+				if strings.HasPrefix(s.Name(), "level-") {
+					levels++
+				}
+			}
+			if levels != tt.wantLevels {
+				t.Fatalf("got %d level spans, want %d", levels, tt.wantLevels)
+			}
+			// Each level-N is a child of level-(N-1), the first of getProductDetails
+			for _, s := range byID {
+				if !strings.HasPrefix(s.Name(), "level-") {
+					continue
+				}
+				n, _ := strconv.Atoi(strings.TrimPrefix(s.Name(), "level-"))
+				want := "getProductDetails"
+				if n > 1 {
+					want = fmt.Sprintf("level-%d", n-1)
+				}
+				if parent := byID[s.Parent().SpanID()]; parent == nil || parent.Name() != want {
+					t.Fatalf("%s is not a child of %s", s.Name(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckoutCurrenciesAreConvertible(t *testing.T) {
+	useTestCurrency(t)
+	c := &checkoutService{rng: NewRNG(1)}
+
+	picked := map[string]bool{}
+	for range 500 {
+		picked[c.randomCurrency()] = true
+	}
+	if len(picked) != len(exchangeRates) {
+		t.Fatalf("checkout picked %d currencies in 500 orders, want all %d the currency service has", len(picked), len(exchangeRates))
+	}
+	for currency := range picked {
+		// Unknown currencies would convert at the base rate, so check the
+		// service actually has a rate for it
+		if _, ok := exchangeRates[currency]; !ok {
+			t.Errorf("checkout picked %s, which the currency service has no rate for", currency)
+		}
+		if res := convertQuery(t, "from=USD&to="+currency+"&amount=10"); res.To != currency || res.ConvertedAmount == nil {
+			t.Errorf("converting 10 USD to %s gave %+v", currency, res)
+		}
+	}
+}
+
+// gatedTransport holds every /charge until release is closed, reporting each
+// arrival on charged, and answers every other call like a dry run
+type gatedTransport struct {
+	charged chan struct{}
+	release chan struct{}
+}
+
+func (g gatedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path == "/charge" {
+		g.charged <- struct{}{}
+		<-g.release
+	}
+	return dryRunTransport{}.RoundTrip(req)
+}
+
+func TestInFlightOrdersRiseAndFall(t *testing.T) {
+	useTestCheckout(t)
+	mp, reader := newTestMeterProvider(t)
+	initCheckoutMetrics(mp)
+	gate := gatedTransport{charged: make(chan struct{}), release: make(chan struct{})}
+	client := &http.Client{Transport: gate}
+	c := &checkoutService{rng: fixedRNG{}}
+
+	const orders = 3
+	var wg sync.WaitGroup
+	for range orders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.placeOrder(context.Background(), client, OrderRequest{})
+		}()
+	}
+	for range orders {
+		<-gate.charged
+	}
+	if got := counterValue(t, reader, "app.checkout.in_flight"); got != orders {
+		t.Fatalf("in_flight = %d with %d orders waiting on payment, want %d", got, orders, orders)
+	}
+
+	close(gate.release)
+	wg.Wait()
+	if got := counterValue(t, reader, "app.checkout.in_flight"); got != 0 {
+		t.Fatalf("in_flight = %d after every order finished, want 0", got)
+	}
+}
+
+// malformedTransport answers path with a body that isn't JSON and every other
+// call like a dry run
+type malformedTransport struct{ path string }
+
+func (m malformedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path != m.path {
+		return dryRunTransport{}.RoundTrip(req)
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"transaction_id": `)),
+		Request:    req,
+	}, nil
+}
+
+func TestMalformedDownstreamResponseIsRecorded(t *testing.T) {
+	tests := []struct {
+		path, wantErr, wantSpan string
+		// An unreadable cart is tolerated: the order goes on at a made-up
+		// subtotal, with the error left on the prepare span
+		orderFails bool
+	}{
+		{path: "/cart", wantErr: "invalid cart response", wantSpan: "prepareOrderItemsAndShippingQuoteFromCart"},
+		{path: "/charge", wantErr: "invalid payment response", wantSpan: "chargeCard", orderFails: true},
+		{path: "/ship", wantErr: "invalid shipping response", wantSpan: "shipOrder", orderFails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			sr := useTestCheckout(t)
+			c := &checkoutService{rng: fixedRNG{}}
+
+			_, err := c.placeOrder(context.Background(), &http.Client{Transport: malformedTransport{tt.path}}, OrderRequest{})
+			if tt.orderFails && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("placeOrder error = %v, want %q", err, tt.wantErr)
+			}
+			if !tt.orderFails && err != nil {
+				t.Fatalf("placeOrder error = %v, want the order to go on", err)
+			}
+			for _, s := range sr.Ended() {
+				if s.Name() != tt.wantSpan {
+					continue
+				}
+				if s.Status().Code != codes.Error || !strings.Contains(s.Status().Description, tt.wantErr) {
+					t.Fatalf("%s status = %v %q, want the decode error recorded", s.Name(), s.Status().Code, s.Status().Description)
+				}
+				return
+			}
+			t.Fatalf("no %s span recorded", tt.wantSpan)
+		})
+	}
+}
+
+func TestGetCartReturnsDecodeError(t *testing.T) {
+	useTestCheckout(t)
+
+	items, err := getCart(context.Background(), &http.Client{Transport: malformedTransport{"/cart"}}, "u-1")
+	if err == nil || !strings.Contains(err.Error(), "invalid cart response") || items != nil {
+		t.Fatalf("getCart = %v, %v; want no items and the decode error", items, err)
+	}
+}
@@ -0,0 +1,18 @@
+package services
+
+import "time"
+
+// Clock is the time source behind recorded durations. Services default to
+// SystemClock; tests can swap in a fake one to assert exact latencies.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+}
+
+// SystemClock is the wall clock
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                  { return time.Now() }
+func (systemClock) Since(t time.Time) time.Duration { return time.Since(t) }
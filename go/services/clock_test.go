@@ -0,0 +1,71 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"otel-mock/config"
+)
+
+func TestCheckoutLatencyUsesClock(t *testing.T) {
+	sr := useTestCheckout(t)
+	mp, reader := newTestMeterProvider(t)
+	initCheckoutMetrics(mp)
+	clock := newManualClock()
+	setForTest(t, &checkoutClock, Clock(clock))
+	// Only the card charge takes any (fake) time
+	counter := &chargeCounter{onCharge: func(*http.Request) { clock.Advance(1500 * time.Millisecond) }}
+	c := &checkoutService{rng: fixedRNG{}}
+
+	if _, err := c.placeOrder(context.Background(), &http.Client{Transport: counter}, OrderRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if sum, count := histogramTotal(t, reader, "app.checkout.latency"); sum != 1500 || count != 1 {
+		t.Fatalf("app.checkout.latency = %v over %d orders, want exactly 1500", sum, count)
+	}
+	for _, s := range sr.Ended() {
+		if s.Name() != "PlaceOrder" {
+			continue
+		}
+		for _, e := range s.Events() {
+			for _, kv := range e.Attributes {
+				if kv.Key != "app.step.duration_ms" {
+					continue
+				}
+				want := int64(0)
+				if e.Name == "charged" {
+					want = 1500
+				}
+				if kv.Value.AsInt64() != want {
+					t.Errorf("%s step took %dms, want %d", e.Name, kv.Value.AsInt64(), want)
+				}
+			}
+		}
+	}
+}
+
+func TestShippingQuoteDurationUsesClock(t *testing.T) {
+	useTestShipping(t, fixedRNG{})
+	mp, reader := newTestMeterProvider(t)
+	initShippingMetrics(mp)
+	clock := newManualClock()
+	setForTest(t, &shippingClock, Clock(clock))
+	quote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clock.Advance(250 * time.Millisecond)
+		w.Write([]byte(`{"cost_usd": 10}`))
+	}))
+	defer quote.Close()
+	setForTest(t, &config.QuoteURL, quote.URL)
+
+	if _, _, err := createQuoteFromCount(context.Background(), 2, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if sum, count := histogramTotal(t, reader, "app.shipping.quote.duration"); sum != 250 || count != 1 {
+		t.Fatalf("app.shipping.quote.duration = %v over %d quotes, want exactly 250", sum, count)
+	}
+}
@@ -1,13 +1,22 @@
 package services
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"log"
 	"log/slog"
+	"maps"
+	"math"
 	"net/http"
+	"otel-mock/common"
+	"otel-mock/config"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"go.opentelemetry.io/contrib/bridges/otelslog"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
-	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	otellog "go.opentelemetry.io/otel/log"
 	"go.opentelemetry.io/otel/metric"
@@ -18,9 +27,14 @@ var (
 	currencyLogger  *slog.Logger
 	currencyMeter   metric.Meter
 	currencyCounter metric.Int64Counter
+	currencyRand    RNG
+
+	// currencyRates caches /convert rates; nil when CURRENCY_CACHE_SIZE is 0
+	currencyRates *rateCache
 )
 
-// Exchange rates from USD
+// Exchange rates from USD; rebaseExchangeRates re-anchors them at
+// BASE_CURRENCY on startup
 var exchangeRates = map[string]float64{
 	"USD": 1.0,
 	"EUR": 0.85,
@@ -30,10 +44,99 @@ var exchangeRates = map[string]float64{
 	"CHF": 0.92,
 	"AUD": 1.35,
 	"INR": 83.0,
+	"BHD": 0.376,
 }
 
-func initCurrencyMetrics() {
-	currencyMeter = otel.Meter("currency")
+// With CURRENCY_FUZZ, each rate drifts by up to rateDriftStep per lookup but
+// never more than maxRateDrift from its exchangeRates anchor
+const (
+	maxRateDrift  = 0.01
+	rateDriftStep = 0.002
+)
+
+var (
+	rateDriftMu sync.Mutex
+	rateDrift   = map[string]float64{}
+)
+
+// currentRate returns the base-currency rate for code, fuzzed when
+// CURRENCY_FUZZ is set. The base currency itself stays at 1.
+func currentRate(code string) (float64, bool) {
+	base, ok := exchangeRates[code]
+	if !ok || !config.CurrencyFuzz || code == config.BaseCurrency {
+		return base, ok
+	}
+
+	rateDriftMu.Lock()
+	defer rateDriftMu.Unlock()
+	drift := rateDrift[code] + (currencyRand.Float64()*2-1)*rateDriftStep
+	drift = max(-maxRateDrift, min(maxRateDrift, drift))
+	rateDrift[code] = drift
+	return base * (1 + drift), true
+}
+
+// rebaseExchangeRates divides every rate by base's so base becomes 1.0 and
+// the rates between any two currencies are unchanged
+func rebaseExchangeRates(base string) error {
+	baseRate, ok := exchangeRates[base]
+	if !ok {
+		return fmt.Errorf("unsupported base currency %q (supported: %s)", base, strings.Join(supportedCurrencies(), ", "))
+	}
+	for code, rate := range exchangeRates {
+		exchangeRates[code] = rate / baseRate
+	}
+	return nil
+}
+
+// supportedCurrencies returns the codes in exchangeRates, sorted so seeded
+// random picks are reproducible
+func supportedCurrencies() []string {
+	return slices.Sorted(maps.Keys(exchangeRates))
+}
+
+// currencyDecimals returns the ISO 4217 minor units for code: JPY has none,
+// BHD has three, everything else here has two
+func currencyDecimals(code string) int {
+	switch code {
+	case "JPY":
+		return 0
+	case "BHD":
+		return 3
+	default:
+		return 2
+	}
+}
+
+// roundToMinorUnits rounds amount to the decimal places used by currency
+func roundToMinorUnits(amount float64, currency string) float64 {
+	scale := math.Pow10(currencyDecimals(currency))
+	return math.Round(amount*scale) / scale
+}
+
+// currencyLatency is extra time convertHandler takes per target currency, as
+// if those rates came from a distant datacenter. Empty by default;
+// CURRENCY_LATENCY adds or overrides entries.
+var currencyLatency = map[string]time.Duration{}
+
+// applyCurrencyLatency merges CURRENCY_LATENCY (e.g. "JPY=200ms,INR=50ms")
+// into currencyLatency
+func applyCurrencyLatency() {
+	if config.CurrencyLatency == "" {
+		return
+	}
+	for _, entry := range strings.Split(config.CurrencyLatency, ",") {
+		code, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		delay, err := time.ParseDuration(value)
+		if !ok || err != nil || delay < 0 {
+			log.Printf("Ignoring invalid currency latency %q", entry)
+			continue
+		}
+		currencyLatency[strings.ToUpper(code)] = delay
+	}
+}
+
+func initCurrencyMetrics(mp metric.MeterProvider) {
+	currencyMeter = mp.Meter("currency")
 	var err error
 
 	currencyCounter, err = currencyMeter.Int64Counter("app.currency_counter",
@@ -42,33 +145,69 @@ func initCurrencyMetrics() {
 	if err != nil {
 		panic(err)
 	}
+
+	if currencyRates != nil {
+		_, err = currencyMeter.Float64ObservableGauge("app.currency.cache.hit_ratio",
+			metric.WithDescription("Fraction of /convert rate lookups served from cache"),
+			metric.WithUnit("1"),
+			metric.WithFloat64Callback(func(_ context.Context, o metric.Float64Observer) error {
+				o.Observe(currencyRates.hitRatio())
+				return nil
+			}))
+		if err != nil {
+			panic(err)
+		}
+	}
 }
 
-func RunCurrencyService(tp trace.TracerProvider, lp otellog.LoggerProvider) {
-	currencyLogger = otelslog.NewLogger("currency", otelslog.WithLoggerProvider(lp))
-	initCurrencyMetrics()
+func RunCurrencyService(rng RNG, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) {
+	currencyRand = rng
+	currencyLogger = common.NewLogger("currency", lp)
+	logEffectiveConfig(currencyLogger)
+	if err := rebaseExchangeRates(config.BaseCurrency); err != nil {
+		log.Fatalf("Invalid BASE_CURRENCY: %v", err)
+	}
+	if config.CurrencyCacheSize > 0 {
+		currencyRates = newRateCache(config.CurrencyCacheSize, config.CurrencyCacheTTL)
+	}
+	initCurrencyMetrics(mp)
+	applyCurrencyLatency()
+
+	mux := newCurrencyMux(tp)
+
+	port := ":8089"
+	currencyLogger.Info("Currency Service starting", "port", port)
+	if err := common.ListenAndServe(common.NewServer(port, mux)); err != nil {
+		currencyLogger.Error("Currency Service failed", "error", err)
+	}
+}
 
-	convertHandler := otelhttp.NewHandler(
+// newCurrencyMux routes the currency endpoints, each in its own server span
+func newCurrencyMux(tp trace.TracerProvider) *http.ServeMux {
+	convertHandler := common.NewHandler(
 		http.HandlerFunc(convertHandler),
 		"Convert",
-		otelhttp.WithTracerProvider(tp),
+		tp,
 	)
 
-	supportedHandler := otelhttp.NewHandler(
+	supportedHandler := common.NewHandler(
 		http.HandlerFunc(getSupportedCurrenciesHandler),
 		"GetSupportedCurrencies",
-		otelhttp.WithTracerProvider(tp),
+		tp,
+	)
+
+	batchConvertHandler := common.NewHandler(
+		http.HandlerFunc(batchConvertHandler),
+		"BatchConvert",
+		tp,
 	)
 
 	mux := http.NewServeMux()
 	mux.Handle("/convert", convertHandler)
+	mux.Handle("POST /convert/batch", batchConvertHandler)
 	mux.Handle("/currencies", supportedHandler)
-
-	port := ":8089"
-	currencyLogger.Info("Currency Service starting", "port", port)
-	if err := http.ListenAndServe(port, mux); err != nil {
-		currencyLogger.Error("Currency Service failed", "error", err)
-	}
+	mux.HandleFunc("/health", healthHandler)
+	return mux
 }
 
 func convertHandler(w http.ResponseWriter, r *http.Request) {
@@ -77,7 +216,7 @@ func convertHandler(w http.ResponseWriter, r *http.Request) {
 
 	from := r.URL.Query().Get("from")
 	if from == "" {
-		from = "USD"
+		from = config.BaseCurrency
 	}
 	to := r.URL.Query().Get("to")
 	if to == "" {
@@ -93,17 +232,32 @@ func convertHandler(w http.ResponseWriter, r *http.Request) {
 		attribute.String("rpc.method", "Convert"),
 	)
 
-	// Simulate conversion calculation
-	fromRate, ok := exchangeRates[from]
-	if !ok {
-		fromRate = 1.0
+	if config.CurrencyFail != "" && strings.EqualFold(to, config.CurrencyFail) {
+		err := fmt.Errorf("conversion to %s is unavailable", to)
+		common.RecordSpanError(span, err)
+		currencyLogger.ErrorContext(ctx, "Convert failed", "from", from, "to", to, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	toRate, ok := exchangeRates[to]
-	if !ok {
-		toRate = 1.0
+
+	if delay := currencyLatency[strings.ToUpper(to)]; delay > 0 {
+		span.AddEvent("currency_latency_injected", trace.WithAttributes(
+			attribute.String("app.currency.to", to),
+			attribute.Int64("app.currency.delay_ms", delay.Milliseconds()),
+		))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
 	}
 
-	rate := toRate / fromRate
+	rate := cachedConversionRate(span, from, to)
+	decimals := currencyDecimals(to)
+	span.SetAttributes(
+		attribute.Float64("app.currency.rate", rate),
+		attribute.Int("app.currency.minor_units", decimals),
+	)
 
 	currencyCounter.Add(ctx, 1, metric.WithAttributes(
 		attribute.String("currency_code", to),
@@ -118,7 +272,135 @@ func convertHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"from": "%s", "to": "%s", "rate": %.4f}`, from, to, rate)
+	res := conversionResponse{From: from, To: to, Rate: math.Round(rate*1e4) / 1e4}
+	if amount, err := strconv.ParseFloat(r.URL.Query().Get("amount"), 64); err == nil {
+		converted := roundToMinorUnits(amount*rate, to)
+		res.ConvertedAmount = &converted
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// conversionResponse is the /convert response; ConvertedAmount is set when
+// the request gave an amount
+type conversionResponse struct {
+	From            string   `json:"from"`
+	To              string   `json:"to"`
+	Rate            float64  `json:"rate"`
+	ConvertedAmount *float64 `json:"converted_amount,omitempty"`
+}
+
+// conversionRate is the from->to rate, treating unknown currencies as the base
+func conversionRate(from, to string) float64 {
+	fromRate, ok := currentRate(from)
+	if !ok {
+		fromRate = 1.0
+	}
+	toRate, ok := currentRate(to)
+	if !ok {
+		toRate = 1.0
+	}
+	return toRate / fromRate
+}
+
+// cachedConversionRate serves conversionRate from currencyRates and records
+// cache.hit on span. Fuzzed rates change on every lookup, so the cache is
+// bypassed entirely while CURRENCY_FUZZ is on.
+func cachedConversionRate(span trace.Span, from, to string) float64 {
+	if currencyRates == nil || config.CurrencyFuzz {
+		return conversionRate(from, to)
+	}
+	rate, hit := currencyRates.get(from, to)
+	span.SetAttributes(attribute.Bool("cache.hit", hit))
+	if !hit {
+		rate = conversionRate(from, to)
+		currencyRates.put(from, to, rate)
+	}
+	return rate
+}
+
+// ConversionRequest is one entry of a /convert/batch body
+type ConversionRequest struct {
+	From   string  `json:"from"`
+	To     string  `json:"to"`
+	Amount float64 `json:"amount"`
+}
+
+// ConversionResult is the outcome of one batch entry; Error is set instead of
+// the rate and amount when the entry was invalid
+type ConversionResult struct {
+	From   string  `json:"from"`
+	To     string  `json:"to"`
+	Amount float64 `json:"amount"`
+	Rate   float64 `json:"rate,omitempty"`
+	Result float64 `json:"result,omitempty"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// convert validates a single conversion; unlike /convert, unknown currencies
+// are rejected rather than treated as the base currency
+func convert(req ConversionRequest) ConversionResult {
+	res := ConversionResult{From: req.From, To: req.To, Amount: req.Amount}
+	fromRate, ok := currentRate(req.From)
+	if !ok {
+		res.Error = fmt.Sprintf("unsupported currency %q", req.From)
+		return res
+	}
+	toRate, ok := currentRate(req.To)
+	if !ok {
+		res.Error = fmt.Sprintf("unsupported currency %q", req.To)
+		return res
+	}
+	if req.Amount < 0 {
+		res.Error = fmt.Sprintf("negative amount %g", req.Amount)
+		return res
+	}
+	res.Rate = toRate / fromRate
+	res.Result = roundToMinorUnits(req.Amount*res.Rate, req.To)
+	return res
+}
+
+// batchConvertHandler converts a JSON array of requests under one span. Bad
+// entries get a per-entry error; only a malformed body fails the request.
+func batchConvertHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := trace.SpanFromContext(ctx)
+
+	var reqs []ConversionRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		http.Error(w, fmt.Sprintf("invalid batch request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]ConversionResult, len(reqs))
+	failed := 0
+	for i, req := range reqs {
+		results[i] = convert(req)
+		if results[i].Error != "" {
+			failed++
+			continue
+		}
+		currencyCounter.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("currency_code", req.To),
+			attribute.String("from_currency", req.From),
+		))
+	}
+
+	span.SetAttributes(
+		attribute.String("rpc.system", "grpc"),
+		attribute.String("rpc.service", "oteldemo.CurrencyService"),
+		attribute.String("rpc.method", "BatchConvert"),
+		attribute.Int("app.currency.batch.size", len(reqs)),
+		attribute.Int("app.currency.batch.failed", failed),
+	)
+
+	currencyLogger.InfoContext(ctx, "BatchConvert",
+		"size", len(reqs),
+		"failed", failed,
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(results)
 }
 
 func getSupportedCurrenciesHandler(w http.ResponseWriter, r *http.Request) {
@@ -132,10 +414,7 @@ func getSupportedCurrenciesHandler(w http.ResponseWriter, r *http.Request) {
 		attribute.Int("app.currencies.count", len(exchangeRates)),
 	)
 
-	currencies := make([]string, 0, len(exchangeRates))
-	for code := range exchangeRates {
-		currencies = append(currencies, code)
-	}
+	currencies := supportedCurrencies()
 
 	currencyLogger.InfoContext(ctx, "GetSupportedCurrencies",
 		"count", len(currencies),
@@ -143,5 +422,5 @@ func getSupportedCurrenciesHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"currencies": %d}`, len(currencies))
+	json.NewEncoder(w).Encode(map[string]int{"currencies": len(currencies)})
 }
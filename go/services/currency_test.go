@@ -0,0 +1,345 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"otel-mock/common"
+	"otel-mock/config"
+
+	"go.opentelemetry.io/otel/codes"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+)
+
+// useTestCurrency sets up the currency service's globals for handler tests
+func useTestCurrency(t *testing.T) {
+	t.Helper()
+	setForTest(t, &currencyLogger, discardLogger)
+	setForTest(t, &currencyRand, RNG(fixedRNG{f: 0.5}))
+	setForTest(t, &currencyRates, nil)
+	initCurrencyMetrics(metricnoop.NewMeterProvider())
+}
+
+func convertQuery(t *testing.T, query string) conversionResponse {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	convertHandler(rec, httptest.NewRequest("GET", "/convert?"+query, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/convert?%s returned %d: %s", query, rec.Code, rec.Body)
+	}
+	var res conversionResponse
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestRoundToMinorUnits(t *testing.T) {
+	tests := []struct {
+		amount   float64
+		currency string
+		want     float64
+	}{
+		{1234.5678, "JPY", 1235},
+		{1234.4999, "JPY", 1234},
+		{12.345, "USD", 12.35},
+		{12.344, "USD", 12.34},
+		{1.23456, "BHD", 1.235},
+		{1.23449, "BHD", 1.234},
+	}
+	for _, tt := range tests {
+		if got := roundToMinorUnits(tt.amount, tt.currency); got != tt.want {
+			t.Errorf("roundToMinorUnits(%v, %s) = %v, want %v", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestConvertRoundsToTargetCurrency(t *testing.T) {
+	useTestCurrency(t)
+
+	tests := []struct {
+		to   string
+		want float64
+	}{
+		{"JPY", 1358},  // 12.345 * 110
+		{"USD", 12.35}, // 12.345 * 1
+		{"BHD", 4.642}, // 12.345 * 0.376
+	}
+	for _, tt := range tests {
+		res := convertQuery(t, "from=USD&to="+tt.to+"&amount=12.345")
+		if res.ConvertedAmount == nil || *res.ConvertedAmount != tt.want {
+			t.Errorf("USD->%s converted_amount = %v, want %v", tt.to, res.ConvertedAmount, tt.want)
+		}
+	}
+}
+
+func TestBatchConvertRoundsPerEntry(t *testing.T) {
+	got := convert(ConversionRequest{From: "USD", To: "JPY", Amount: 0.5})
+	if got.Result != 55 {
+		t.Fatalf("0.5 USD -> JPY = %v, want 55", got.Result)
+	}
+	if got := convert(ConversionRequest{From: "USD", To: "BHD", Amount: 100}); got.Result != 37.6 {
+		t.Fatalf("100 USD -> BHD = %v, want 37.6", got.Result)
+	}
+}
+
+// cacheHitAttr converts from->to through the rate cache and returns the
+// span's cache.hit attribute, if it was set
+func cacheHitAttr(t *testing.T, from, to string) (hit, set bool) {
+	t.Helper()
+	tp, sr := newTestTracerProvider(t)
+	_, span := tp.Tracer("test").Start(context.Background(), "convert")
+	if got, want := cachedConversionRate(span, from, to), conversionRate(from, to); got != want {
+		t.Fatalf("%s->%s rate = %v, want %v", from, to, got, want)
+	}
+	span.End()
+	for _, kv := range sr.Ended()[0].Attributes() {
+		if kv.Key == "cache.hit" {
+			return kv.Value.AsBool(), true
+		}
+	}
+	return false, false
+}
+
+func TestRateCacheMissThenHit(t *testing.T) {
+	useTestCurrency(t)
+	setForTest(t, &currencyRates, newRateCache(10, time.Hour))
+
+	if hit, set := cacheHitAttr(t, "USD", "EUR"); !set || hit {
+		t.Fatalf("first lookup cache.hit = %v (set %v), want false", hit, set)
+	}
+	if hit, set := cacheHitAttr(t, "USD", "EUR"); !set || !hit {
+		t.Fatalf("second lookup cache.hit = %v (set %v), want true", hit, set)
+	}
+	if hit, _ := cacheHitAttr(t, "EUR", "USD"); hit {
+		t.Fatal("reverse pair served from the cache")
+	}
+	if got := currencyRates.hitRatio(); got != 1.0/3 {
+		t.Fatalf("hit ratio = %v, want 1/3", got)
+	}
+}
+
+func TestRateCacheBypassed(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		useTestCurrency(t)
+		if _, set := cacheHitAttr(t, "USD", "EUR"); set {
+			t.Fatal("cache.hit set with no cache")
+		}
+	})
+	t.Run("fuzz", func(t *testing.T) {
+		useTestCurrency(t)
+		setForTest(t, &currencyRates, newRateCache(10, time.Hour))
+		setForTest(t, &config.CurrencyFuzz, true)
+		if _, set := cacheHitAttr(t, "USD", "EUR"); set {
+			t.Fatal("cache.hit set while CURRENCY_FUZZ is on")
+		}
+		if len(currencyRates.entries) != 0 || currencyRates.misses.Load() != 0 {
+			t.Fatal("fuzzed lookup went through the cache")
+		}
+	})
+}
+
+func TestRateCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newRateCache(2, time.Hour)
+	c.put("USD", "EUR", 0.9)
+	c.put("USD", "JPY", 110)
+	c.get("USD", "EUR")
+	c.put("USD", "GBP", 0.8)
+
+	if _, ok := c.get("USD", "JPY"); ok {
+		t.Fatal("least recently used rate survived eviction")
+	}
+	if rate, ok := c.get("USD", "EUR"); !ok || rate != 0.9 {
+		t.Fatalf("USD:EUR = %v, %v, want the recently used 0.9", rate, ok)
+	}
+}
+
+func TestRateCacheExpiresEntries(t *testing.T) {
+	c := newRateCache(2, -time.Second)
+	c.put("USD", "EUR", 0.9)
+	if _, ok := c.get("USD", "EUR"); ok {
+		t.Fatal("expired rate served")
+	}
+	if len(c.entries) != 0 {
+		t.Fatal("expired rate not evicted")
+	}
+}
+
+func TestRequestLogsCarryTraceID(t *testing.T) {
+	useTestCurrency(t)
+	tp, sr := newTestTracerProvider(t)
+	lp, logs := newTestLoggerProvider(t)
+	setForTest(t, &currencyLogger, common.NewLogger("currency", lp))
+
+	common.NewHandler(http.HandlerFunc(convertHandler), "Convert", tp).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/convert?from=USD&to=EUR", nil))
+
+	traceID := sr.Ended()[0].SpanContext().TraceID()
+	records := logs.Records()
+	if len(records) == 0 {
+		t.Fatal("convert logged nothing")
+	}
+	for _, r := range records {
+		if r.TraceID() != traceID {
+			t.Fatalf("record %q has trace ID %s, want the request's %s", r.Body().AsString(), r.TraceID(), traceID)
+		}
+	}
+}
+
+func TestRebaseKeepsCrossRates(t *testing.T) {
+	useTestCurrency(t)
+	setForTest(t, &exchangeRates, maps.Clone(exchangeRates))
+	codes := supportedCurrencies()
+	before := map[string]float64{}
+	for _, from := range codes {
+		for _, to := range codes {
+			before[from+":"+to] = conversionRate(from, to)
+		}
+	}
+
+	if err := rebaseExchangeRates("EUR"); err != nil {
+		t.Fatal(err)
+	}
+
+	if exchangeRates["EUR"] != 1 {
+		t.Fatalf("EUR rate = %v after rebasing on it, want 1", exchangeRates["EUR"])
+	}
+	for _, from := range codes {
+		for _, to := range codes {
+			want := before[from+":"+to]
+			if got := conversionRate(from, to); math.Abs(got-want) > want*1e-9 {
+				t.Errorf("%s->%s = %v after rebase, want %v", from, to, got, want)
+			}
+		}
+	}
+}
+
+func TestRebaseRejectsUnknownBase(t *testing.T) {
+	setForTest(t, &exchangeRates, maps.Clone(exchangeRates))
+	usd := exchangeRates["USD"]
+
+	if err := rebaseExchangeRates("XXX"); err == nil {
+		t.Fatal("rebasing on an unknown currency succeeded")
+	}
+	if exchangeRates["USD"] != usd {
+		t.Fatal("failed rebase changed the rates")
+	}
+}
+
+func TestFuzzedRatesStayWithinDriftOfAnchor(t *testing.T) {
+	useTestCurrency(t)
+	setForTest(t, &config.CurrencyFuzz, true)
+	setForTest(t, &currencyRand, NewRNG(7))
+	setForTest(t, &rateDrift, map[string]float64{})
+
+	for code, base := range exchangeRates {
+		seen := map[float64]bool{}
+		for range 2000 {
+			rate, ok := currentRate(code)
+			if !ok {
+				t.Fatalf("no rate for %s", code)
+			}
+			if math.Abs(rate-base) > base*maxRateDrift*(1+1e-9) {
+				t.Fatalf("%s rate %v drifted more than 1%% from its %v anchor", code, rate, base)
+			}
+			seen[rate] = true
+		}
+		if code == config.BaseCurrency {
+			if len(seen) != 1 {
+				t.Fatalf("base currency %s rate moved: %v", code, seen)
+			}
+		} else if len(seen) < 100 {
+			t.Fatalf("%s took only %d distinct rates over 2000 lookups, want it to walk", code, len(seen))
+		}
+	}
+}
+
+func TestFuzzedRateClampsAtDriftBound(t *testing.T) {
+	useTestCurrency(t)
+	setForTest(t, &config.CurrencyFuzz, true)
+	// Every step pushes the rate up as far as it goes
+	setForTest(t, &currencyRand, RNG(fixedRNG{f: 0.999999}))
+	setForTest(t, &rateDrift, map[string]float64{})
+
+	var rate float64
+	for range 100 {
+		rate, _ = currentRate("EUR")
+	}
+	if want := exchangeRates["EUR"] * (1 + maxRateDrift); math.Abs(rate-want) > 1e-12 {
+		t.Fatalf("EUR rate = %v after a sustained rise, want it held at %v", rate, want)
+	}
+}
+
+func TestCurrencyLatencyIgnoresCase(t *testing.T) {
+	useTestCurrency(t)
+	setForTest(t, &currencyLatency, map[string]time.Duration{})
+	setForTest(t, &config.CurrencyLatency, "jpy=80ms")
+	applyCurrencyLatency()
+
+	for _, to := range []string{"JPY", "jpy", "Jpy"} {
+		start := time.Now()
+		convertQuery(t, "from=USD&to="+to)
+		if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+			t.Errorf("conversion to %s took %v, want the 80ms injected for JPY", to, elapsed)
+		}
+	}
+	start := time.Now()
+	convertQuery(t, "from=USD&to=EUR")
+	if elapsed := time.Since(start); elapsed >= 80*time.Millisecond {
+		t.Errorf("conversion to EUR took %v, want no injected latency", elapsed)
+	}
+}
+
+func TestRateCacheHitRatioGauge(t *testing.T) {
+	useTestCurrency(t)
+	setForTest(t, &currencyRates, newRateCache(10, time.Hour))
+	mp, reader := newTestMeterProvider(t)
+	initCurrencyMetrics(mp)
+
+	for _, to := range []string{"EUR", "EUR", "EUR", "JPY"} {
+		convertQuery(t, "from=USD&to="+to)
+	}
+
+	// Misses for the first EUR and JPY lookups, hits for the other two
+	if got := gaugeValue(t, reader, "app.currency.cache.hit_ratio"); got != 0.5 {
+		t.Fatalf("app.currency.cache.hit_ratio = %v, want 0.5", got)
+	}
+}
+
+func TestCurrencyFailAffectsOnlyConfiguredCurrency(t *testing.T) {
+	useTestCurrency(t)
+	setForTest(t, &config.CurrencyFail, "JPY")
+	tp, sr := newTestTracerProvider(t)
+
+	for _, tt := range []struct {
+		to   string
+		want int
+	}{
+		{"JPY", http.StatusInternalServerError},
+		{"jpy", http.StatusInternalServerError},
+		{"EUR", http.StatusOK},
+		{"GBP", http.StatusOK},
+	} {
+		ctx, span := tp.Tracer("currency").Start(context.Background(), "convert "+tt.to)
+		rec := httptest.NewRecorder()
+		convertHandler(rec, httptest.NewRequest("GET", "/convert?from=USD&to="+tt.to, nil).WithContext(ctx))
+		span.End()
+		if rec.Code != tt.want {
+			t.Errorf("conversion to %s returned %d, want %d", tt.to, rec.Code, tt.want)
+		}
+	}
+
+	for _, s := range sr.Ended() {
+		failed := s.Status().Code == codes.Error
+		if wantFailed := strings.EqualFold(s.Name(), "convert JPY"); failed != wantFailed {
+			t.Errorf("span %s error status = %v, want %v", s.Name(), failed, wantFailed)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"otel-mock/common"
+	"otel-mock/config"
+	"strings"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newCheckoutClient returns the client checkout uses for downstream calls.
+// With DRY_RUN set, requests are answered locally by dryRunTransport while
+// still producing otelhttp client spans.
+func newCheckoutClient(tp trace.TracerProvider, mp metric.MeterProvider) *http.Client {
+	client := common.NewHTTPClient(tp, mp)
+	if config.DryRun {
+		client.Transport = otelhttp.NewTransport(dryRunTransport{}, otelhttp.WithTracerProvider(tp), otelhttp.WithMeterProvider(mp))
+	}
+	return client
+}
+
+// dryRunTransport logs the request it was given and returns a canned
+// successful response shaped like the real service's
+type dryRunTransport struct{}
+
+func (dryRunTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("app.dry_run", true))
+	checkoutLogger.InfoContext(ctx, "DryRun request", "method", req.Method, "url", req.URL.String())
+
+	body, err := json.Marshal(dryRunResponse(req))
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Status:        fmt.Sprintf("%d %s", http.StatusOK, http.StatusText(http.StatusOK)),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// dryRunResponse picks a canned body by request path
+func dryRunResponse(req *http.Request) any {
+	path := req.URL.Path
+	switch {
+	case path == "/cart":
+		return map[string]any{"items_count": 0, "items": []CartItem{}}
+	case path == "/charge":
+		return map[string]string{"transaction_id": "dry-run-" + uuid.New().String()}
+	case path == "/ship":
+		return map[string]string{"tracking_id": "dry-run-" + uuid.New().String()}
+	case strings.HasPrefix(path, "/products/"):
+		id := strings.TrimPrefix(path, "/products/")
+		for _, p := range products {
+			if p.ID == id {
+				return p
+			}
+		}
+		return products[0]
+	default:
+		return map[string]string{"status": "ok"}
+	}
+}
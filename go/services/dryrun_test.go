@@ -0,0 +1,58 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"otel-mock/config"
+
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestDryRunMakesNoHTTPCalls(t *testing.T) {
+	useTestCheckout(t)
+	setForTest(t, &config.DryRun, true)
+	var calls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		t.Errorf("dry run called %s %s", r.Method, r.URL)
+	}))
+	t.Cleanup(srv.Close)
+	for _, p := range []*string{&config.CartURL, &config.ProductCatalogURL, &config.CurrencyURL, &config.PaymentURL, &config.ShippingURL, &config.EmailURL, &config.QuoteURL} {
+		setForTest(t, p, srv.URL)
+	}
+
+	tp, sr := newTestTracerProvider(t)
+	client := newCheckoutClient(tp, metricnoop.NewMeterProvider())
+	c := &checkoutService{rng: fixedRNG{}}
+	if _, err := c.placeOrder(context.Background(), client, OrderRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := calls.Load(); n != 0 {
+		t.Fatalf("dry run made %d real HTTP calls, want 0", n)
+	}
+	clientSpans := 0
+	for _, s := range sr.Ended() {
+		if s.SpanKind() != trace.SpanKindClient {
+			continue
+		}
+		clientSpans++
+		dryRun := false
+		for _, kv := range s.Attributes() {
+			if kv.Key == "app.dry_run" && kv.Value.AsBool() {
+				dryRun = true
+			}
+		}
+		if !dryRun {
+			t.Errorf("client span %s not marked app.dry_run", s.Name())
+		}
+	}
+	if clientSpans == 0 {
+		t.Fatal("no client spans recorded in dry run")
+	}
+}
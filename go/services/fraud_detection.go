@@ -1,79 +1,155 @@
 package services
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log/slog"
-	"math/rand"
 	"net/http"
+	"otel-mock/common"
+	"otel-mock/config"
+	"sync"
+	"time"
 
-	"go.opentelemetry.io/contrib/bridges/otelslog"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel/attribute"
 	otellog "go.opentelemetry.io/otel/log"
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
 )
 
-var (
-	fraudTracer trace.Tracer
-	fraudMeter  metric.Meter
-	fraudLogger *slog.Logger
-)
+// fraudDetectionService holds one fraud detection instance's telemetry and
+// state, so instances (and the other services sharing this package) never
+// share counters or velocity history
+type fraudDetectionService struct {
+	tracer trace.Tracer
+	logger *slog.Logger
+	rng    RNG
+	client *http.Client
 
-var (
-	ordersScanned  metric.Int64Counter
-	fraudsDetected metric.Int64Counter
-)
+	ordersScanned    metric.Int64Counter
+	fraudsDetected   metric.Int64Counter
+	messagesConsumed metric.Int64Counter
+	consumeLatency   metric.Float64Histogram
+	dlqPublished     metric.Int64Counter
 
-func InitFraudDetectionService(port string, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) *http.Server {
-	fraudTracer = tp.Tracer("fraud-detection")
-	fraudMeter = mp.Meter("fraud-detection")
+	// userOrders tracks recent order times per user for the velocity rule
+	userOrdersMu sync.Mutex
+	userOrders   map[string][]time.Time
+}
+
+func newFraudDetectionService(rng RNG, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) *fraudDetectionService {
+	meter := mp.Meter("fraud-detection")
+	s := &fraudDetectionService{
+		tracer:     tp.Tracer("fraud-detection"),
+		logger:     common.NewLogger("fraud-detection", lp),
+		rng:        rng,
+		client:     common.NewHTTPClient(tp, mp),
+		userOrders: map[string][]time.Time{},
+	}
 
 	var err error
-	ordersScanned, err = fraudMeter.Int64Counter("app.fraud.orders_scanned",
+	s.ordersScanned, err = meter.Int64Counter("app.fraud.orders_scanned",
 		metric.WithDescription("Total orders scanned for fraud"),
 		metric.WithUnit("{orders}"))
 	if err != nil {
-		slog.Error("Failed to create orders_scanned counter", "error", err)
+		s.logger.Error("Failed to create orders_scanned counter", "error", err)
 	}
 
-	fraudsDetected, err = fraudMeter.Int64Counter("app.fraud.detected",
+	s.fraudsDetected, err = meter.Int64Counter("app.fraud.detected",
 		metric.WithDescription("Total fraudulent orders detected"),
 		metric.WithUnit("{orders}"))
 	if err != nil {
-		slog.Error("Failed to create frauds_detected counter", "error", err)
+		s.logger.Error("Failed to create frauds_detected counter", "error", err)
 	}
 
-	mux := http.NewServeMux()
-	// Wrap with otelhttp to extract trace context from incoming requests
-	mux.Handle("/consume", otelhttp.NewHandler(
-		http.HandlerFunc(handleFraudConsume),
-		"orders receive",
-		otelhttp.WithTracerProvider(tp),
-	))
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"status":"ok"}`))
-	})
+	s.messagesConsumed, err = meter.Int64Counter("app.messaging.consumed",
+		metric.WithDescription("Messages consumed from Kafka"),
+		metric.WithUnit("{messages}"))
+	if err != nil {
+		s.logger.Error("Failed to create messaging.consumed counter", "error", err)
+	}
 
-	server := &http.Server{
-		Addr:    port,
-		Handler: mux,
+	s.consumeLatency, err = meter.Float64Histogram("app.messaging.consume.latency",
+		metric.WithDescription("Time taken to process a consumed message"),
+		metric.WithUnit("ms"))
+	if err != nil {
+		s.logger.Error("Failed to create messaging.consume.latency histogram", "error", err)
 	}
 
-	fraudLogger = otelslog.NewLogger("fraud-detection", otelslog.WithLoggerProvider(lp))
-	fraudLogger.Info("Fraud Detection Service starting", "port", port)
+	s.dlqPublished, err = meter.Int64Counter("app.fraud.dlq.published",
+		metric.WithDescription("Fraudulent orders published to the dead-letter queue"),
+		metric.WithUnit("{orders}"))
+	if err != nil {
+		s.logger.Error("Failed to create fraud.dlq.published counter", "error", err)
+	}
+	return s
+}
+
+func InitFraudDetectionService(port string, rng RNG, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) *http.Server {
+	s := newFraudDetectionService(rng, tp, mp, lp)
+
+	server := common.NewServer(port, s.newMux(tp))
+
+	logEffectiveConfig(s.logger)
+	s.logger.Info("Fraud Detection Service starting", "port", port)
+
+	if kafkaBrokers() != nil {
+		go runKafkaConsumer("frauddetectionservice", s.tracer, s.logger, func(ctx context.Context, span trace.Span, order *OrderMessage) {
+			s.consumeOrder(ctx, span, order)
+		})
+	}
 	return server
 }
 
-func handleFraudConsume(w http.ResponseWriter, r *http.Request) {
+// newMux routes fraud detection's consumer endpoint
+func (s *fraudDetectionService) newMux(tp trace.TracerProvider) *http.ServeMux {
+	mux := http.NewServeMux()
+	// Wrap with otelhttp to extract trace context from incoming requests
+	mux.Handle("/consume", newConsumeHandler(http.HandlerFunc(s.handleConsume), tp))
+	mux.HandleFunc("/health", healthHandler)
+	return mux
+}
+
+func (s *fraudDetectionService) handleConsume(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
 	// Get span from otelhttp handler (already creates "orders receive" span)
 	span := trace.SpanFromContext(ctx)
+	setPartitionFromHeader(span, r.Header)
+
+	body, _ := io.ReadAll(r.Body)
+	order, err := decodeOrderMessage(body)
+	if err != nil {
+		common.RecordSpanError(span, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := simulateConsumeFailure(s.rng, span); err != nil {
+		s.logger.WarnContext(ctx, "Failing order delivery", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fraudDetected := s.consumeOrder(ctx, span, order)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "scanned",
+		"is_fraud": fraudDetected,
+	})
+}
+
+// consumeOrder handles one orders message, whether it arrived over the HTTP
+// mock or a real Kafka consumer. A nil order is replaced by a random one.
+func (s *fraudDetectionService) consumeOrder(ctx context.Context, span trace.Span, order *OrderMessage) bool {
+	start := time.Now()
+	if order == nil {
+		order = randomOrderMessage(ctx, s.rng)
+	}
 
-	// Add Kafka messaging attributes to the existing span
+	// Add Kafka messaging attributes to the receive span
 	span.SetAttributes(
 		attribute.String("messaging.system", "kafka"),
 		attribute.String("messaging.destination.name", "orders"),
@@ -81,58 +157,157 @@ func handleFraudConsume(w http.ResponseWriter, r *http.Request) {
 		attribute.String("messaging.consumer.group.name", "frauddetectionservice"),
 	)
 
-	fraudLogger.InfoContext(ctx, "Received order from Kafka", "topic", "orders", "consumer_group", "frauddetectionservice")
+	setOrderAttributes(ctx, span, order)
 
-	// Simulate fraud detection
-	fraudDetected := detectFraud(ctx)
+	s.logger.InfoContext(ctx, "Received order from Kafka", "topic", "orders", "consumer_group", "frauddetectionservice", "order_id", order.OrderID)
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":   "scanned",
-		"is_fraud": fraudDetected,
-	})
+	// Scan the order for fraud
+	fraudDetected := s.detectFraud(ctx, order)
+
+	consumeAttrs := metric.WithAttributes(
+		attribute.String("messaging.destination.name", "orders"),
+		attribute.String("messaging.consumer.group.name", "frauddetectionservice"),
+	)
+	s.messagesConsumed.Add(ctx, 1, consumeAttrs)
+	s.consumeLatency.Record(ctx, float64(time.Since(start).Milliseconds()), consumeAttrs)
+
+	return fraudDetected
 }
 
-func detectFraud(ctx context.Context) bool {
-	ctx, span := fraudTracer.Start(ctx, "detectFraud")
+func (s *fraudDetectionService) detectFraud(ctx context.Context, order *OrderMessage) bool {
+	ctx, span := s.tracer.Start(ctx, "detectFraud")
 	defer span.End()
 
-	orderID := "order-" + randomString(8)
-	amount := float64(rand.Intn(50000)+1000) / 100.0
-	userID := "user-" + randomString(6)
+	orderID := order.OrderID
+	amount := order.Amount
+	userID := order.UserID
 
-	fraudLogger.InfoContext(ctx, "DetectFraud started", "order_id", orderID, "user_id", userID, "amount", amount)
+	s.logger.InfoContext(ctx, "DetectFraud started", "order_id", orderID, "user_id", userID, "amount", amount)
 
 	span.SetAttributes(
 		attribute.String("app.order.id", orderID),
 		attribute.Float64("app.order.amount", amount),
-		attribute.String("app.user.id", userID),
+		common.BoundedAttr("app.user.id", userID),
 	)
 
-	// 2% chance of fraud detection
-	isFraud := rand.Float32() < 0.02
+	isFraud, reason := s.evaluateFraudRules(userID, amount)
 
 	span.SetAttributes(attribute.Bool("app.fraud.detected", isFraud))
+	if isFraud {
+		span.SetAttributes(attribute.String("app.fraud.reason", reason))
+	}
 
-	ordersScanned.Add(ctx, 1)
+	s.ordersScanned.Add(ctx, 1)
 
 	if isFraud {
-		fraudsDetected.Add(ctx, 1)
+		s.fraudsDetected.Add(ctx, 1)
 		span.AddEvent("fraud_detected", trace.WithAttributes(
 			attribute.String("app.order.id", orderID),
-			attribute.String("app.fraud.reason", "suspicious_pattern"),
+			attribute.String("app.fraud.reason", reason),
 		))
-		fraudLogger.WarnContext(ctx, "Fraud detected!",
+		s.logger.WarnContext(ctx, "Fraud detected!",
 			"order_id", orderID,
+			"reason", reason,
 			"user_id", userID,
 			"amount", amount,
 		)
+		s.publishToDLQ(ctx, order, reason)
 	} else {
 		span.AddEvent("order_cleared")
-		fraudLogger.InfoContext(ctx, "Order cleared",
+		s.logger.InfoContext(ctx, "Order cleared",
 			"order_id", orderID,
 		)
 	}
 
 	return isFraud
 }
+
+// maxTrackedUsers bounds userOrders before stale users are pruned
+const maxTrackedUsers = 10000
+
+// evaluateFraudRules checks the order against each rule in turn and returns
+// the first that triggers: high_amount, velocity, then the random base rate
+func (s *fraudDetectionService) evaluateFraudRules(userID string, amount float64) (bool, string) {
+	if config.FraudAmountThreshold > 0 && amount > config.FraudAmountThreshold {
+		return true, "high_amount"
+	}
+	if config.FraudVelocityLimit > 0 && s.recordUserOrder(userID, time.Now()) > config.FraudVelocityLimit {
+		return true, "velocity"
+	}
+	if s.rng.Float64() < config.FraudRate {
+		return true, "random"
+	}
+	return false, ""
+}
+
+// recordUserOrder notes an order for userID and returns how many orders the
+// user has placed within the velocity window
+func (s *fraudDetectionService) recordUserOrder(userID string, now time.Time) int {
+	s.userOrdersMu.Lock()
+	defer s.userOrdersMu.Unlock()
+
+	cutoff := now.Add(-config.FraudVelocityWindow)
+	recent := s.userOrders[userID][:0]
+	for _, t := range s.userOrders[userID] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	s.userOrders[userID] = recent
+
+	// Random user IDs would otherwise grow the map without bound
+	if len(s.userOrders) > maxTrackedUsers {
+		for id, times := range s.userOrders {
+			if !times[len(times)-1].After(cutoff) {
+				delete(s.userOrders, id)
+			}
+		}
+	}
+	return len(recent)
+}
+
+// publishToDLQ sends a fraudulent order to the dead-letter queue. Without
+// FRAUD_DLQ_URL the producer span only records that the publish was skipped.
+func (s *fraudDetectionService) publishToDLQ(ctx context.Context, order *OrderMessage, reason string) {
+	ctx, span := s.tracer.Start(ctx, "fraud-dlq publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "kafka"),
+			attribute.String("messaging.destination.name", "fraud-dlq"),
+			attribute.String("messaging.operation.type", "publish"),
+			attribute.String("app.order.id", order.OrderID),
+			attribute.String("app.fraud.reason", reason),
+		))
+	defer span.End()
+
+	if config.FraudDLQURL == "" {
+		span.AddEvent("dlq_publish_skipped", trace.WithAttributes(
+			attribute.String("app.dlq.skip_reason", "FRAUD_DLQ_URL not set"),
+		))
+		return
+	}
+
+	payload, _ := json.Marshal(order)
+	req, _ := http.NewRequestWithContext(ctx, "POST", config.FraudDLQURL, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	injectMessageHeaders(ctx, req.Header)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		common.RecordSpanError(span, err)
+		s.logger.ErrorContext(ctx, "DLQ publish failed", "order_id", order.OrderID, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		err := fmt.Errorf("dead-letter queue returned %d", resp.StatusCode)
+		common.RecordSpanError(span, err)
+		s.logger.ErrorContext(ctx, "DLQ publish failed", "order_id", order.OrderID, "error", err)
+		return
+	}
+
+	s.dlqPublished.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("app.fraud.reason", reason),
+	))
+	s.logger.InfoContext(ctx, "Order published to DLQ", "order_id", order.OrderID, "reason", reason)
+}
@@ -0,0 +1,147 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"otel-mock/config"
+
+	lognoop "go.opentelemetry.io/otel/log/noop"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+func newTestFraudService(rng RNG) *fraudDetectionService {
+	return newFraudDetectionService(rng, tracenoop.NewTracerProvider(), metricnoop.NewMeterProvider(), lognoop.NewLoggerProvider())
+}
+
+func TestFraudRules(t *testing.T) {
+	setForTest(t, &config.FraudAmountThreshold, 1000)
+	setForTest(t, &config.FraudVelocityLimit, 2)
+	setForTest(t, &config.FraudVelocityWindow, time.Minute)
+	setForTest(t, &config.FraudRate, 0.1)
+
+	tests := []struct {
+		name       string
+		userID     string
+		amount     float64
+		roll       float64
+		prior      int
+		wantFraud  bool
+		wantReason string
+	}{
+		{name: "cleared", userID: "u-1", amount: 50, roll: 0.5},
+		{name: "high amount", userID: "u-2", amount: 1000.01, roll: 0.5, wantFraud: true, wantReason: "high_amount"},
+		{name: "at threshold", userID: "u-3", amount: 1000, roll: 0.5},
+		{name: "velocity", userID: "u-4", amount: 50, roll: 0.5, prior: 2, wantFraud: true, wantReason: "velocity"},
+		{name: "within velocity limit", userID: "u-5", amount: 50, roll: 0.5, prior: 1},
+		{name: "random", userID: "u-6", amount: 50, roll: 0.05, wantFraud: true, wantReason: "random"},
+		{name: "high amount wins over random", userID: "u-7", amount: 5000, roll: 0.05, wantFraud: true, wantReason: "high_amount"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestFraudService(fixedRNG{f: tt.roll})
+			for range tt.prior {
+				s.recordUserOrder(tt.userID, time.Now())
+			}
+			fraud, reason := s.evaluateFraudRules(tt.userID, tt.amount)
+			if fraud != tt.wantFraud || reason != tt.wantReason {
+				t.Fatalf("evaluateFraudRules = (%v, %q), want (%v, %q)", fraud, reason, tt.wantFraud, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestFraudRulesDisabledByDefaultThresholds(t *testing.T) {
+	setForTest(t, &config.FraudAmountThreshold, 0)
+	setForTest(t, &config.FraudVelocityLimit, 0)
+	setForTest(t, &config.FraudRate, 0)
+
+	s := newTestFraudService(fixedRNG{f: 0})
+	for range 10 {
+		if fraud, reason := s.evaluateFraudRules("u-1", 1e9); fraud {
+			t.Fatalf("flagged %q with every rule disabled", reason)
+		}
+	}
+}
+
+func TestRecordUserOrderForgetsOrdersOutsideWindow(t *testing.T) {
+	setForTest(t, &config.FraudVelocityWindow, time.Minute)
+	s := newTestFraudService(fixedRNG{})
+
+	start := time.Unix(0, 0)
+	s.recordUserOrder("u-1", start)
+	s.recordUserOrder("u-1", start.Add(30*time.Second))
+	if n := s.recordUserOrder("u-1", start.Add(80*time.Second)); n != 2 {
+		t.Fatalf("orders in window = %d, want 2", n)
+	}
+}
+
+func TestDLQPublishOnlyOnFraud(t *testing.T) {
+	var received atomic.Int32
+	dlq := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+	}))
+	defer dlq.Close()
+	setForTest(t, &config.FraudDLQURL, dlq.URL)
+	setForTest(t, &config.FraudAmountThreshold, 1000)
+	setForTest(t, &config.FraudVelocityLimit, 0)
+	setForTest(t, &config.FraudRate, 0)
+
+	mp, reader := newTestMeterProvider(t)
+	s := newFraudDetectionService(fixedRNG{f: 1}, tracenoop.NewTracerProvider(), mp, lognoop.NewLoggerProvider())
+
+	if s.detectFraud(context.Background(), &OrderMessage{OrderID: "o-1", UserID: "u-1", Amount: 10}) {
+		t.Fatal("cheap order flagged as fraud")
+	}
+	if n := received.Load(); n != 0 {
+		t.Fatalf("DLQ received %d messages for a cleared order", n)
+	}
+
+	if !s.detectFraud(context.Background(), &OrderMessage{OrderID: "o-2", UserID: "u-1", Amount: 5000}) {
+		t.Fatal("expensive order not flagged as fraud")
+	}
+	if n := received.Load(); n != 1 {
+		t.Fatalf("DLQ received %d messages, want 1", n)
+	}
+	if n := counterValue(t, reader, "app.fraud.dlq.published"); n != 1 {
+		t.Fatalf("app.fraud.dlq.published = %d, want 1", n)
+	}
+}
+
+func TestDLQPublishFailureIsNotCounted(t *testing.T) {
+	dlq := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer dlq.Close()
+	setForTest(t, &config.FraudDLQURL, dlq.URL)
+
+	mp, reader := newTestMeterProvider(t)
+	s := newFraudDetectionService(fixedRNG{}, tracenoop.NewTracerProvider(), mp, lognoop.NewLoggerProvider())
+	s.publishToDLQ(context.Background(), &OrderMessage{OrderID: "o-1"}, "high_amount")
+
+	if n := counterValue(t, reader, "app.fraud.dlq.published"); n != 0 {
+		t.Fatalf("app.fraud.dlq.published = %d after a rejected publish, want 0", n)
+	}
+}
+
+func TestDLQPublishSkippedWithoutURL(t *testing.T) {
+	setForTest(t, &config.FraudDLQURL, "")
+	tp, sr := newTestTracerProvider(t)
+	mp, reader := newTestMeterProvider(t)
+	s := newFraudDetectionService(fixedRNG{}, tp, mp, lognoop.NewLoggerProvider())
+
+	s.publishToDLQ(context.Background(), &OrderMessage{OrderID: "o-1"}, "high_amount")
+
+	if n := counterValue(t, reader, "app.fraud.dlq.published"); n != 0 {
+		t.Fatalf("app.fraud.dlq.published = %d without a DLQ, want 0", n)
+	}
+	events := sr.Ended()[0].Events()
+	if len(events) != 1 || events[0].Name != "dlq_publish_skipped" {
+		t.Fatalf("span events = %+v, want a single dlq_publish_skipped", events)
+	}
+}
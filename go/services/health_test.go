@@ -0,0 +1,35 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	lognoop "go.opentelemetry.io/otel/log/noop"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+)
+
+func TestHealthOnEveryService(t *testing.T) {
+	tp, sr := newTestTracerProvider(t)
+	mp, lp := metricnoop.NewMeterProvider(), lognoop.NewLoggerProvider()
+
+	muxes := map[string]http.Handler{
+		"accounting":      newAccountingService(fixedRNG{}, tp, mp, lp).newMux(tp),
+		"cart":            newCartMux(tp),
+		"checkout":        (&checkoutService{rng: fixedRNG{}}).newMux(http.DefaultClient, tp),
+		"currency":        newCurrencyMux(tp),
+		"fraud-detection": newFraudDetectionService(fixedRNG{}, tp, mp, lp).newMux(tp),
+		"product-catalog": newProductCatalogMux(tp),
+		"shipping":        newShippingMux(tp),
+	}
+	for name, mux := range muxes {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != `{"status":"ok"}` {
+			t.Errorf("%s /health = %d %q, want 200 {\"status\":\"ok\"}", name, rec.Code, rec.Body)
+		}
+	}
+	if spans := sr.Ended(); len(spans) != 0 {
+		t.Fatalf("health probes produced %d spans, want none", len(spans))
+	}
+}
@@ -0,0 +1,266 @@
+package services
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"otel-mock/common"
+	"otel-mock/config"
+
+	"github.com/alicebob/miniredis/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/propagation"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// discardLogger stands in for service loggers whose output tests ignore
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// setForTest points *p at v for the duration of the test
+func setForTest[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// newTestRedis starts an in-memory Redis and points REDIS_ADDR at it
+func newTestRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	setForTest(t, &config.RedisAddr, mr.Addr())
+	return mr
+}
+
+// useTestCart points the cart handlers at the Redis in REDIS_ADDR, e.g. one
+// started by newTestRedis
+func useTestCart(t *testing.T, rng RNG) {
+	t.Helper()
+	setForTest(t, &cartRand, rng)
+	setForTest(t, &cartLogger, discardLogger)
+	setForTest(t, &cartTTL, time.Hour)
+	initCartMetrics(metricnoop.NewMeterProvider())
+	setForTest(t, &redisClient, common.NewRedisClient("cart"))
+	t.Cleanup(func() { redisClient.Close() })
+}
+
+// newTestTracerProvider records every span ended through it
+func newTestTracerProvider(t *testing.T) (*sdktrace.TracerProvider, *tracetest.SpanRecorder) {
+	t.Helper()
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+	return tp, sr
+}
+
+// newTestMeterProvider collects metrics on demand through the returned reader
+func newTestMeterProvider(t *testing.T) (*sdkmetric.MeterProvider, *sdkmetric.ManualReader) {
+	t.Helper()
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	t.Cleanup(func() { mp.Shutdown(context.Background()) })
+	return mp, reader
+}
+
+// logRecorder keeps every log record exported to it
+type logRecorder struct {
+	mu      sync.Mutex
+	records []sdklog.Record
+}
+
+func (r *logRecorder) Export(_ context.Context, records []sdklog.Record) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rec := range records {
+		r.records = append(r.records, rec.Clone())
+	}
+	return nil
+}
+
+func (r *logRecorder) Shutdown(context.Context) error   { return nil }
+func (r *logRecorder) ForceFlush(context.Context) error { return nil }
+
+func (r *logRecorder) Records() []sdklog.Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.records)
+}
+
+// newTestLoggerProvider exports every record emitted through it to the
+// returned recorder as it is emitted
+func newTestLoggerProvider(t *testing.T) (*sdklog.LoggerProvider, *logRecorder) {
+	t.Helper()
+	rec := &logRecorder{}
+	lp := sdklog.NewLoggerProvider(sdklog.WithProcessor(sdklog.NewSimpleProcessor(rec)))
+	t.Cleanup(func() { lp.Shutdown(context.Background()) })
+	return lp, rec
+}
+
+// histogramTotal returns the sum and count over every data point of the
+// named Float64 histogram
+func histogramTotal(t *testing.T, reader *sdkmetric.ManualReader, name string) (sum float64, count uint64) {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if h, ok := m.Data.(metricdata.Histogram[float64]); ok && m.Name == name {
+				for _, dp := range h.DataPoints {
+					sum += dp.Sum
+					count += dp.Count
+				}
+			}
+		}
+	}
+	return sum, count
+}
+
+// manualClock is a Clock that only moves when advanced
+type manualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newManualClock() *manualClock {
+	return &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Since(t time.Time) time.Duration { return c.Now().Sub(t) }
+
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// counterValue sums every data point of the named Int64 counter
+func counterValue(t *testing.T, reader *sdkmetric.ManualReader, name string) int64 {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if sum, ok := m.Data.(metricdata.Sum[int64]); ok && m.Name == name {
+				for _, dp := range sum.DataPoints {
+					total += dp.Value
+				}
+			}
+		}
+	}
+	return total
+}
+
+// counterValueWith sums an int64 counter's data points carrying kv
+func counterValueWith(t *testing.T, reader *sdkmetric.ManualReader, name string, kv attribute.KeyValue) int64 {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if sum, ok := m.Data.(metricdata.Sum[int64]); ok && m.Name == name {
+				for _, dp := range sum.DataPoints {
+					if v, ok := dp.Attributes.Value(kv.Key); ok && v == kv.Value {
+						total += dp.Value
+					}
+				}
+			}
+		}
+	}
+	return total
+}
+
+// gaugeValue returns a float64 gauge's single observed value, failing the
+// test when the gauge wasn't collected
+func gaugeValue(t *testing.T, reader *sdkmetric.ManualReader, name string) float64 {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if g, ok := m.Data.(metricdata.Gauge[float64]); ok && m.Name == name && len(g.DataPoints) == 1 {
+				return g.DataPoints[0].Value
+			}
+		}
+	}
+	t.Fatalf("no %s gauge collected", name)
+	return 0
+}
+
+// useTestCheckout points checkout's tracer at a recording provider and
+// silences its logger
+func useTestCheckout(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	tp, sr := newTestTracerProvider(t)
+	setForTest(t, &checkoutTracer, trace.Tracer(tp.Tracer("checkout")))
+	setForTest(t, &checkoutLogger, discardLogger)
+	initCheckoutMetrics(metricnoop.NewMeterProvider())
+	return sr
+}
+
+// usePropagators installs the W3C trace context and baggage propagators the
+// services are configured with in main
+func usePropagators(t *testing.T) {
+	t.Helper()
+	old := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	t.Cleanup(func() { otel.SetTextMapPropagator(old) })
+}
+
+// fixedRNG returns the same values on every call, for exact assertions
+type fixedRNG struct {
+	n int
+	f float64
+}
+
+func (r fixedRNG) Intn(n int) int   { return min(r.n, n-1) }
+func (r fixedRNG) Float32() float32 { return float32(r.f) }
+func (r fixedRNG) Float64() float64 { return r.f }
+
+// seqRNG returns floats from a fixed sequence, repeating the last one once it
+// runs out; safe for concurrent use
+type seqRNG struct {
+	mu     sync.Mutex
+	floats []float64
+}
+
+func (r *seqRNG) next() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.floats[0]
+	if len(r.floats) > 1 {
+		r.floats = r.floats[1:]
+	}
+	return f
+}
+
+func (r *seqRNG) Intn(n int) int   { return int(r.next() * float64(n)) }
+func (r *seqRNG) Float32() float32 { return float32(r.next()) }
+func (r *seqRNG) Float64() float64 { return r.next() }
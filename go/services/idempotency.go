@@ -0,0 +1,114 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"otel-mock/common"
+	"otel-mock/config"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// IdempotencyKeyHeader lets a client retry /checkout without placing the
+// order twice
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyPending marks a key whose order is still being placed
+const idempotencyPending = "pending"
+
+// storedOrder is the response saved for an idempotency key
+type storedOrder struct {
+	Status int          `json:"status"`
+	Result *OrderResult `json:"result"`
+}
+
+func idempotencyRedisKey(key string) string {
+	return "checkout:idempotency:" + key
+}
+
+// claimIdempotencyKey reserves key for this request. It returns the stored
+// response when the key was already used (nil while that order is still in
+// flight) and claimed=false. When Redis is unavailable the request proceeds
+// without idempotency. The in-flight marker only lives as long as an order
+// can take, so a key whose request died is freed well before IDEMPOTENCY_TTL.
+func (c *checkoutService) claimIdempotencyKey(ctx context.Context, key string) (stored *storedOrder, claimed bool) {
+	rkey := idempotencyRedisKey(key)
+	ok, err := c.redis.SetNX(ctx, rkey, idempotencyPending, idempotencyPendingTTL()).Result()
+	if err != nil {
+		common.RecordSpanError(trace.SpanFromContext(ctx), err)
+		checkoutLogger.WarnContext(ctx, "Idempotency check failed, placing order anyway", "error", err)
+		return nil, true
+	}
+	if ok {
+		return nil, true
+	}
+
+	raw, err := c.redis.Get(ctx, rkey).Result()
+	if errors.Is(err, redis.Nil) {
+		// Expired between SETNX and GET; treat as a fresh key
+		return c.claimIdempotencyKey(ctx, key)
+	}
+	if err != nil {
+		common.RecordSpanError(trace.SpanFromContext(ctx), err)
+		checkoutLogger.WarnContext(ctx, "Idempotency lookup failed, placing order anyway", "error", err)
+		return nil, true
+	}
+	if raw == idempotencyPending {
+		return nil, false
+	}
+	var s storedOrder
+	if err := json.Unmarshal([]byte(raw), &s); err != nil {
+		return nil, false
+	}
+	return &s, false
+}
+
+// idempotencyPendingTTL is how long an order can run before its request is
+// cut off: REQUEST_TIMEOUT, or the server write timeout when that is disabled
+func idempotencyPendingTTL() time.Duration {
+	if config.RequestTimeout > 0 {
+		return config.RequestTimeout
+	}
+	return config.HTTPWriteTimeout
+}
+
+// storeIdempotentResult saves the response for a claimed key and reports
+// whether it was saved
+func (c *checkoutService) storeIdempotentResult(ctx context.Context, key string, status int, result *OrderResult) bool {
+	data, _ := json.Marshal(storedOrder{Status: status, Result: result})
+	if err := c.redis.Set(ctx, idempotencyRedisKey(key), data, config.IdempotencyTTL).Err(); err != nil {
+		common.RecordSpanError(trace.SpanFromContext(ctx), err)
+		checkoutLogger.WarnContext(ctx, "Failed to store idempotent order result", "error", err)
+		return false
+	}
+	return true
+}
+
+// releaseIdempotencyKey frees a claimed key whose order left no result to
+// replay (it was aborted, panicked, or the result couldn't be stored)
+func (c *checkoutService) releaseIdempotencyKey(ctx context.Context, key string) {
+	if err := c.redis.Del(ctx, idempotencyRedisKey(key)).Err(); err != nil {
+		checkoutLogger.WarnContext(ctx, "Failed to release idempotency key", "idempotency_key", key, "error", err)
+	}
+}
+
+// replayIdempotentResult answers a repeated request from its stored response,
+// or with 409 while the original is still being placed
+func replayIdempotentResult(w http.ResponseWriter, r *http.Request, key string, stored *storedOrder) {
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttributes(attribute.Bool("app.checkout.idempotent_replay", true))
+	if stored == nil {
+		checkoutLogger.InfoContext(r.Context(), "Order with idempotency key still in progress", "idempotency_key", key)
+		http.Error(w, "order with this idempotency key is in progress", http.StatusConflict)
+		return
+	}
+	checkoutLogger.InfoContext(r.Context(), "Replaying idempotent order", "idempotency_key", key, "order_id", stored.Result.OrderID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(stored.Status)
+	json.NewEncoder(w).Encode(stored.Result)
+}
@@ -0,0 +1,176 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"otel-mock/common"
+	"otel-mock/config"
+
+	"github.com/alicebob/miniredis/v2"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// chargeCounter answers like a dry run and counts the /charge calls it sees.
+// onCharge, if set, runs before each charge is answered.
+type chargeCounter struct {
+	charges  atomic.Int32
+	onCharge func(*http.Request)
+}
+
+func (c *chargeCounter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path == "/charge" {
+		c.charges.Add(1)
+		if c.onCharge != nil {
+			c.onCharge(req)
+		}
+	}
+	return dryRunTransport{}.RoundTrip(req)
+}
+
+// newRedisCheckout returns a checkout instance using the Redis in REDIS_ADDR
+func newRedisCheckout(t *testing.T) *checkoutService {
+	t.Helper()
+	c := &checkoutService{rng: fixedRNG{}, redis: common.NewRedisClient("checkout")}
+	t.Cleanup(func() { c.redis.Close() })
+	return c
+}
+
+// useTestIdempotency points checkout at an in-memory Redis and returns it
+// with a /checkout handler whose downstream charges are counted
+func useTestIdempotency(t *testing.T) (*miniredis.Miniredis, http.Handler, *chargeCounter) {
+	t.Helper()
+	useTestCheckout(t)
+	mr := newTestRedis(t)
+	setForTest(t, &config.FraudDetectionURL, "")
+	setForTest(t, &config.AccountingURL, "")
+
+	counter := &chargeCounter{}
+	return mr, newRedisCheckout(t).placeOrderHandler(&http.Client{Transport: counter}), counter
+}
+
+func checkoutWithKey(h http.Handler, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/checkout", strings.NewReader(`{"user_id":"u-1","currency":"USD"}`))
+	req.Header.Set(IdempotencyKeyHeader, key)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIdempotencyKeyChargesOnce(t *testing.T) {
+	_, h, counter := useTestIdempotency(t)
+
+	first := checkoutWithKey(h, "key-1")
+	second := checkoutWithKey(h, "key-1")
+
+	if first.Code != http.StatusOK || second.Code != http.StatusOK {
+		t.Fatalf("statuses = %d, %d, want 200 twice", first.Code, second.Code)
+	}
+	if n := counter.charges.Load(); n != 1 {
+		t.Fatalf("card charged %d times, want once", n)
+	}
+	var a, b OrderResult
+	json.NewDecoder(first.Body).Decode(&a)
+	json.NewDecoder(second.Body).Decode(&b)
+	if a.OrderID == "" || a.OrderID != b.OrderID {
+		t.Fatalf("order IDs = %q, %q, want the first order replayed", a.OrderID, b.OrderID)
+	}
+
+	checkoutWithKey(h, "key-2")
+	if n := counter.charges.Load(); n != 2 {
+		t.Fatalf("card charged %d times after a new key, want twice", n)
+	}
+}
+
+func TestIdempotencyPendingMarkerExpires(t *testing.T) {
+	mr, _, _ := useTestIdempotency(t)
+	setForTest(t, &config.RequestTimeout, 5*time.Second)
+	c := newRedisCheckout(t)
+
+	if _, claimed := c.claimIdempotencyKey(context.Background(), "key-1"); !claimed {
+		t.Fatal("fresh key not claimed")
+	}
+	if ttl := mr.TTL(idempotencyRedisKey("key-1")); ttl != 5*time.Second {
+		t.Fatalf("pending marker TTL = %v, want REQUEST_TIMEOUT", ttl)
+	}
+	if _, claimed := c.claimIdempotencyKey(context.Background(), "key-1"); claimed {
+		t.Fatal("key claimed twice while pending")
+	}
+	mr.FastForward(5 * time.Second)
+	if _, claimed := c.claimIdempotencyKey(context.Background(), "key-1"); !claimed {
+		t.Fatal("key not reclaimable once the pending marker expired")
+	}
+}
+
+func TestIdempotencyKeyReleasedWhenOrderAborts(t *testing.T) {
+	mr, h, counter := useTestIdempotency(t)
+
+	// The client gives up while the card is being charged
+	ctx, cancel := context.WithCancel(context.Background())
+	counter.onCharge = func(*http.Request) { cancel() }
+	req := httptest.NewRequest("POST", "/checkout", strings.NewReader(`{}`)).WithContext(ctx)
+	req.Header.Set(IdempotencyKeyHeader, "key-1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if mr.Exists(idempotencyRedisKey("key-1")) {
+		t.Fatal("aborted order left its idempotency key claimed")
+	}
+	counter.onCharge = nil
+	if rec := checkoutWithKey(h, "key-1"); rec.Code != http.StatusOK {
+		t.Fatalf("retry after abort returned %d, want 200", rec.Code)
+	}
+	if n := counter.charges.Load(); n != 2 {
+		t.Fatalf("card charged %d times, want the retry to charge again", n)
+	}
+}
+
+func TestIdempotencyKeyReleasedWhenOrderPanics(t *testing.T) {
+	mr, h, counter := useTestIdempotency(t)
+	counter.onCharge = func(*http.Request) { panic("payment client bug") }
+
+	func() {
+		defer func() { recover() }()
+		checkoutWithKey(h, "key-1")
+	}()
+
+	if mr.Exists(idempotencyRedisKey("key-1")) {
+		t.Fatal("panicked order left its idempotency key claimed")
+	}
+}
+
+func TestIdempotencyLookupErrorPlacesOrder(t *testing.T) {
+	mr, h, counter := useTestIdempotency(t)
+	// A key of the wrong type makes SETNX report it taken and GET fail
+	mr.HSet(idempotencyRedisKey("key-1"), "field", "value")
+
+	if rec := checkoutWithKey(h, "key-1"); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want the order placed", rec.Code)
+	}
+	if n := counter.charges.Load(); n != 1 {
+		t.Fatalf("card charged %d times, want once", n)
+	}
+}
+
+func TestIdempotencyRedisFailureMarksSpanFailed(t *testing.T) {
+	sr := useTestCheckout(t)
+	setForTest(t, &config.RedisAddr, unreachableURL(t)[len("http://"):])
+	c := newRedisCheckout(t)
+
+	ctx, span := checkoutTracer.Start(context.Background(), "PlaceOrder")
+	if _, claimed := c.claimIdempotencyKey(ctx, "key-1"); !claimed {
+		t.Fatal("order not placed while Redis is down")
+	}
+	c.recordOrderStatus(ctx, "o-1", orderPlaced)
+	span.End()
+
+	s := sr.Ended()[0]
+	if s.Status().Code != codes.Error || len(s.Events()) != 2 {
+		t.Fatalf("status = %+v with %d events, want Error with both failures recorded", s.Status(), len(s.Events()))
+	}
+}
@@ -0,0 +1,115 @@
+//go:build integration
+
+// Integration tests against real brokers. Run with
+//
+//	KAFKA_BROKERS=localhost:9092 REDIS_ADDR=localhost:6379 go test -tags integration ./services
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"otel-mock/config"
+
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestKafkaPublishReachesConsumerWithProducerLink(t *testing.T) {
+	if config.KafkaBrokers == "" {
+		t.Skip("KAFKA_BROKERS not set")
+	}
+	usePropagators(t)
+	tp, sr := newTestTracerProvider(t)
+	setForTest(t, &checkoutTracer, tp.Tracer("checkout"))
+	setForTest(t, &checkoutLogger, discardLogger)
+	initCheckoutMetrics(metricnoop.NewMeterProvider())
+	setForTest(t, &kafkaWriter, newKafkaWriter())
+	t.Cleanup(func() { kafkaWriter.Close() })
+
+	orderID := fmt.Sprintf("it-%d", time.Now().UnixNano())
+	received := make(chan struct{}, 1)
+	groupID := "integration-" + orderID
+	go runKafkaConsumer(groupID, tp.Tracer("consumer"), discardLogger, func(ctx context.Context, span trace.Span, order *OrderMessage) {
+		if order.OrderID == orderID {
+			received <- struct{}{}
+		}
+	})
+
+	c := &checkoutService{rng: NewRNG(1)}
+	c.publishToKafka(context.Background(), http.DefaultClient, OrderMessage{OrderID: orderID})
+
+	select {
+	case <-received:
+	case <-time.After(30 * time.Second):
+		t.Fatal("order was not consumed within 30s")
+	}
+
+	// The consumer span ends once the handler returns, so wait for it
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if producer, consumer := publishAndReceiveSpans(sr.Ended()); consumer != nil {
+			if consumer.Parent().SpanID() != producer.SpanContext().SpanID() {
+				t.Fatal("consumer span is not a child of the producer span")
+			}
+			links := consumer.Links()
+			if len(links) != 1 || links[0].SpanContext.SpanID() != producer.SpanContext().SpanID() {
+				t.Fatalf("consumer links = %+v, want one link to the producer span", links)
+			}
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("no orders receive span was recorded for the published order")
+}
+
+// publishAndReceiveSpans finds the orders publish span and its orders receive
+// child among spans; consumer is nil until the receive span has ended
+func publishAndReceiveSpans(spans []sdktrace.ReadOnlySpan) (producer, consumer sdktrace.ReadOnlySpan) {
+	for _, s := range spans {
+		if s.Name() == "orders publish" {
+			producer = s
+		}
+	}
+	if producer == nil {
+		return nil, nil
+	}
+	for _, s := range spans {
+		if s.Name() == "orders receive" && s.Parent().SpanID() == producer.SpanContext().SpanID() {
+			return producer, s
+		}
+	}
+	return producer, nil
+}
+
+func TestCartAddAgainstRedis(t *testing.T) {
+	if os.Getenv("REDIS_ADDR") == "" {
+		t.Skip("REDIS_ADDR not set")
+	}
+	useTestCart(t, fixedRNG{n: 1})
+
+	userID := fmt.Sprintf("it-%d", time.Now().UnixNano())
+	for range 2 {
+		rec := httptest.NewRecorder()
+		addItemHandler(rec, httptest.NewRequest("POST", "/cart/add?user_id="+userID+"&product_id=OLJCESPC7Z", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("add returned %d: %s", rec.Code, rec.Body)
+		}
+	}
+	t.Cleanup(func() { redisClient.Del(context.Background(), "cart:"+userID) })
+
+	items, err := redisClient.HGetAll(context.Background(), "cart:"+userID).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fixedRNG{n: 1} adds a quantity of 2 each time
+	if want := `{"product_id":"OLJCESPC7Z","quantity":4}`; items["OLJCESPC7Z"] != want {
+		t.Fatalf("cart item = %s, want %s", items["OLJCESPC7Z"], want)
+	}
+}
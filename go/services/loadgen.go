@@ -0,0 +1,128 @@
+package services
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"otel-mock/common"
+	"otel-mock/config"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/baggage"
+	otellog "go.opentelemetry.io/otel/log"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// LoadGenResult summarizes a load generator run
+type LoadGenResult struct {
+	Requests    int64
+	Errors      int64
+	Elapsed     time.Duration
+	AchievedRPS float64
+	ErrorRate   float64
+}
+
+// RunLoadGenerator drives the checkout endpoint at rps requests per second for
+// duration, spread across a pool of workers. With synthetic set, requests carry
+// synthetic_request=true baggage so checkout tags their spans app.synthetic.
+// Cancelling ctx ends the run early; in-flight requests still complete.
+func RunLoadGenerator(ctx context.Context, rps, workers int, duration time.Duration, synthetic bool, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) LoadGenResult {
+	logger := common.NewLogger("loadgen", lp)
+	logEffectiveConfig(logger)
+	client := common.NewHTTPClient(tp, mp)
+
+	if synthetic {
+		ctx = withSyntheticBaggage(ctx)
+	}
+
+	logger.Info("Load generator starting", "rps", rps, "workers", workers, "duration", duration.String(), "synthetic", synthetic,
+		"max_idle_conns_per_host", config.HTTPMaxIdleConnsPerHost, "max_conns_per_host", config.HTTPMaxConnsPerHost)
+	result := generateLoad(ctx, client, config.CheckoutURL+"/checkout", rps, workers, duration)
+	logger.Info("Load generator completed",
+		"requests", result.Requests,
+		"errors", result.Errors,
+		"achieved_rps", result.AchievedRPS,
+		"error_rate", result.ErrorRate,
+	)
+	return result
+}
+
+// withSyntheticBaggage marks outgoing requests as synthetic traffic
+func withSyntheticBaggage(ctx context.Context) context.Context {
+	m, _ := baggage.NewMember("synthetic_request", "true")
+	b, _ := baggage.New(m)
+	return baggage.ContextWithBaggage(ctx, b)
+}
+
+func generateLoad(ctx context.Context, client *http.Client, url string, rps, workers int, duration time.Duration) LoadGenResult {
+	// Requests keep ctx's values (baggage) but not the run's deadline, so
+	// in-flight orders complete
+	reqCtx := context.WithoutCancel(ctx)
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	var requests, errors atomic.Int64
+	jobs := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				requests.Add(1)
+				if !sendCheckout(reqCtx, client, url) {
+					errors.Add(1)
+				}
+			}
+		}()
+	}
+
+	// The ticker paces requests; if every worker is busy the tick is dropped
+	// rather than queued, so achieved RPS shows when the target is unreachable
+	start := time.Now()
+	ticker := time.NewTicker(time.Second / time.Duration(rps))
+	defer ticker.Stop()
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-ticker.C:
+			select {
+			case jobs <- struct{}{}:
+			default:
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	result := LoadGenResult{
+		Requests: requests.Load(),
+		Errors:   errors.Load(),
+		Elapsed:  elapsed,
+	}
+	result.AchievedRPS = float64(result.Requests) / elapsed.Seconds()
+	if result.Requests > 0 {
+		result.ErrorRate = float64(result.Errors) / float64(result.Requests)
+	}
+	return result
+}
+
+// sendCheckout places one order and reports whether it succeeded
+func sendCheckout(ctx context.Context, client *http.Client, url string) bool {
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode < http.StatusBadRequest
+}
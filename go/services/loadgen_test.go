@@ -0,0 +1,84 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"otel-mock/common"
+
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+)
+
+func TestGenerateLoadHitsTargetRate(t *testing.T) {
+	var served atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every third order fails
+		if served.Add(1)%3 == 0 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	res := generateLoad(context.Background(), srv.Client(), srv.URL, 50, 4, 500*time.Millisecond)
+
+	// 50 rps for 0.5s is 25 requests; allow for ticker and scheduling slack
+	if res.Requests < 18 || res.Requests > 26 {
+		t.Fatalf("sent %d requests, want about 25", res.Requests)
+	}
+	if res.Requests != served.Load() {
+		t.Fatalf("reported %d requests but the server saw %d", res.Requests, served.Load())
+	}
+	if want := served.Load() / 3; res.Errors != want {
+		t.Fatalf("counted %d errors, want %d", res.Errors, want)
+	}
+	if res.AchievedRPS < 36 || res.AchievedRPS > 52 {
+		t.Fatalf("achieved %.1f rps, want about 50", res.AchievedRPS)
+	}
+}
+
+func TestSyntheticLoadTagsOrderSpans(t *testing.T) {
+	for _, synthetic := range []bool{true, false} {
+		t.Run(fmt.Sprintf("synthetic=%v", synthetic), func(t *testing.T) {
+			useTestCheckout(t)
+			usePropagators(t)
+			tp, sr := newTestTracerProvider(t)
+			c := &checkoutService{rng: fixedRNG{}}
+			checkout := httptest.NewServer(c.newMux(&http.Client{Transport: dryRunTransport{}}, tp))
+			defer checkout.Close()
+
+			ctx := context.Background()
+			if synthetic {
+				ctx = withSyntheticBaggage(ctx)
+			}
+			client := common.NewHTTPClient(tp, metricnoop.NewMeterProvider())
+			if res := generateLoad(ctx, client, checkout.URL+"/checkout", 20, 1, 120*time.Millisecond); res.Requests == 0 || res.Errors != 0 {
+				t.Fatalf("load run = %+v, want successful orders", res)
+			}
+
+			orders := 0
+			for _, s := range sr.Ended() {
+				if s.Name() != "PlaceOrder" {
+					continue
+				}
+				orders++
+				tagged := false
+				for _, kv := range s.Attributes() {
+					if kv.Key == "app.synthetic" && kv.Value.AsBool() {
+						tagged = true
+					}
+				}
+				if tagged != synthetic {
+					t.Fatalf("order span app.synthetic = %v, want %v", tagged, synthetic)
+				}
+			}
+			if orders == 0 {
+				t.Fatal("no PlaceOrder span recorded")
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package services
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"otel-mock/common"
+	"otel-mock/config"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// messageHeaderPrefix namespaces the mock Kafka message headers on the HTTP
+// request, so they don't collide with the transport's own traceparent
+const messageHeaderPrefix = "X-Message-"
+
+// messageHeaderCarrier adapts prefixed HTTP headers to a TextMapCarrier,
+// standing in for Kafka record headers
+type messageHeaderCarrier http.Header
+
+func (c messageHeaderCarrier) Get(key string) string {
+	return http.Header(c).Get(messageHeaderPrefix + key)
+}
+
+func (c messageHeaderCarrier) Set(key, value string) {
+	http.Header(c).Set(messageHeaderPrefix+key, value)
+}
+
+func (c messageHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		if strings.HasPrefix(k, messageHeaderPrefix) {
+			keys = append(keys, strings.ToLower(strings.TrimPrefix(k, messageHeaderPrefix)))
+		}
+	}
+	return keys
+}
+
+// injectMessageHeaders writes the producer span context into the message headers
+func injectMessageHeaders(ctx context.Context, h http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, messageHeaderCarrier(h))
+}
+
+// producerLinksKey carries the links the consumer span is started with
+type producerLinksKey struct{}
+
+// producerLinkTracerProvider hands out tracers that start every span with the
+// links stored in the context, so the otelhttp server span gets its producer
+// link at creation like the Kafka consumer span does
+type producerLinkTracerProvider struct {
+	trace.TracerProvider
+}
+
+func (p producerLinkTracerProvider) Tracer(name string, opts ...trace.TracerOption) trace.Tracer {
+	return producerLinkTracer{p.TracerProvider.Tracer(name, opts...)}
+}
+
+type producerLinkTracer struct {
+	trace.Tracer
+}
+
+func (t producerLinkTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if links, ok := ctx.Value(producerLinksKey{}).([]trace.Link); ok {
+		opts = append(opts, trace.WithLinks(links...))
+	}
+	return t.Tracer.Start(ctx, name, opts...)
+}
+
+// newConsumeHandler wraps a mock /consume handler in an "orders receive"
+// server span linked to the producer span carried in the message headers,
+// mirroring how Kafka consumers relate to producers. Baggage in the message
+// headers reaches the handler, as it would a Kafka consumer.
+func newConsumeHandler(h http.Handler, tp trace.TracerProvider) http.Handler {
+	inner := common.NewHandler(h, ordersTopic+" receive", producerLinkTracerProvider{tp})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		producerCtx := otel.GetTextMapPropagator().Extract(context.Background(), messageHeaderCarrier(r.Header))
+		if bag := baggage.FromContext(producerCtx); bag.Len() > 0 {
+			r = r.WithContext(baggage.ContextWithBaggage(r.Context(), bag))
+		}
+		if sc := trace.SpanContextFromContext(producerCtx); sc.IsValid() {
+			links := []trace.Link{trace.LinkFromContext(producerCtx,
+				attribute.String("messaging.operation.type", "publish"),
+			)}
+			r = r.WithContext(context.WithValue(r.Context(), producerLinksKey{}, links))
+		}
+		inner.ServeHTTP(w, r)
+	})
+}
+
+// partitionHeader carries the mock message's partition to the consumers
+const partitionHeader = messageHeaderPrefix + "Partition"
+
+// orderPartition assigns an order to one of KAFKA_PARTITIONS partitions by
+// hashing its ID the way the real writer's kafka.Hash balancer does, so the
+// same order always lands on the same partition
+func orderPartition(orderID string) int {
+	partitions := make([]int, max(config.KafkaPartitions, 1))
+	for i := range partitions {
+		partitions[i] = i
+	}
+	return (&kafka.Hash{}).Balance(kafka.Message{Key: []byte(orderID)}, partitions...)
+}
+
+// setPartitionFromHeader records the partition the producer assigned to the
+// mock message on the consumer span
+func setPartitionFromHeader(span trace.Span, h http.Header) {
+	if p, err := strconv.Atoi(h.Get(partitionHeader)); err == nil {
+		span.SetAttributes(attribute.Int("messaging.kafka.destination.partition", p))
+	}
+}
+
+// simulateConsumeFailure fails a mock delivery at CONSUMER_FAILURE_RATE,
+// recording the error on the consumer span
+func simulateConsumeFailure(rng RNG, span trace.Span) error {
+	if config.ConsumerFailureRate <= 0 || rng.Float64() >= config.ConsumerFailureRate {
+		return nil
+	}
+	err := errors.New("simulated consumer processing failure")
+	common.RecordSpanError(span, err)
+	return err
+}
+
+// deliverMockMessage posts an orders message to one consumer's /consume,
+// retrying failed deliveries, and returns how many retries it took
+func deliverMockMessage(ctx context.Context, client *http.Client, url string, payload []byte, partition int) (int, error) {
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(partitionHeader, strconv.Itoa(partition))
+	injectMessageHeaders(ctx, req.Header)
+	resp, retries, err := common.DoWithRetryCount(client, req, common.RetryOnThrottle())
+	if err != nil {
+		return retries, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+		return retries, fmt.Errorf("consumer returned %d", resp.StatusCode)
+	}
+	return retries, nil
+}
+
+const ordersTopic = "orders"
+
+// OrderMessage is the order payload published to the orders topic
+type OrderMessage struct {
+	OrderID  string  `json:"order_id"`
+	UserID   string  `json:"user_id"`
+	Amount   float64 `json:"amount"`
+	Currency string  `json:"currency"`
+}
+
+// decodeOrderMessage parses an orders payload; an empty payload yields nil
+func decodeOrderMessage(data []byte) (*OrderMessage, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+	var order OrderMessage
+	if err := json.Unmarshal(data, &order); err != nil {
+		return nil, fmt.Errorf("invalid order message: %w", err)
+	}
+	return &order, nil
+}
+
+// randomOrderMessage invents an order for consumers that received no payload,
+// keeping the order ID from baggage when the producer set one
+func randomOrderMessage(ctx context.Context, rng RNG) *OrderMessage {
+	return &OrderMessage{
+		OrderID:  cmp.Or(orderIDFromBaggage(ctx), "order-"+randomString(rng, 8)),
+		UserID:   "user-" + randomString(rng, 6),
+		Amount:   float64(rng.Intn(50000)+1000) / 100.0,
+		Currency: []string{"USD", "EUR", "GBP", "JPY"}[rng.Intn(4)],
+	}
+}
+
+// setOrderAttributes records the consumed order on the receive span. The
+// order ID comes from baggage when the producer set it there, so it matches
+// the one stamped by every other service the order passed through.
+func setOrderAttributes(ctx context.Context, span trace.Span, order *OrderMessage) {
+	span.SetAttributes(
+		attribute.String("app.order.id", cmp.Or(orderIDFromBaggage(ctx), order.OrderID)),
+		common.BoundedAttr("app.user.id", order.UserID),
+		attribute.Float64("app.order.amount", order.Amount),
+		attribute.String("app.order.currency", order.Currency),
+	)
+}
+
+// kafkaHeaderCarrier adapts Kafka record headers to a TextMapCarrier
+type kafkaHeaderCarrier struct {
+	headers *[]kafka.Header
+}
+
+func (c kafkaHeaderCarrier) Get(key string) string {
+	for _, h := range *c.headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func (c kafkaHeaderCarrier) Set(key, value string) {
+	for i, h := range *c.headers {
+		if h.Key == key {
+			(*c.headers)[i].Value = []byte(value)
+			return
+		}
+	}
+	*c.headers = append(*c.headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (c kafkaHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(*c.headers))
+	for _, h := range *c.headers {
+		keys = append(keys, h.Key)
+	}
+	return keys
+}
+
+func kafkaBrokers() []string {
+	if config.KafkaBrokers == "" {
+		return nil
+	}
+	return strings.Split(config.KafkaBrokers, ",")
+}
+
+// newKafkaWriter returns a writer for the orders topic, or nil when no
+// brokers are configured. Messages are keyed by order ID, and hashing the key
+// keeps each order on the partition orderPartition reports for the mock.
+func newKafkaWriter() *kafka.Writer {
+	brokers := kafkaBrokers()
+	if brokers == nil || config.DryRun {
+		return nil
+	}
+	return &kafka.Writer{
+		Addr:                   kafka.TCP(brokers...),
+		Topic:                  ordersTopic,
+		Balancer:               &kafka.Hash{},
+		BatchTimeout:           10 * time.Millisecond,
+		AllowAutoTopicCreation: true,
+	}
+}
+
+// runKafkaConsumer reads the orders topic as groupID, starting a consumer span
+// linked to the producer for each message and passing the decoded order to handle
+func runKafkaConsumer(groupID string, tracer trace.Tracer, logger *slog.Logger, handle func(ctx context.Context, span trace.Span, order *OrderMessage)) {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: kafkaBrokers(),
+		GroupID: groupID,
+		Topic:   ordersTopic,
+	})
+	defer reader.Close()
+
+	logger.Info("Kafka consumer starting", "topic", ordersTopic, "consumer_group", groupID)
+
+	for {
+		msg, err := reader.ReadMessage(context.Background())
+		if err != nil {
+			logger.Error("Kafka consumer stopped", "consumer_group", groupID, "error", err)
+			return
+		}
+
+		producerCtx := otel.GetTextMapPropagator().Extract(context.Background(), kafkaHeaderCarrier{&msg.Headers})
+		ctx, span := tracer.Start(producerCtx, ordersTopic+" receive",
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithLinks(trace.LinkFromContext(producerCtx,
+				attribute.String("messaging.operation.type", "publish"),
+			)),
+			trace.WithAttributes(
+				attribute.Int("messaging.kafka.destination.partition", msg.Partition),
+				attribute.Int64("messaging.kafka.message.offset", msg.Offset),
+				attribute.String("messaging.kafka.message.key", string(msg.Key)),
+			))
+
+		order, err := decodeOrderMessage(msg.Value)
+		if err != nil {
+			common.RecordSpanError(span, err)
+			logger.ErrorContext(ctx, "Skipping undecodable order message", "offset", msg.Offset, "error", err)
+			span.End()
+			continue
+		}
+		handle(ctx, span, order)
+		span.End()
+	}
+}
@@ -0,0 +1,167 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"otel-mock/config"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/codes"
+	lognoop "go.opentelemetry.io/otel/log/noop"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+)
+
+func TestConsumeSpanStartsWithProducerLink(t *testing.T) {
+	usePropagators(t)
+	tp, sr := newTestTracerProvider(t)
+
+	producerCtx, producer := tp.Tracer("test").Start(context.Background(), "orders publish")
+	producer.End()
+
+	req := httptest.NewRequest("POST", "/consume", nil)
+	injectMessageHeaders(producerCtx, req.Header)
+	newConsumeHandler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), tp).
+		ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := sr.Ended()
+	consumer := spans[len(spans)-1]
+	if consumer.Name() != "orders receive" {
+		t.Fatalf("last span = %q, want the orders receive span", consumer.Name())
+	}
+	links := consumer.Links()
+	if len(links) != 1 || links[0].SpanContext.SpanID() != producer.SpanContext().SpanID() {
+		t.Fatalf("consumer links = %+v, want one link to the producer span", links)
+	}
+}
+
+func TestConsumeSpanWithoutProducerHasNoLinks(t *testing.T) {
+	usePropagators(t)
+	tp, sr := newTestTracerProvider(t)
+
+	newConsumeHandler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}), tp).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/consume", nil))
+
+	if links := sr.Ended()[0].Links(); len(links) != 0 {
+		t.Fatalf("consumer links = %+v, want none", links)
+	}
+}
+
+func TestMockDeliveryRetriesConsumerFailures(t *testing.T) {
+	setForTest(t, &config.ConsumerFailureRate, 0.5)
+	setForTest(t, &config.FraudRate, 0)
+	setForTest(t, &config.RetryMaxAttempts, 3)
+	setForTest(t, &config.RetryBaseBackoff, time.Millisecond)
+	tp, sr := newTestTracerProvider(t)
+
+	// The consumer fails its first two deliveries, then processes the third
+	s := newFraudDetectionService(&seqRNG{floats: []float64{0.1, 0.2, 0.9}}, tp, metricnoop.NewMeterProvider(), lognoop.NewLoggerProvider())
+	consumer := httptest.NewServer(newConsumeHandler(http.HandlerFunc(s.handleConsume), tp))
+	defer consumer.Close()
+
+	retries, err := deliverMockMessage(context.Background(), consumer.Client(), consumer.URL, []byte(`{"order_id":"o-1"}`), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retries != 2 {
+		t.Fatalf("retries = %d, want 2", retries)
+	}
+
+	var failed int
+	for _, span := range sr.Ended() {
+		if span.Name() == "orders receive" && span.Status().Code == codes.Error {
+			failed++
+		}
+	}
+	if failed != 2 {
+		t.Fatalf("%d failed receive spans, want 2", failed)
+	}
+}
+
+// consumeOrder delivers body to a fraud detection consumer, with headers
+// injected from ctx, and returns the receive span's app.order.id
+func consumeOrder(t *testing.T, ctx context.Context, body string) string {
+	t.Helper()
+	setForTest(t, &config.FraudRate, 0)
+	setForTest(t, &config.ConsumerFailureRate, 0)
+	tp, sr := newTestTracerProvider(t)
+	s := newFraudDetectionService(fixedRNG{f: 0.5}, tp, metricnoop.NewMeterProvider(), lognoop.NewLoggerProvider())
+
+	req := httptest.NewRequest("POST", "/consume", strings.NewReader(body))
+	injectMessageHeaders(ctx, req.Header)
+	rec := httptest.NewRecorder()
+	newConsumeHandler(http.HandlerFunc(s.handleConsume), tp).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/consume returned %d: %s", rec.Code, rec.Body)
+	}
+	return spanAttr(t, sr, "orders receive", "app.order.id").AsString()
+}
+
+func TestConsumerReadsOrderIDFromBaggage(t *testing.T) {
+	usePropagators(t)
+	ctx := contextWithOrderID(context.Background(), "o-from-checkout")
+
+	// The baggage ID is the one every other service stamped on the order
+	if got := consumeOrder(t, ctx, `{"order_id":"o-in-payload","amount":10}`); got != "o-from-checkout" {
+		t.Fatalf("consumer app.order.id = %q, want the baggage order ID", got)
+	}
+}
+
+func TestConsumerFallsBackToPayloadOrderID(t *testing.T) {
+	usePropagators(t)
+
+	if got := consumeOrder(t, context.Background(), `{"order_id":"o-in-payload","amount":10}`); got != "o-in-payload" {
+		t.Fatalf("consumer app.order.id = %q, want the payload's order ID without baggage", got)
+	}
+}
+
+func TestPublishCountsOnlyDeliveredMessages(t *testing.T) {
+	useTestCheckout(t)
+	mp, reader := newTestMeterProvider(t)
+	initCheckoutMetrics(mp)
+	setForTest(t, &kafkaWriter, nil)
+	setForTest(t, &config.RetryBaseBackoff, time.Millisecond)
+	up := statusServer(t, http.StatusOK)
+	setForTest(t, &config.AccountingURL, up.URL)
+	setForTest(t, &config.FraudDetectionURL, up.URL)
+	c := &checkoutService{rng: fixedRNG{}}
+
+	c.publishToKafka(context.Background(), http.DefaultClient, OrderMessage{OrderID: "o-1"})
+	if n := counterValue(t, reader, "app.messaging.published"); n != 1 {
+		t.Fatalf("app.messaging.published = %d after a delivered message, want 1", n)
+	}
+
+	config.FraudDetectionURL = statusServer(t, http.StatusInternalServerError).URL
+	c.publishToKafka(context.Background(), http.DefaultClient, OrderMessage{OrderID: "o-2"})
+	if n := counterValue(t, reader, "app.messaging.published"); n != 1 {
+		t.Fatalf("app.messaging.published = %d after a failed delivery, want it still 1", n)
+	}
+}
+
+func TestOrderPartitionMatchesWriterBalancer(t *testing.T) {
+	setForTest(t, &config.KafkaPartitions, 6)
+	setForTest(t, &config.KafkaBrokers, "localhost:9092")
+	w := newKafkaWriter()
+	partitions := []int{0, 1, 2, 3, 4, 5}
+
+	seen := map[int]bool{}
+	for i := range 50 {
+		orderID := fmt.Sprintf("order-%d", i)
+		p := orderPartition(orderID)
+		if again := orderPartition(orderID); again != p {
+			t.Fatalf("orderPartition(%s) = %d then %d, want it stable", orderID, p, again)
+		}
+		if got := w.Balancer.Balance(kafka.Message{Key: []byte(orderID)}, partitions...); got != p {
+			t.Fatalf("writer puts %s on partition %d, but spans report %d", orderID, got, p)
+		}
+		seen[p] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("50 orders all landed on partitions %v, want them spread", seen)
+	}
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"otel-mock/common"
+	"otel-mock/config"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Order lifecycle states, in the order placeOrder reaches them
+const (
+	orderPlaced    = "placed"
+	orderCharged   = "charged"
+	orderShipped   = "shipped"
+	orderConfirmed = "confirmed"
+)
+
+var orderStatuses = []string{orderPlaced, orderCharged, orderShipped, orderConfirmed}
+
+// OrderStatus is the GET /orders/{id} response: the latest state and when
+// each state so far was reached
+type OrderStatus struct {
+	OrderID    string               `json:"order_id"`
+	Status     string               `json:"status"`
+	Timestamps map[string]time.Time `json:"timestamps"`
+}
+
+// orderIDBaggageKey carries the order ID in baggage from placeOrder to every
+// downstream call, so shipping, email and the orders consumers can stamp
+// app.order.id without it being passed explicitly
+const orderIDBaggageKey = "order.id"
+
+// contextWithOrderID adds orderID to ctx's baggage, keeping existing members
+func contextWithOrderID(ctx context.Context, orderID string) context.Context {
+	m, err := baggage.NewMember(orderIDBaggageKey, orderID)
+	if err != nil {
+		return ctx
+	}
+	bag, err := baggage.FromContext(ctx).SetMember(m)
+	if err != nil {
+		return ctx
+	}
+	return baggage.ContextWithBaggage(ctx, bag)
+}
+
+// orderIDFromBaggage returns the order ID placeOrder put in baggage, or ""
+func orderIDFromBaggage(ctx context.Context) string {
+	return baggage.FromContext(ctx).Member(orderIDBaggageKey).Value()
+}
+
+func orderRedisKey(orderID string) string {
+	return "checkout:order:" + orderID
+}
+
+// recordOrderStatus stores status as the order's current state along with
+// the time it was reached. It is best-effort: the saga carries on when Redis
+// is unavailable, and batch mode (no Redis client) records nothing.
+func (c *checkoutService) recordOrderStatus(ctx context.Context, orderID, status string) {
+	if c.redis == nil {
+		return
+	}
+	key := orderRedisKey(orderID)
+	pipe := c.redis.TxPipeline()
+	pipe.HSet(ctx, key, "status", status, status+"_at", time.Now().UTC().Format(time.RFC3339Nano))
+	pipe.Expire(ctx, key, config.OrderStatusTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		common.RecordSpanError(trace.SpanFromContext(ctx), err)
+		checkoutLogger.WarnContext(ctx, "Failed to record order status", "order_id", orderID, "status", status, "error", err)
+	}
+}
+
+// getOrderHandler serves GET /orders/{id} from the statuses recorded by
+// placeOrder, answering 404 for orders it has no record of
+func (c *checkoutService) getOrderHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	span := trace.SpanFromContext(ctx)
+
+	orderID := r.PathValue("id")
+	span.SetAttributes(attribute.String("app.order.id", orderID))
+
+	fields, err := c.redis.HGetAll(ctx, orderRedisKey(orderID)).Result()
+	if err != nil {
+		common.RecordSpanError(span, err)
+		checkoutLogger.ErrorContext(ctx, "Failed to get order status", "order_id", orderID, "error", err)
+		http.Error(w, "Failed to get order status", http.StatusInternalServerError)
+		return
+	}
+	if len(fields) == 0 {
+		http.Error(w, "order not found", http.StatusNotFound)
+		return
+	}
+
+	status := OrderStatus{OrderID: orderID, Status: fields["status"], Timestamps: map[string]time.Time{}}
+	for _, s := range orderStatuses {
+		if at, err := time.Parse(time.RFC3339Nano, fields[s+"_at"]); err == nil {
+			status.Timestamps[s] = at
+		}
+	}
+	span.SetAttributes(attribute.String("app.order.status", status.Status))
+	checkoutLogger.InfoContext(ctx, "GetOrder", "order_id", orderID, "status", status.Status)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -1,15 +1,18 @@
 package services
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
 	"log/slog"
-	"math/rand"
 	"net/http"
+	"otel-mock/common"
+	"otel-mock/config"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 
-	"go.opentelemetry.io/contrib/bridges/otelslog"
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
-	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	otellog "go.opentelemetry.io/otel/log"
 	"go.opentelemetry.io/otel/metric"
@@ -20,6 +23,7 @@ var (
 	productLogger  *slog.Logger
 	productMeter   metric.Meter
 	productCounter metric.Int64Counter
+	productRand    RNG
 )
 
 // Mock product data
@@ -29,9 +33,12 @@ type Product struct {
 	Description string   `json:"description"`
 	Price       float64  `json:"price"`
 	Categories  []string `json:"categories"`
+	Weight      float64  `json:"-"` // popularity for GetWeightedProductID; 0 means 1
 }
 
-var products = []Product{
+// products is the built-in catalog, extended to PRODUCT_CATALOG_SIZE with
+// synthetic products
+var products = withSyntheticProducts([]Product{
 	{ID: "OLJCESPC7Z", Name: "Sunglasses", Description: "High quality sunglasses", Price: 19.99, Categories: []string{"accessories"}},
 	{ID: "66VCHSJNUP", Name: "Tank Top", Description: "Comfortable tank top", Price: 18.99, Categories: []string{"clothing"}},
 	{ID: "1YMWWN1N4O", Name: "Watch", Description: "Classic wristwatch", Price: 109.99, Categories: []string{"accessories"}},
@@ -41,10 +48,33 @@ var products = []Product{
 	{ID: "LS4PSXUNUM", Name: "Salt Shaker", Description: "Ceramic salt shaker", Price: 9.99, Categories: []string{"home"}},
 	{ID: "9SIQT8TOJO", Name: "Bamboo Glass Jar", Description: "Eco-friendly glass jar", Price: 14.99, Categories: []string{"home"}},
 	{ID: "6E92ZMYYFZ", Name: "Mug", Description: "Ceramic coffee mug", Price: 12.99, Categories: []string{"home"}},
+}, config.ProductCatalogSize)
+
+var syntheticCategories = []string{"accessories", "clothing", "footwear", "beauty", "home"}
+
+// withSyntheticProducts appends generated products to builtin until the
+// catalog holds size products. IDs, names, prices and categories derive from
+// the index alone, so every run and every service sees the same catalog.
+func withSyntheticProducts(builtin []Product, size int) []Product {
+	if size <= len(builtin) {
+		return builtin
+	}
+	catalog := make([]Product, len(builtin), size)
+	copy(catalog, builtin)
+	for i := 1; len(catalog) < size; i++ {
+		catalog = append(catalog, Product{
+			ID:          fmt.Sprintf("SYN%07d", i),
+			Name:        fmt.Sprintf("Synthetic Product %d", i),
+			Description: "Generated for catalog scale testing",
+			Price:       float64(499+(i*7919)%20000) / 100,
+			Categories:  []string{syntheticCategories[i%len(syntheticCategories)]},
+		})
+	}
+	return catalog
 }
 
-func initProductMetrics() {
-	productMeter = otel.Meter("product-catalog")
+func initProductMetrics(mp metric.MeterProvider) {
+	productMeter = mp.Meter("product-catalog")
 	var err error
 
 	productCounter, err = productMeter.Int64Counter("app.products.requests",
@@ -55,44 +85,58 @@ func initProductMetrics() {
 	}
 }
 
-func RunProductCatalogService(tp trace.TracerProvider, lp otellog.LoggerProvider) {
-	productLogger = otelslog.NewLogger("product-catalog", otelslog.WithLoggerProvider(lp))
-	initProductMetrics()
+func RunProductCatalogService(rng RNG, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) {
+	productRand = rng
+	productLogger = common.NewLogger("product-catalog", lp)
+	logEffectiveConfig(productLogger)
+	initProductMetrics(mp)
+
+	mux := newProductCatalogMux(tp)
+
+	port := ":8085"
+	productLogger.Info("Product Catalog Service starting", "port", port)
+	if err := common.ListenAndServe(common.NewServer(port, mux)); err != nil {
+		productLogger.Error("Product Catalog Service failed", "error", err)
+	}
+}
 
-	listHandler := otelhttp.NewHandler(
-		http.HandlerFunc(listProductsHandler),
+// newProductCatalogMux routes the catalog endpoints, each in its own server span
+func newProductCatalogMux(tp trace.TracerProvider) *http.ServeMux {
+	listHandler := common.NewHandler(
+		common.PadResponse(http.HandlerFunc(listProductsHandler)),
 		"ListProducts",
-		otelhttp.WithTracerProvider(tp),
+		tp,
 	)
 
-	getHandler := otelhttp.NewHandler(
-		http.HandlerFunc(getProductHandler),
+	getHandler := common.NewHandler(
+		common.PadResponse(http.HandlerFunc(getProductHandler)),
 		"GetProduct",
-		otelhttp.WithTracerProvider(tp),
+		tp,
 	)
 
-	searchHandler := otelhttp.NewHandler(
-		http.HandlerFunc(searchProductsHandler),
+	searchHandler := common.NewHandler(
+		common.PadResponse(http.HandlerFunc(searchProductsHandler)),
 		"SearchProducts",
-		otelhttp.WithTracerProvider(tp),
+		tp,
 	)
 
 	mux := http.NewServeMux()
 	mux.Handle("/products", listHandler)
 	mux.Handle("/products/", getHandler) // /products/{id}
 	mux.Handle("/products/search", searchHandler)
-
-	port := ":8085"
-	productLogger.Info("Product Catalog Service starting", "port", port)
-	if err := http.ListenAndServe(port, mux); err != nil {
-		productLogger.Error("Product Catalog Service failed", "error", err)
-	}
+	mux.HandleFunc("/health", healthHandler)
+	return mux
 }
 
 func listProductsHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	span := trace.SpanFromContext(ctx)
 
+	if category := r.URL.Query().Get("category"); category != "" {
+		listProductsByCategory(w, r, category)
+		return
+	}
+
 	span.SetAttributes(
 		attribute.Int("app.products.count", len(products)),
 		attribute.String("rpc.system", "grpc"),
@@ -108,7 +152,48 @@ func listProductsHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"products": %d}`, len(products))
+	json.NewEncoder(w).Encode(map[string]int{"products": len(products)})
+}
+
+// listProductsByCategory serves /products?category=<name> as a JSON array;
+// unknown categories yield an empty array rather than an error
+func listProductsByCategory(w http.ResponseWriter, r *http.Request, category string) {
+	ctx := r.Context()
+	span := trace.SpanFromContext(ctx)
+
+	results := productsInCategory(category)
+
+	span.SetAttributes(
+		attribute.String("app.products.category", category),
+		attribute.Int("app.products.count", len(results)),
+		attribute.String("rpc.system", "grpc"),
+		attribute.String("rpc.service", "oteldemo.ProductCatalogService"),
+		attribute.String("rpc.method", "ListProducts"),
+	)
+
+	productCounter.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("method", "ListProducts"),
+	))
+
+	productLogger.InfoContext(ctx, "ListProducts",
+		"category", category,
+		"count", len(results),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(results)
+}
+
+// productsInCategory returns the products tagged with category, never nil
+func productsInCategory(category string) []Product {
+	results := []Product{}
+	for _, p := range products {
+		if slices.Contains(p.Categories, category) {
+			results = append(results, p)
+		}
+	}
+	return results
 }
 
 func getProductHandler(w http.ResponseWriter, r *http.Request) {
@@ -135,6 +220,15 @@ func getProductHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// PRODUCT_NOTFOUND_RATE turns some lookups of real products into misses
+	// so error dashboards have a steady supply of 404s
+	simulatedMiss := found != nil && config.ProductNotFoundRate > 0 && productRand.Float64() < config.ProductNotFoundRate
+	if simulatedMiss {
+		span.SetAttributes(attribute.Bool("app.product.simulated_miss", true))
+		productLogger.WarnContext(ctx, "GetProduct simulated miss", "product_id", id)
+		found = nil
+	}
+
 	if found == nil {
 		span.SetAttributes(attribute.Bool("product.found", false))
 		productCounter.Add(ctx, 1, metric.WithAttributes(
@@ -162,7 +256,7 @@ func getProductHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"id": "%s", "name": "%s", "price": %.2f}`, found.ID, found.Name, found.Price)
+	json.NewEncoder(w).Encode(productResponse{ID: found.ID, Name: found.Name, Price: found.Price})
 }
 
 func searchProductsHandler(w http.ResponseWriter, r *http.Request) {
@@ -203,15 +297,76 @@ func searchProductsHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"query": "%s", "results": %d}`, query, len(results))
+	json.NewEncoder(w).Encode(searchResponse{Query: query, Results: len(results)})
+}
+
+// productResponse is the GetProduct response
+type productResponse struct {
+	ID    string  `json:"id"`
+	Name  string  `json:"name"`
+	Price float64 `json:"price"`
+}
+
+// searchResponse is the SearchProducts response
+type searchResponse struct {
+	Query   string `json:"query"`
+	Results int    `json:"results"`
 }
 
 // GetRandomProduct returns a random product for other services to use
-func GetRandomProduct() Product {
-	return products[rand.Intn(len(products))]
+func GetRandomProduct(rng RNG) Product {
+	return products[rng.Intn(len(products))]
 }
 
 // GetProductID returns a random product ID
-func GetProductID() string {
-	return products[rand.Intn(len(products))].ID
+func GetProductID(rng RNG) string {
+	return products[rng.Intn(len(products))].ID
+}
+
+var productWeightsOnce sync.Once
+
+// applyProductWeights sets product weights from PRODUCT_WEIGHTS
+func applyProductWeights() {
+	if config.ProductWeights == "" {
+		return
+	}
+	for _, entry := range strings.Split(config.ProductWeights, ",") {
+		id, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		weight, err := strconv.ParseFloat(value, 64)
+		if !ok || err != nil || weight < 0 {
+			log.Printf("Ignoring invalid product weight %q", entry)
+			continue
+		}
+		for i := range products {
+			if products[i].ID == id {
+				products[i].Weight = weight
+			}
+		}
+	}
+}
+
+func productWeight(p Product) float64 {
+	if p.Weight == 0 {
+		return 1
+	}
+	return p.Weight
+}
+
+// GetWeightedProductID returns a random product ID, picking popular products
+// more often according to their weights
+func GetWeightedProductID(rng RNG) string {
+	productWeightsOnce.Do(applyProductWeights)
+
+	total := 0.0
+	for _, p := range products {
+		total += productWeight(p)
+	}
+	r := rng.Float64() * total
+	for _, p := range products {
+		r -= productWeight(p)
+		if r < 0 {
+			return p.ID
+		}
+	}
+	return products[len(products)-1].ID
 }
@@ -0,0 +1,214 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"otel-mock/config"
+
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+)
+
+// useTestCatalog sets up the product catalog's globals for handler tests
+func useTestCatalog(t *testing.T) {
+	t.Helper()
+	setForTest(t, &productLogger, discardLogger)
+	setForTest(t, &productRand, RNG(fixedRNG{}))
+	initProductMetrics(metricnoop.NewMeterProvider())
+}
+
+// getJSON serves target with h and decodes the 200 response into v
+func getJSON(t *testing.T, h http.HandlerFunc, target string, v any) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest("GET", target, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s returned %d: %s", target, rec.Code, rec.Body)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("%s returned invalid JSON: %v\n%s", target, err, rec.Body)
+	}
+}
+
+func TestProductNameWithQuotesIsValidJSON(t *testing.T) {
+	useTestCatalog(t)
+	name := `12" Vinyl "Deluxe" \ Edition`
+	setForTest(t, &products, []Product{{ID: "VINYL", Name: name, Price: 29.99}})
+
+	var got productResponse
+	getJSON(t, getProductHandler, "/products/VINYL", &got)
+
+	if got.Name != name || got.Price != 29.99 {
+		t.Fatalf("product = %+v, want name %q at 29.99", got, name)
+	}
+}
+
+func TestSearchQueryWithQuotesIsValidJSON(t *testing.T) {
+	useTestCatalog(t)
+	query := `sun"glasses`
+
+	var got searchResponse
+	getJSON(t, searchProductsHandler, "/products/search?q="+url.QueryEscape(query), &got)
+
+	if got.Query != query || got.Results != 0 {
+		t.Fatalf("search = %+v, want query %q echoed with no results", got, query)
+	}
+}
+
+func TestCatalogReportsSyntheticProducts(t *testing.T) {
+	useTestCatalog(t)
+	builtin := products[:9]
+	setForTest(t, &products, withSyntheticProducts(builtin, 1000))
+
+	var listed map[string]int
+	getJSON(t, listProductsHandler, "/products", &listed)
+	if listed["products"] != 1000 {
+		t.Fatalf("catalog lists %d products, want 1000", listed["products"])
+	}
+
+	ids := map[string]bool{}
+	for _, p := range products {
+		if ids[p.ID] {
+			t.Fatalf("duplicate product ID %s", p.ID)
+		}
+		ids[p.ID] = true
+	}
+	var got productResponse
+	getJSON(t, getProductHandler, "/products/SYN0000991", &got)
+	if got.Name != "Synthetic Product 991" {
+		t.Fatalf("last synthetic product = %+v, want Synthetic Product 991", got)
+	}
+}
+
+func TestSyntheticProductsAreStable(t *testing.T) {
+	builtin := []Product{{ID: "A"}, {ID: "B"}}
+
+	if got := withSyntheticProducts(builtin, 1); len(got) != 2 {
+		t.Fatalf("size below the built-in catalog gave %d products, want the 2 built-in", len(got))
+	}
+	a, b := withSyntheticProducts(builtin, 50), withSyntheticProducts(builtin, 50)
+	if !reflect.DeepEqual(a, b) {
+		t.Fatal("synthetic catalog differs between builds")
+	}
+	if len(builtin) != 2 {
+		t.Fatal("built-in catalog was modified")
+	}
+}
+
+// pickShares draws n weighted product IDs and returns each ID's share
+func pickShares(n int) map[string]float64 {
+	rng := NewRNG(1)
+	shares := map[string]float64{}
+	for range n {
+		shares[GetWeightedProductID(rng)] += 1 / float64(n)
+	}
+	return shares
+}
+
+func TestWeightedProductSelectionFollowsWeights(t *testing.T) {
+	setForTest(t, &products, []Product{{ID: "A", Weight: 8}, {ID: "B", Weight: 1}, {ID: "C", Weight: 1}})
+
+	shares := pickShares(20000)
+	for id, want := range map[string]float64{"A": 0.8, "B": 0.1, "C": 0.1} {
+		if math.Abs(shares[id]-want) > 0.02 {
+			t.Errorf("%s picked %.3f of the time, want %.2f", id, shares[id], want)
+		}
+	}
+}
+
+func TestUnweightedProductSelectionIsUniform(t *testing.T) {
+	setForTest(t, &products, []Product{{ID: "A"}, {ID: "B"}, {ID: "C"}, {ID: "D"}})
+
+	shares := pickShares(20000)
+	for _, id := range []string{"A", "B", "C", "D"} {
+		if math.Abs(shares[id]-0.25) > 0.02 {
+			t.Errorf("%s picked %.3f of the time, want 0.25", id, shares[id])
+		}
+	}
+}
+
+func TestListProductsByCategory(t *testing.T) {
+	tests := []struct {
+		category string
+		wantIDs  []string
+	}{
+		{category: "home", wantIDs: []string{"0PUK6V6EV0", "LS4PSXUNUM", "9SIQT8TOJO", "6E92ZMYYFZ"}},
+		{category: "accessories", wantIDs: []string{"OLJCESPC7Z", "1YMWWN1N4O"}},
+		{category: "garden", wantIDs: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.category, func(t *testing.T) {
+			useTestCatalog(t)
+			tp, sr := newTestTracerProvider(t)
+			ctx, span := tp.Tracer("product-catalog").Start(context.Background(), "ListProducts")
+
+			var got []Product
+			getJSON(t, func(w http.ResponseWriter, r *http.Request) {
+				listProductsHandler(w, r.WithContext(ctx))
+			}, "/products?category="+tt.category, &got)
+			span.End()
+			if got == nil {
+				t.Fatal("products = null, want an array")
+			}
+
+			ids := []string{}
+			for _, p := range got {
+				ids = append(ids, p.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Fatalf("products = %v, want %v", ids, tt.wantIDs)
+			}
+			if v := spanAttr(t, sr, "ListProducts", "app.products.category"); v.AsString() != tt.category {
+				t.Fatalf("app.products.category = %q, want %q", v.AsString(), tt.category)
+			}
+			if v := spanAttr(t, sr, "ListProducts", "app.products.count"); v.AsInt64() != int64(len(tt.wantIDs)) {
+				t.Fatalf("app.products.count = %d, want %d", v.AsInt64(), len(tt.wantIDs))
+			}
+		})
+	}
+}
+
+func TestProductNotFoundRate(t *testing.T) {
+	for _, rate := range []float64{0, 0.3} {
+		t.Run(fmt.Sprintf("rate=%v", rate), func(t *testing.T) {
+			useTestCatalog(t)
+			setForTest(t, &productRand, NewRNG(1))
+			setForTest(t, &config.ProductNotFoundRate, rate)
+			tp, sr := newTestTracerProvider(t)
+
+			const n = 5000
+			misses := 0
+			for range n {
+				ctx, span := tp.Tracer("product-catalog").Start(context.Background(), "GET /products/{id}")
+				rec := httptest.NewRecorder()
+				getProductHandler(rec, httptest.NewRequest("GET", "/products/"+products[0].ID, nil).WithContext(ctx))
+				span.End()
+				if rec.Code == http.StatusNotFound {
+					misses++
+				}
+			}
+
+			if share := float64(misses) / n; math.Abs(share-rate) > 0.02 {
+				t.Fatalf("%d of %d lookups of a real product missed (%.3f), want about %.2f", misses, n, share, rate)
+			}
+			marked := 0
+			for _, s := range sr.Ended() {
+				for _, kv := range s.Attributes() {
+					if kv.Key == "app.product.simulated_miss" && kv.Value.AsBool() {
+						marked++
+					}
+				}
+			}
+			if marked != misses {
+				t.Fatalf("%d spans marked app.product.simulated_miss, want all %d misses", marked, misses)
+			}
+		})
+	}
+}
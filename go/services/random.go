@@ -0,0 +1,52 @@
+package services
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// RNG is the source of all mock data and simulated behavior. Each service is
+// given its own so tests can inject a fixed sequence.
+type RNG interface {
+	Intn(n int) int
+	Float32() float32
+	Float64() float64
+}
+
+// lockedRand is a *rand.Rand that is safe for concurrent handlers
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+// NewRNG returns a concurrency-safe RNG seeded with seed
+func NewRNG(seed int64) RNG {
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+func (l *lockedRand) Intn(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Intn(n)
+}
+
+func (l *lockedRand) Float32() float32 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Float32()
+}
+
+func (l *lockedRand) Float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Float64()
+}
+
+func randomString(rng RNG, n int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[rng.Intn(len(letters))]
+	}
+	return string(b)
+}
@@ -0,0 +1,42 @@
+package services
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"otel-mock/config"
+)
+
+// seededRun draws the product IDs and fraud decisions a run seeded with seed
+// would produce
+func seededRun(seed int64) (productIDs []string, fraud []bool) {
+	products := NewRNG(seed)
+	s := newTestFraudService(NewRNG(seed))
+	for i := range 20 {
+		productIDs = append(productIDs, GetProductID(products))
+		isFraud, _ := s.evaluateFraudRules(fmt.Sprintf("u-%d", i), 50)
+		fraud = append(fraud, isFraud)
+	}
+	return productIDs, fraud
+}
+
+func TestSameSeedReproducesRun(t *testing.T) {
+	setForTest(t, &config.FraudAmountThreshold, 0)
+	setForTest(t, &config.FraudVelocityLimit, 0)
+	setForTest(t, &config.FraudRate, 0.5)
+
+	firstIDs, firstFraud := seededRun(42)
+	secondIDs, secondFraud := seededRun(42)
+	if !reflect.DeepEqual(firstIDs, secondIDs) {
+		t.Fatalf("product IDs differ with the same seed:\n%v\n%v", firstIDs, secondIDs)
+	}
+	if !reflect.DeepEqual(firstFraud, secondFraud) {
+		t.Fatalf("fraud decisions differ with the same seed:\n%v\n%v", firstFraud, secondFraud)
+	}
+
+	otherIDs, otherFraud := seededRun(43)
+	if reflect.DeepEqual(firstIDs, otherIDs) && reflect.DeepEqual(firstFraud, otherFraud) {
+		t.Fatal("a different seed reproduced the same run")
+	}
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateCache is an LRU of computed conversion rates keyed "from:to", each
+// valid for ttl after it was stored
+type rateCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+
+	hits, misses atomic.Int64
+}
+
+type cachedRate struct {
+	key     string
+	rate    float64
+	expires time.Time
+}
+
+func newRateCache(size int, ttl time.Duration) *rateCache {
+	return &rateCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func rateCacheKey(from, to string) string {
+	return from + ":" + to
+}
+
+// get returns the cached rate for from:to, counting the lookup as a hit or
+// miss. Expired entries are evicted and count as misses.
+func (c *rateCache) get(from, to string) (float64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[rateCacheKey(from, to)]; ok {
+		entry := el.Value.(*cachedRate)
+		if time.Now().Before(entry.expires) {
+			c.order.MoveToFront(el)
+			c.hits.Add(1)
+			return entry.rate, true
+		}
+		c.order.Remove(el)
+		delete(c.entries, entry.key)
+	}
+	c.misses.Add(1)
+	return 0, false
+}
+
+// put stores rate for from:to, evicting the least recently used entry when
+// the cache is full
+func (c *rateCache) put(from, to string, rate float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := rateCacheKey(from, to)
+	expires := time.Now().Add(c.ttl)
+	if el, ok := c.entries[key]; ok {
+		el.Value = &cachedRate{key: key, rate: rate, expires: expires}
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cachedRate{key: key, rate: rate, expires: expires})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedRate).key)
+	}
+}
+
+// hitRatio is hits over lookups so far, 0 before the first lookup
+func (c *rateCache) hitRatio() float64 {
+	hits, misses := c.hits.Load(), c.misses.Load()
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
@@ -1,21 +1,29 @@
 package services
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
-	"math/rand"
+	"math"
 	"net/http"
+	"net/url"
+	"otel-mock/common"
 	"otel-mock/config"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
-	"go.opentelemetry.io/contrib/bridges/otelslog"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
-	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	otellog "go.opentelemetry.io/otel/log"
 	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
 )
 
@@ -25,10 +33,15 @@ var (
 	shippingMeter       metric.Meter
 	shippingItemsCount  metric.Int64Counter
 	shippingQuoteMetric metric.Float64Histogram
+	shippingQuoteSource metric.Int64Counter
+	quoteClient         *http.Client
+	shippingRand        RNG
+	// shippingClock times quote calculation; tests may replace it
+	shippingClock Clock = SystemClock
 )
 
-func initShippingMetrics() {
-	shippingMeter = otel.Meter("shipping")
+func initShippingMetrics(mp metric.MeterProvider) {
+	shippingMeter = mp.Meter("shipping")
 	var err error
 
 	shippingItemsCount, err = shippingMeter.Int64Counter("app.shipping.items_count",
@@ -44,34 +57,60 @@ func initShippingMetrics() {
 	if err != nil {
 		panic(err)
 	}
+
+	shippingQuoteSource, err = shippingMeter.Int64Counter("app.shipping.quote.source",
+		metric.WithDescription("Quotes by source: external quote service or local fallback"),
+		metric.WithUnit("{quotes}"))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// newQuoteClient builds shipping's client for quote and currency calls. It
+// pins W3C propagation so they stay linked to this trace even when no global
+// propagator has been installed.
+func newQuoteClient(tp trace.TracerProvider, mp metric.MeterProvider) *http.Client {
+	return common.NewHTTPClient(tp, mp, otelhttp.WithPropagators(
+		propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}),
+	))
 }
 
-func RunShippingService(tp trace.TracerProvider, lp otellog.LoggerProvider) {
-	shippingLogger = otelslog.NewLogger("shipping", otelslog.WithLoggerProvider(lp))
+func RunShippingService(rng RNG, tp trace.TracerProvider, mp metric.MeterProvider, lp otellog.LoggerProvider) {
+	shippingRand = rng
+	shippingLogger = common.NewLogger("shipping", lp)
+	logEffectiveConfig(shippingLogger)
 	shippingTracer = tp.Tracer("shipping")
-	initShippingMetrics()
+	initShippingMetrics(mp)
+	quoteClient = newQuoteClient(tp, mp)
+
+	mux := newShippingMux(tp)
 
-	handler := otelhttp.NewHandler(
+	port := ":8082"
+	shippingLogger.Info("Shipping Service starting", "port", port)
+	if err := common.ListenAndServe(common.NewServer(port, mux)); err != nil {
+		shippingLogger.Error("Shipping Service failed", "error", err)
+	}
+}
+
+// newShippingMux routes the shipping endpoints, each in its own server span
+func newShippingMux(tp trace.TracerProvider) *http.ServeMux {
+	handler := common.NewHandler(
 		http.HandlerFunc(shipHandler),
 		"ship",
-		otelhttp.WithTracerProvider(tp),
+		tp,
 	)
 
-	quoteHandler := otelhttp.NewHandler(
+	quoteHandler := common.NewHandler(
 		http.HandlerFunc(getQuoteHandler),
 		"get-quote",
-		otelhttp.WithTracerProvider(tp),
+		tp,
 	)
 
 	mux := http.NewServeMux()
 	mux.Handle("/ship", handler)
 	mux.Handle("/get-quote", quoteHandler)
-
-	port := ":8082"
-	shippingLogger.Info("Shipping Service starting", "port", port)
-	if err := http.ListenAndServe(port, mux); err != nil {
-		shippingLogger.Error("Shipping Service failed", "error", err)
-	}
+	mux.HandleFunc("/health", healthHandler)
+	return mux
 }
 
 func shipHandler(w http.ResponseWriter, r *http.Request) {
@@ -79,15 +118,44 @@ func shipHandler(w http.ResponseWriter, r *http.Request) {
 	span := trace.SpanFromContext(ctx)
 
 	shippingLogger.InfoContext(ctx, "Processing shipping request")
+	if orderID := orderIDFromBaggage(ctx); orderID != "" {
+		span.SetAttributes(attribute.String("app.order.id", orderID))
+	}
 
-	// Create quote from count (like Rust shipping service)
-	itemCount := rand.Intn(5) + 1
-	quote, err := createQuoteFromCount(ctx, itemCount)
-	if err != nil {
-		span.RecordError(err)
-		http.Error(w, "Failed to calculate quote", http.StatusInternalServerError)
+	var shipReq ShipRequest
+	if err := json.NewDecoder(r.Body).Decode(&shipReq); err != nil && err != io.EOF {
+		http.Error(w, fmt.Sprintf("invalid ship request: %v", err), http.StatusBadRequest)
 		return
 	}
+	if shipReq.Address != nil {
+		if err := validateAddress(ctx, *shipReq.Address); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Create quote from count (like Rust shipping service)
+	itemCount := shippingRand.Intn(5) + 1
+	var quote float64
+	currency := r.URL.Query().Get("currency")
+	if freeShipping(ctx, span, r) {
+		currency = cmp.Or(currency, "USD")
+	} else {
+		surcharge := 0.0
+		if shipReq.Address != nil {
+			surcharge = internationalSurchargeFor(shipReq.Address.Country)
+		}
+		var err error
+		quote, currency, err = createQuoteFromCount(ctx, itemCount, surcharge, currency)
+		if err != nil {
+			common.RecordSpanError(span, err)
+			http.Error(w, "Failed to calculate quote", http.StatusInternalServerError)
+			return
+		}
+	}
+	if shipReq.Address != nil {
+		span.SetAttributes(attribute.String("app.shipping.address.country", shipReq.Address.Country))
+	}
 
 	trackingID := uuid.New().String()
 
@@ -106,23 +174,128 @@ func shipHandler(w http.ResponseWriter, r *http.Request) {
 		"tracking_id", trackingID,
 		"items", itemCount,
 		"quote", quote,
+		"currency", currency,
 	)
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"tracking_id": "%s", "cost": %.2f}`, trackingID, quote)
+	json.NewEncoder(w).Encode(shipResponse{TrackingID: trackingID, Cost: math.Round(quote*100) / 100, Currency: currency})
+}
+
+// shipResponse is the /ship response
+type shipResponse struct {
+	TrackingID string  `json:"tracking_id"`
+	Cost       float64 `json:"cost"`
+	Currency   string  `json:"currency"`
+}
+
+// freeShipping reports whether the request's amount param exceeds
+// FREE_SHIPPING_THRESHOLD, in which case the quote is zero and no quote is
+// calculated. The threshold is in USD, so amounts in another currency param
+// are converted through the currency service first; if that fails the order
+// pays for shipping. The decision is recorded on span either way.
+func freeShipping(ctx context.Context, span trace.Span, r *http.Request) bool {
+	if config.FreeShippingThreshold <= 0 {
+		return false
+	}
+	amount, err := strconv.ParseFloat(r.URL.Query().Get("amount"), 64)
+	if err != nil {
+		span.SetAttributes(attribute.Bool("app.shipping.free", false))
+		return false
+	}
+
+	amountUSD := amount
+	if currency := r.URL.Query().Get("currency"); currency != "" && currency != "USD" {
+		rate, err := fetchRate(ctx, currency, "USD")
+		if err != nil {
+			shippingLogger.WarnContext(ctx, "Cannot price order in USD, charging for shipping", "currency", currency, "error", err)
+			span.SetAttributes(attribute.Bool("app.shipping.free", false))
+			return false
+		}
+		amountUSD = amount * rate
+	}
+
+	free := amountUSD > config.FreeShippingThreshold
+	span.SetAttributes(attribute.Bool("app.shipping.free", free))
+	if free {
+		span.AddEvent("free_shipping_applied", trace.WithAttributes(
+			attribute.Float64("app.shipping.order.amount", amount),
+			attribute.Float64("app.shipping.order.amount_usd", amountUSD),
+			attribute.Float64("app.shipping.free.threshold", config.FreeShippingThreshold),
+		))
+	}
+	return free
+}
+
+// ShipRequest is the optional /ship body; without an address the order ships
+// domestically
+type ShipRequest struct {
+	Address *Address `json:"address"`
+}
+
+// Address is a shipping destination; Country is an ISO 3166-1 alpha-2 code
+type Address struct {
+	StreetAddress string `json:"street_address"`
+	City          string `json:"city"`
+	State         string `json:"state"`
+	Country       string `json:"country"`
+	ZipCode       string `json:"zip_code"`
+}
+
+// Orders shipped outside domesticCountry pay internationalSurcharge on top of
+// the quote
+const (
+	domesticCountry        = "US"
+	internationalSurcharge = 15.0
+)
+
+// validateAddress checks the fields a quote needs under a validateAddress span
+func validateAddress(ctx context.Context, addr Address) error {
+	ctx, span := shippingTracer.Start(ctx, "validateAddress")
+	defer span.End()
+
+	var err error
+	switch {
+	case len(addr.Country) != 2:
+		err = fmt.Errorf("invalid country %q: want a 2-letter code", addr.Country)
+	case addr.ZipCode == "":
+		err = errors.New("missing postal code")
+	}
+
+	span.SetAttributes(attribute.Bool("app.shipping.address.valid", err == nil))
+	if err != nil {
+		common.RecordSpanError(span, err)
+		shippingLogger.WarnContext(ctx, "Invalid shipping address", "error", err)
+	}
+	return err
+}
+
+// internationalSurchargeFor returns the surcharge for shipping to country
+func internationalSurchargeFor(country string) float64 {
+	if strings.EqualFold(country, domesticCountry) {
+		return 0
+	}
+	return internationalSurcharge
 }
 
 func getQuoteHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	span := trace.SpanFromContext(ctx)
 
-	itemCount := rand.Intn(10) + 1
-
-	quote, err := createQuoteFromCount(ctx, itemCount)
-	if err != nil {
-		span.RecordError(err)
-		http.Error(w, "Failed to calculate quote", http.StatusInternalServerError)
-		return
+	itemCount := shippingRand.Intn(10) + 1
+
+	var quote float64
+	currency := r.URL.Query().Get("currency")
+	if freeShipping(ctx, span, r) {
+		currency = cmp.Or(currency, "USD")
+	} else {
+		var err error
+		quote, currency, err = createQuoteFromCount(ctx, itemCount, 0, currency)
+		if err != nil {
+			common.RecordSpanError(span, err)
+			http.Error(w, "Failed to calculate quote", http.StatusInternalServerError)
+			return
+		}
 	}
 
 	span.SetAttributes(
@@ -130,45 +303,118 @@ func getQuoteHandler(w http.ResponseWriter, r *http.Request) {
 		attribute.Float64("app.quote.cost.total", quote),
 	)
 
-	shippingLogger.InfoContext(ctx, "GetQuote", "items", itemCount, "quote", quote)
+	shippingLogger.InfoContext(ctx, "GetQuote", "items", itemCount, "quote", quote, "currency", currency)
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"quote": %.2f, "items": %d}`, quote, itemCount)
+	json.NewEncoder(w).Encode(quoteResponse{Quote: math.Round(quote*100) / 100, Items: itemCount, Currency: currency})
 }
 
-func createQuoteFromCount(ctx context.Context, count int) (float64, error) {
-	start := time.Now()
+// quoteResponse is the /get-quote response
+type quoteResponse struct {
+	Quote    float64 `json:"quote"`
+	Items    int     `json:"items"`
+	Currency string  `json:"currency"`
+}
+
+// createQuoteFromCount quotes count items in USD, adds surcharge (also USD)
+// and converts the total into currency, returning the currency actually used
+// (USD when conversion fails)
+func createQuoteFromCount(ctx context.Context, count int, surcharge float64, currency string) (float64, string, error) {
+	start := shippingClock.Now()
 
 	ctx, span := shippingTracer.Start(ctx, "createQuoteFromCount",
 		trace.WithSpanKind(trace.SpanKindClient))
 	defer span.End()
 
+	quote, err := quoteUSD(ctx, span, count, start)
+	if err != nil {
+		return 0, "", err
+	}
+	if surcharge > 0 {
+		quote += surcharge
+		span.SetAttributes(attribute.Float64("app.shipping.surcharge", surcharge))
+	}
+
+	converted, currency := convertQuote(ctx, quote, currency)
+	span.SetAttributes(
+		attribute.String("app.shipping.cost.currency", currency),
+		attribute.Float64("app.shipping.cost.converted", converted),
+	)
+	return converted, currency, nil
+}
+
+// convertQuote converts a USD quote via the currency service, falling back to
+// USD when currency is empty or the service can't be reached
+func convertQuote(ctx context.Context, quote float64, currency string) (float64, string) {
+	if currency == "" || currency == "USD" {
+		return quote, "USD"
+	}
+	rate, err := fetchRate(ctx, "USD", currency)
+	if err != nil {
+		shippingLogger.WarnContext(ctx, "Currency conversion failed, quoting in USD", "currency", currency, "error", err)
+		return quote, "USD"
+	}
+	return quote * rate, currency
+}
+
+// fetchRate asks the currency service for the from->to exchange rate
+func fetchRate(ctx context.Context, from, to string) (float64, error) {
+	u := fmt.Sprintf("%s/convert?from=%s&to=%s", config.CurrencyURL, url.QueryEscape(from), url.QueryEscape(to))
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := quoteClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Rate float64 `json:"rate"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&res) != nil || res.Rate <= 0 {
+		return 0, fmt.Errorf("unusable currency service response (status %d)", resp.StatusCode)
+	}
+	return res.Rate, nil
+}
+
+// quoteUSD prices count items via the quote service, or locally when it's down
+func quoteUSD(ctx context.Context, span trace.Span, count int, start time.Time) (float64, error) {
 	shippingLogger.InfoContext(ctx, "CreateQuoteFromCount", "items", count)
 
 	// Record items metric
 	shippingItemsCount.Add(ctx, int64(count))
 
 	// Call external quote service (Python FastAPI) with OTel trace context propagation
-	client := &http.Client{
-		Timeout:   30 * time.Second,
-		Transport: otelhttp.NewTransport(http.DefaultTransport),
-	}
-	req, err := http.NewRequestWithContext(ctx, "POST", config.QuoteURL+"/quote", nil)
+	body, _ := json.Marshal(map[string]int{"numberOfItems": count})
+	req, err := http.NewRequestWithContext(ctx, "POST", config.QuoteURL+"/quote", bytes.NewReader(body))
 	if err != nil {
-		span.RecordError(err)
+		common.RecordSpanError(span, err)
 		// Fallback to local calculation
 		return calculateQuoteLocally(ctx, span, count, start)
 	}
+	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := client.Do(req)
+	resp, err := quoteClient.Do(req)
 	if err != nil {
-		span.RecordError(err)
+		common.RecordSpanError(span, err)
 		shippingLogger.WarnContext(ctx, "QuoteService unavailable, using fallback", "error", err)
 		return calculateQuoteLocally(ctx, span, count, start)
 	}
 	defer resp.Body.Close()
 
-	quote := 5.99 + (float64(count) * 1.50) + float64(rand.Intn(300))/100.0
+	var res struct {
+		CostUSD *float64 `json:"cost_usd"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&res) != nil || res.CostUSD == nil {
+		err := fmt.Errorf("unusable quote service response (status %d)", resp.StatusCode)
+		common.RecordSpanError(span, err)
+		shippingLogger.WarnContext(ctx, "QuoteService response unusable, using fallback", "error", err)
+		return calculateQuoteLocally(ctx, span, count, start)
+	}
+	quote := *res.CostUSD
 
 	span.SetAttributes(
 		attribute.Int("quote.items.count", count),
@@ -181,8 +427,9 @@ func createQuoteFromCount(ctx context.Context, count int) (float64, error) {
 	))
 
 	shippingLogger.InfoContext(ctx, "QuoteReceived", "items", count, "quote", quote)
+	shippingQuoteSource.Add(ctx, 1, metric.WithAttributes(attribute.String("source", "external")))
 
-	duration := float64(time.Since(start).Milliseconds())
+	duration := float64(shippingClock.Since(start).Milliseconds())
 	shippingQuoteMetric.Record(ctx, duration)
 
 	return quote, nil
@@ -191,9 +438,13 @@ func createQuoteFromCount(ctx context.Context, count int) (float64, error) {
 func calculateQuoteLocally(ctx context.Context, span trace.Span, count int, start time.Time) (float64, error) {
 	baseRate := 5.99
 	perItemRate := 1.50
-	quote := baseRate + (float64(count) * perItemRate) + float64(rand.Intn(300))/100.0
+	quote := baseRate + (float64(count) * perItemRate)
+	if !config.QuoteDeterministic {
+		quote += float64(shippingRand.Intn(300)) / 100.0
+	}
 
 	span.SetAttributes(
+		attribute.Bool("app.quote.deterministic", config.QuoteDeterministic),
 		attribute.Int("quote.items.count", count),
 		attribute.Float64("quote.base_rate", baseRate),
 		attribute.Float64("quote.per_item_rate", perItemRate),
@@ -206,8 +457,9 @@ func calculateQuoteLocally(ctx context.Context, span trace.Span, count int, star
 	))
 
 	shippingLogger.InfoContext(ctx, "QuoteCalculatedLocally", "items", count, "quote", quote)
+	shippingQuoteSource.Add(ctx, 1, metric.WithAttributes(attribute.String("source", "local")))
 
-	duration := float64(time.Since(start).Milliseconds())
+	duration := float64(shippingClock.Since(start).Milliseconds())
 	shippingQuoteMetric.Record(ctx, duration)
 
 	return quote, nil
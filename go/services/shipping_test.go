@@ -0,0 +1,275 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"otel-mock/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// useTestShipping sets up shipping's globals with a recording tracer
+func useTestShipping(t *testing.T, rng RNG) *tracetest.SpanRecorder {
+	t.Helper()
+	tp, sr := newTestTracerProvider(t)
+	setForTest(t, &shippingRand, rng)
+	setForTest(t, &shippingLogger, discardLogger)
+	setForTest(t, &shippingTracer, trace.Tracer(tp.Tracer("shipping")))
+	setForTest(t, &quoteClient, http.DefaultClient)
+	initShippingMetrics(metricnoop.NewMeterProvider())
+	return sr
+}
+
+// jsonServer answers every request with body and is closed with the test
+func jsonServer(t *testing.T, body string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// unreachableURL is the address of a server that has already shut down
+func unreachableURL(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	return srv.URL
+}
+
+// spanAttr returns the named attribute of the first ended span called name
+func spanAttr(t *testing.T, sr *tracetest.SpanRecorder, name string, key attribute.Key) attribute.Value {
+	t.Helper()
+	for _, s := range sr.Ended() {
+		if s.Name() != name {
+			continue
+		}
+		for _, kv := range s.Attributes() {
+			if kv.Key == key {
+				return kv.Value
+			}
+		}
+		t.Fatalf("span %s has no %s attribute", name, key)
+	}
+	t.Fatalf("no %s span was recorded", name)
+	return attribute.Value{}
+}
+
+func ship(t *testing.T, query, body string) shipResponse {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	shipHandler(rec, httptest.NewRequest("POST", "/ship?"+query, strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/ship returned %d: %s", rec.Code, rec.Body)
+	}
+	var resp shipResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestShipConvertsQuoteWithSurcharge(t *testing.T) {
+	sr := useTestShipping(t, fixedRNG{n: 1})
+	setForTest(t, &config.FreeShippingThreshold, 0)
+	setForTest(t, &config.QuoteURL, jsonServer(t, `{"cost_usd": 10}`).URL)
+	setForTest(t, &config.CurrencyURL, jsonServer(t, `{"rate": 2}`).URL)
+
+	resp := ship(t, "currency=EUR", `{"address":{"country":"DE","zip_code":"10115"}}`)
+
+	// (10 USD quote + 15 USD surcharge) * 2
+	if resp.Cost != 50 || resp.Currency != "EUR" {
+		t.Fatalf("cost = %v %s, want 50 EUR", resp.Cost, resp.Currency)
+	}
+	if got := spanAttr(t, sr, "createQuoteFromCount", "app.shipping.cost.converted").AsFloat64(); got != 50 {
+		t.Fatalf("app.shipping.cost.converted = %v, want 50 including the surcharge", got)
+	}
+}
+
+func TestShipFallsBackToUSDWhenCurrencyIsDown(t *testing.T) {
+	sr := useTestShipping(t, fixedRNG{n: 1})
+	setForTest(t, &config.FreeShippingThreshold, 0)
+	setForTest(t, &config.QuoteURL, jsonServer(t, `{"cost_usd": 10}`).URL)
+	setForTest(t, &config.CurrencyURL, unreachableURL(t))
+
+	resp := ship(t, "currency=EUR", `{"address":{"country":"DE","zip_code":"10115"}}`)
+
+	if resp.Cost != 25 || resp.Currency != "USD" {
+		t.Fatalf("cost = %v %s, want 25 USD", resp.Cost, resp.Currency)
+	}
+	if got := spanAttr(t, sr, "createQuoteFromCount", "app.shipping.cost.currency").AsString(); got != "USD" {
+		t.Fatalf("app.shipping.cost.currency = %s, want USD", got)
+	}
+}
+
+func TestQuoteUsesQuoteServiceResult(t *testing.T) {
+	sr := useTestShipping(t, fixedRNG{n: 1})
+	setForTest(t, &config.FreeShippingThreshold, 0)
+	setForTest(t, &config.QuoteURL, jsonServer(t, `{"cost_usd": 12.34}`).URL)
+
+	quote, currency, err := createQuoteFromCount(context.Background(), 3, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quote != 12.34 || currency != "USD" {
+		t.Fatalf("quote = %v %s, want the quote service's 12.34 USD", quote, currency)
+	}
+	if !spanAttr(t, sr, "createQuoteFromCount", "quote.external_service").AsBool() {
+		t.Fatal("quote not attributed to the external service")
+	}
+}
+
+func TestQuoteFallsBackLocally(t *testing.T) {
+	for name, quoteURL := range map[string]func(*testing.T) string{
+		"unreachable":   unreachableURL,
+		"bad response":  func(t *testing.T) string { return jsonServer(t, `{"price": 1}`).URL },
+		"server errors": func(t *testing.T) string { return statusServer(t, http.StatusInternalServerError).URL },
+	} {
+		t.Run(name, func(t *testing.T) {
+			useTestShipping(t, fixedRNG{n: 1})
+			setForTest(t, &config.QuoteDeterministic, true)
+			setForTest(t, &config.QuoteURL, quoteURL(t))
+
+			quote, _, err := createQuoteFromCount(context.Background(), 2, 0, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 5.99 base + 2 * 1.50 per item
+			if quote != 8.99 {
+				t.Fatalf("quote = %v, want the local 8.99", quote)
+			}
+		})
+	}
+}
+
+func TestFreeShippingComparesInUSD(t *testing.T) {
+	useTestShipping(t, fixedRNG{})
+	setForTest(t, &config.FreeShippingThreshold, 100)
+	jpyToUSD := jsonServer(t, `{"rate": 0.009}`).URL
+
+	tests := []struct {
+		name, query, currencyURL string
+		want                     bool
+	}{
+		{"USD above", "amount=150", "", true},
+		{"USD below", "amount=50&currency=USD", "", false},
+		{"JPY above once converted", "amount=20000&currency=JPY", jpyToUSD, true},
+		{"JPY number above but USD below", "amount=5000&currency=JPY", jpyToUSD, false},
+		{"currency unreachable", "amount=20000&currency=JPY", unreachableURL(t), false},
+		{"no amount", "currency=USD", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setForTest(t, &config.CurrencyURL, tt.currencyURL)
+			ctx, span := shippingTracer.Start(context.Background(), "ship")
+			defer span.End()
+			if got := freeShipping(ctx, span, httptest.NewRequest("POST", "/ship?"+tt.query, nil)); got != tt.want {
+				t.Fatalf("freeShipping(%s) = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeterministicQuoteDependsOnlyOnItemCount(t *testing.T) {
+	sr := useTestShipping(t, NewRNG(1))
+	setForTest(t, &config.QuoteURL, unreachableURL(t))
+
+	quotes := func() map[float64]bool {
+		seen := map[float64]bool{}
+		for range 10 {
+			quote, _, err := createQuoteFromCount(context.Background(), 3, 0, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen[quote] = true
+		}
+		return seen
+	}
+
+	setForTest(t, &config.QuoteDeterministic, true)
+	// 5.99 base + 3 * 1.50 per item
+	if seen := quotes(); len(seen) != 1 || !seen[10.49] {
+		t.Fatalf("deterministic quotes for 3 items = %v, want only 10.49", seen)
+	}
+	if !spanAttr(t, sr, "createQuoteFromCount", "app.quote.deterministic").AsBool() {
+		t.Fatal("quote span not marked deterministic")
+	}
+
+	config.QuoteDeterministic = false
+	if seen := quotes(); len(seen) < 2 {
+		t.Fatalf("jittered quotes for 3 items = %v, want them to vary", seen)
+	}
+}
+
+func TestQuoteSourceCounted(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		quoteURL   func(*testing.T) string
+		wantSource string
+	}{
+		{name: "external", quoteURL: func(t *testing.T) string { return jsonServer(t, `{"cost_usd": 12.34}`).URL }, wantSource: "external"},
+		{name: "fallback", quoteURL: unreachableURL, wantSource: "local"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestShipping(t, fixedRNG{n: 1})
+			mp, reader := newTestMeterProvider(t)
+			initShippingMetrics(mp)
+			setForTest(t, &config.QuoteURL, tt.quoteURL(t))
+
+			if _, _, err := createQuoteFromCount(context.Background(), 2, 0, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, source := range []string{"external", "local"} {
+				want := int64(0)
+				if source == tt.wantSource {
+					want = 1
+				}
+				if got := counterValueWith(t, reader, "app.shipping.quote.source", attribute.String("source", source)); got != want {
+					t.Errorf("app.shipping.quote.source{source=%s} = %d, want %d", source, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestQuoteCallPropagatesWithoutGlobalPropagator(t *testing.T) {
+	useTestShipping(t, fixedRNG{n: 1})
+	old := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	t.Cleanup(func() { otel.SetTextMapPropagator(old) })
+	tp, _ := newTestTracerProvider(t)
+	setForTest(t, &quoteClient, newQuoteClient(tp, metricnoop.NewMeterProvider()))
+
+	traceparent := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get("traceparent")
+		fmt.Fprint(w, `{"cost_usd": 12.34}`)
+	}))
+	t.Cleanup(srv.Close)
+	setForTest(t, &config.QuoteURL, srv.URL)
+
+	ctx, span := tp.Tracer("shipping").Start(context.Background(), "GetQuote")
+	defer span.End()
+	if _, _, err := createQuoteFromCount(ctx, 2, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	got := <-traceparent
+	if want := span.SpanContext().TraceID().String(); !strings.Contains(got, want) {
+		t.Fatalf("quote service got traceparent %q, want one carrying trace %s", got, want)
+	}
+}
@@ -0,0 +1,48 @@
+package services
+
+import (
+	"log/slog"
+	"maps"
+	"otel-mock/config"
+	"slices"
+)
+
+// logEffectiveConfig emits one record with the resolved settings a service
+// runs with, so a wrong URL or exporter shows up at startup. Nothing here is
+// secret, so it is logged as-is.
+func logEffectiveConfig(logger *slog.Logger) {
+	urls := config.ServiceURLs()
+	urlAttrs := make([]any, 0, len(urls))
+	for _, name := range slices.Sorted(maps.Keys(urls)) {
+		urlAttrs = append(urlAttrs, slog.String(name, urls[name]))
+	}
+
+	logger.Info("Effective configuration",
+		slog.Group("urls", urlAttrs...),
+		slog.String("redis.addr", config.RedisAddr),
+		slog.String("kafka.brokers", config.KafkaBrokers),
+		slog.Int("kafka.partitions", config.KafkaPartitions),
+		slog.Group("otlp",
+			slog.String("endpoint", config.OTLPEndpoint),
+			slog.String("protocol", config.OTLPProtocol),
+			slog.String("compression", config.OTLPCompression),
+		),
+		slog.Group("sampling",
+			slog.String("sampler", config.TracesSampler),
+			slog.String("arg", config.TracesSamplerArg),
+		),
+		slog.String("telemetry.exporter", config.TelemetryExporter),
+		slog.String("metrics.exporter", config.MetricsExporter),
+		slog.String("deployment.environment", config.DeploymentEnvironment),
+		slog.String("region", config.Region),
+		slog.String("base_currency", config.BaseCurrency),
+		slog.String("rand_seed", config.RandSeed),
+		slog.Bool("dry_run", config.DryRun),
+		slog.Duration("http.client_timeout", config.HTTPClientTimeout),
+		slog.Int("retry.max_attempts", config.RetryMaxAttempts),
+		slog.Float64("consumer.failure_rate", config.ConsumerFailureRate),
+	)
+	if config.OTLPProtocol != "grpc" {
+		logger.Warn("OTLP protocol not supported by the Go exporters, using grpc", "protocol", config.OTLPProtocol)
+	}
+}
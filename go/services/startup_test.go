@@ -0,0 +1,62 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"otel-mock/config"
+)
+
+func TestEffectiveConfigFields(t *testing.T) {
+	setForTest(t, &config.OTLPEndpoint, "collector:4317")
+	setForTest(t, &config.OTLPProtocol, "grpc")
+	setForTest(t, &config.TracesSampler, "traceidratio")
+	setForTest(t, &config.TracesSamplerArg, "0.25")
+	setForTest(t, &config.CartURL, "http://cart:8084")
+	setForTest(t, &config.RandSeed, "42")
+	setForTest(t, &config.DryRun, true)
+
+	var buf bytes.Buffer
+	logEffectiveConfig(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	var record struct {
+		Msg  string            `json:"msg"`
+		URLs map[string]string `json:"urls"`
+		OTLP struct {
+			Endpoint string `json:"endpoint"`
+			Protocol string `json:"protocol"`
+		} `json:"otlp"`
+		Sampling struct {
+			Sampler string `json:"sampler"`
+			Arg     string `json:"arg"`
+		} `json:"sampling"`
+		RedisAddr string `json:"redis.addr"`
+		RandSeed  string `json:"rand_seed"`
+		DryRun    bool   `json:"dry_run"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("banner is not a single JSON record: %v\n%s", err, buf.String())
+	}
+	if record.Msg != "Effective configuration" ||
+		record.URLs["cart"] != "http://cart:8084" ||
+		record.OTLP.Endpoint != "collector:4317" || record.OTLP.Protocol != "grpc" ||
+		record.Sampling.Sampler != "traceidratio" || record.Sampling.Arg != "0.25" ||
+		record.RedisAddr != config.RedisAddr ||
+		record.RandSeed != "42" || !record.DryRun {
+		t.Fatalf("unexpected banner: %s", buf.String())
+	}
+}
+
+func TestEffectiveConfigWarnsOnUnsupportedProtocol(t *testing.T) {
+	setForTest(t, &config.OTLPProtocol, "http/protobuf")
+
+	var buf bytes.Buffer
+	logEffectiveConfig(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	if !strings.Contains(buf.String(), `"protocol":"http/protobuf"`) || !strings.Contains(buf.String(), "not supported") {
+		t.Fatalf("no warning about the unsupported protocol:\n%s", buf.String())
+	}
+}
@@ -2,10 +2,10 @@
  * Browser Simulator - Mocks browser-side OpenTelemetry patterns
  */
 const http = require('http');
-const { initTelemetry, shutdown, emitLog, trace, propagation, context, SpanKind, SpanStatusCode } = require('./common/telemetry');
+const { initTelemetry, shutdown, emitLog, regionalEnv, trace, propagation, context, SpanKind, SpanStatusCode } = require('./common/telemetry');
 
 const PORT = process.env.PORT || 8090;
-const FRONTEND_URL = process.env.FRONTEND_URL || 'http://localhost:8080';
+const FRONTEND_URL = regionalEnv('FRONTEND_URL', 'http://localhost:8080');
 
 const { tracer, meter, logger } = initTelemetry('browser-frontend');
 
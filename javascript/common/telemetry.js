@@ -15,6 +15,18 @@ let sdk = null;
 let loggerProvider = null;
 let hostMetrics = null;
 
+const REGION = process.env.REGION || '';
+
+// Prefers KEY_<REGION> (e.g. CART_URL_EU for REGION=eu) over KEY when REGION is set
+function regionalEnv(key, fallback) {
+    if (REGION) {
+        const suffix = REGION.toUpperCase().replace(/-/g, '_');
+        const value = process.env[`${key}_${suffix}`];
+        if (value) return value;
+    }
+    return process.env[key] || fallback;
+}
+
 function initTelemetry(defaultServiceName) {
     const serviceName = process.env.OTEL_SERVICE_NAME || defaultServiceName;
     const otlpEndpoint = process.env.OTEL_EXPORTER_OTLP_ENDPOINT_HTTP ||
@@ -25,6 +37,7 @@ function initTelemetry(defaultServiceName) {
         'service.name': serviceName,
         'service.version': '1.0.0',
         'telemetry.sdk.language': 'javascript',
+        ...(REGION && { 'cloud.region': REGION }),
     });
 
     const traceExporter = new OTLPTraceExporter({ url: `${otlpEndpoint}/v1/traces` });
@@ -106,6 +119,7 @@ module.exports = {
     initTelemetry,
     shutdown,
     emitLog,
+    regionalEnv,
     trace,
     metrics,
     logs,
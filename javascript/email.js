@@ -16,7 +16,10 @@ const server = http.createServer((req, res) => {
     const parsedUrl = url.parse(req.url, true);
     const ctx = propagation.extract(context.active(), req.headers);
 
-    if (parsedUrl.pathname === '/send' && req.method === 'POST') {
+    if (parsedUrl.pathname === '/health') {
+        res.writeHead(200, { 'Content-Type': 'application/json' });
+        res.end('{"status":"ok"}');
+    } else if (parsedUrl.pathname === '/send' && req.method === 'POST') {
         handleSendEmail(req, res, ctx, parsedUrl.query);
     } else {
         res.writeHead(404);
@@ -34,7 +37,9 @@ function handleSendEmail(req, res, parentCtx, query) {
 
     context.with(trace.setSpan(parentCtx, span), () => {
         try {
-            const orderId = query.order_id || randomUUID();
+            const baggage = propagation.getBaggage(trace.setSpan(parentCtx, span));
+            // Checkout puts the order ID in baggage rather than the query string
+            const orderId = query.order_id || baggage?.getEntry('order.id')?.value || randomUUID();
             const userId = query.user_id || `user-${Math.floor(Math.random() * 10000)}`;
             const email = query.email || `${userId}@example.com`;
 
@@ -46,7 +51,6 @@ function handleSendEmail(req, res, parentCtx, query) {
             });
 
             // Read baggage
-            const baggage = propagation.getBaggage(trace.setSpan(parentCtx, span));
             if (baggage) {
                 const sessionId = baggage.getEntry('session.id');
                 if (sessionId) span.setAttribute('session.id', sessionId.value);
@@ -1,9 +1,10 @@
 /**
  * Frontend Service - Routes to backend services
  */
+const crypto = require('crypto');
 const http = require('http');
 const url = require('url');
-const { initTelemetry, shutdown, emitLog, trace, propagation, context, SpanKind } = require('./common/telemetry');
+const { initTelemetry, shutdown, emitLog, regionalEnv, trace, propagation, context, SpanKind } = require('./common/telemetry');
 
 const PORT = process.env.PORT || 8080;
 const { tracer, meter, logger } = initTelemetry('frontend');
@@ -11,15 +12,15 @@ const { tracer, meter, logger } = initTelemetry('frontend');
 const requestCounter = meter.createCounter('app.frontend.requests', { unit: '{requests}' });
 
 const SERVICES = {
-    checkout: process.env.CHECKOUT_URL || 'http://localhost:8083',
-    cart: process.env.CART_URL || 'http://localhost:8084',
-    productCatalog: process.env.PRODUCT_CATALOG_URL || 'http://localhost:8085',
-    recommendation: process.env.RECOMMENDATION_URL || 'http://localhost:8086',
-    ad: process.env.AD_URL || 'http://localhost:8087',
-    payment: process.env.PAYMENT_URL || 'http://localhost:8081',
-    shipping: process.env.SHIPPING_URL || 'http://localhost:8082',
-    email: process.env.EMAIL_URL || 'http://localhost:8088',
-    currency: process.env.CURRENCY_URL || 'http://localhost:8089',
+    checkout: regionalEnv('CHECKOUT_URL', 'http://localhost:8083'),
+    cart: regionalEnv('CART_URL', 'http://localhost:8084'),
+    productCatalog: regionalEnv('PRODUCT_CATALOG_URL', 'http://localhost:8085'),
+    recommendation: regionalEnv('RECOMMENDATION_URL', 'http://localhost:8086'),
+    ad: regionalEnv('AD_URL', 'http://localhost:8087'),
+    payment: regionalEnv('PAYMENT_URL', 'http://localhost:8081'),
+    shipping: regionalEnv('SHIPPING_URL', 'http://localhost:8082'),
+    email: regionalEnv('EMAIL_URL', 'http://localhost:8088'),
+    currency: regionalEnv('CURRENCY_URL', 'http://localhost:8089'),
 };
 
 const server = http.createServer(async (req, res) => {
@@ -71,8 +72,12 @@ const server = http.createServer(async (req, res) => {
                 res.writeHead(200, { 'Content-Type': 'application/json' });
                 res.end(response);
             } else if (path === '/api/checkout') {
-                emitLog(logger, 'Processing checkout request');
-                const response = await makeRequest('POST', `${SERVICES.checkout}/checkout`, span);
+                // Keep the caller's session if it sent one, otherwise start a new one
+                const sessionId = sessionFromBaggage(ctx) || crypto.randomUUID();
+                span.setAttribute('session.id', sessionId);
+                emitLog(logger, 'Processing checkout request', { 'session.id': sessionId });
+                const response = await context.with(withSessionBaggage(context.active(), sessionId),
+                    () => makeRequest('POST', `${SERVICES.checkout}/checkout`, span));
                 res.writeHead(200, { 'Content-Type': 'application/json' });
                 res.end(response);
             } else if (path === '/api/ads') {
@@ -104,6 +109,18 @@ const server = http.createServer(async (req, res) => {
     }
 });
 
+function sessionFromBaggage(ctx) {
+    const entry = propagation.getBaggage(ctx)?.getEntry('session.id');
+    return entry ? entry.value : null;
+}
+
+// withSessionBaggage adds session.id to the context's baggage so it propagates
+// to downstream services alongside the trace context
+function withSessionBaggage(ctx, sessionId) {
+    const bag = propagation.getBaggage(ctx) || propagation.createBaggage();
+    return propagation.setBaggage(ctx, bag.setEntry('session.id', { value: sessionId }));
+}
+
 function makeRequest(method, urlString, parentSpan) {
     return new Promise((resolve) => {
         const parsedUrl = url.parse(urlString);
@@ -11,15 +11,38 @@ const { tracer, meter, logger } = initTelemetry('payment');
 
 const transactionsCounter = meter.createCounter('app.payment.transactions', { unit: '{transactions}' });
 const paymentLatency = meter.createHistogram('app.payment.latency', { unit: 'ms' });
+const declinesCounter = meter.createCounter('app.payment.declines', { unit: '{declines}' });
 
 const CARD_PREFIXES = { '4': 'visa', '5': 'mastercard', '3': 'amex', '6': 'discover' };
 const LOYALTY_LEVELS = ['bronze', 'silver', 'gold', 'platinum'];
+const DECLINE_REASONS = {
+    insufficient_funds: 'insufficient funds',
+    card_expired: 'card expired',
+    fraud_hold: 'held for fraud review',
+};
+
+// PAYMENT_DECLINE_REASON declines every charge with that reason, to exercise one decline path
+const FORCED_DECLINE_REASON = process.env.PAYMENT_DECLINE_REASON || '';
+if (FORCED_DECLINE_REASON && !DECLINE_REASONS[FORCED_DECLINE_REASON]) {
+    console.warn(`Ignoring unknown PAYMENT_DECLINE_REASON ${FORCED_DECLINE_REASON}`);
+}
+
+// Returns the reason to decline this charge for, or null to approve it
+function declineReason() {
+    if (DECLINE_REASONS[FORCED_DECLINE_REASON]) return FORCED_DECLINE_REASON;
+    if (Math.random() >= 0.05) return null;
+    const reasons = Object.keys(DECLINE_REASONS);
+    return reasons[Math.floor(Math.random() * reasons.length)];
+}
 
 const server = http.createServer((req, res) => {
     const parsedUrl = url.parse(req.url, true);
     const ctx = propagation.extract(context.active(), req.headers);
 
-    if (parsedUrl.pathname === '/charge' && req.method === 'POST') {
+    if (parsedUrl.pathname === '/health') {
+        res.writeHead(200, { 'Content-Type': 'application/json' });
+        res.end('{"status":"ok"}');
+    } else if (parsedUrl.pathname === '/charge' && req.method === 'POST') {
         handleCharge(req, res, ctx);
     } else {
         res.writeHead(404);
@@ -63,14 +86,18 @@ function handleCharge(req, res, parentCtx) {
                 'app.payment.transaction.id': transactionId,
             });
 
-            if (Math.random() < 0.05) {
-                const error = new Error('Payment failed: insufficient funds');
+            const reason = declineReason();
+            if (reason) {
+                const error = new Error(`Payment failed: ${DECLINE_REASONS[reason]}`);
                 span.recordException(error);
                 span.setStatus({ code: SpanStatusCode.ERROR, message: error.message });
-                span.addEvent('payment_failed', { 'app.payment.failure_reason': 'insufficient_funds' });
+                span.setAttribute('app.payment.decline.reason', reason);
+                span.addEvent('payment_failed', { 'app.payment.failure_reason': reason });
                 transactionsCounter.add(1, { currency, status: 'failed', card_type: cardType });
-                res.writeHead(402);
-                res.end(JSON.stringify({ error: error.message }));
+                declinesCounter.add(1, { reason, card_type: cardType });
+                emitLog(logger, `Payment declined: ${reason}`, { 'app.payment.decline.reason': reason, 'amount': amount, 'currency': currency }, 'WARN');
+                res.writeHead(402, { 'Content-Type': 'application/json' });
+                res.end(JSON.stringify({ error: error.message, reason }));
             } else {
                 span.addEvent('payment_successful', { 'app.payment.transaction.id': transactionId });
                 transactionsCounter.add(1, { currency, status: 'success', card_type: cardType });
@@ -21,6 +21,10 @@ meter = metrics.get_meter("quote")
 quotes_counter = meter.create_counter("quotes", unit="{quotes}")
 quote_amount_histogram = meter.create_histogram("quote.amount", unit="USD")
 
+# Drops the per-item jitter and random handling fee so equal item counts
+# always get equal quotes
+QUOTE_DETERMINISTIC = os.getenv("QUOTE_DETERMINISTIC", "false").lower() in ("1", "t", "true")
+
 
 class QuoteRequest(BaseModel):
     numberOfItems: int = 1
@@ -58,12 +62,15 @@ def calculate_shipping_quote(num_items: int) -> dict:
         logger.info(f"Calculating quote for {num_items} items")
         
         span.set_attribute("app.quote.items.count", num_items)
+        span.set_attribute("app.quote.deterministic", QUOTE_DETERMINISTIC)
         
         base_cost = 5.99
-        per_item_cost = 1.50 + random.uniform(-0.25, 0.25)
+        per_item_cost = 1.50
+        if not QUOTE_DETERMINISTIC:
+            per_item_cost += random.uniform(-0.25, 0.25)
         total_cost = base_cost + (num_items * per_item_cost)
         
-        if random.random() < 0.2:
+        if not QUOTE_DETERMINISTIC and random.random() < 0.2:
             handling_fee = random.uniform(1.0, 3.0)
             total_cost += handling_fee
             span.add_event("handling_fee_applied", {"fee": handling_fee})
@@ -1,13 +1,17 @@
 """
 Recommendation Service - Python FastAPI
 """
+import json
 import logging
 import os
 import random
+from collections import Counter
 from typing import List, Optional
 
+import redis
 from fastapi import FastAPI, Request
 from opentelemetry import trace, metrics
+from opentelemetry.instrumentation.redis import RedisInstrumentor
 from opentelemetry.instrumentation.system_metrics import SystemMetricsInstrumentor
 
 logging.basicConfig(level=logging.INFO, format='%(asctime)s %(levelname)s [%(name)s] - %(message)s')
@@ -27,6 +31,33 @@ PRODUCTS = [
     {"id": "6E92ZMYYFZ", "name": "Mug", "categories": ["home"]},
 ]
 
+# How recommendations are picked: "random", "same_category" or "popular"
+RECO_STRATEGIES = ("random", "same_category", "popular")
+RECO_STRATEGY = os.getenv("RECO_STRATEGY", "random")
+if RECO_STRATEGY not in RECO_STRATEGIES:
+    logger.warning(f"Unknown RECO_STRATEGY {RECO_STRATEGY!r}, using random")
+    RECO_STRATEGY = "random"
+
+# How often each product has been asked about; "popular" recommends the top ones
+product_requests = Counter()
+
+# How long a user's recommendations stay cached in Redis, in seconds
+RECO_CACHE_TTL = int(os.getenv("RECO_CACHE_TTL", "300"))
+
+
+def init_redis_client() -> Optional[redis.Redis]:
+    """Connects to REDIS_ADDR (host:port) with every command traced, or
+    returns None to turn caching off when it is unset"""
+    addr = os.getenv("REDIS_ADDR")
+    if not addr:
+        return None
+    RedisInstrumentor().instrument()
+    host, _, port = addr.partition(":")
+    return redis.Redis(host=host, port=int(port or 6379), socket_timeout=1)
+
+
+reco_cache = init_redis_client()
+
 tracer = trace.get_tracer("recommendation")
 meter = metrics.get_meter("recommendation")
 recommendations_counter = meter.create_counter("app.recommendations.count", unit="{recommendations}")
@@ -50,22 +81,60 @@ async def list_recommendations(request: Request, productIds: Optional[str] = Non
     logger.info("ListRecommendations request received")
     
     exclude_ids = [pid.strip() for pid in productIds.split(",")] if productIds else []
-    recommendations = get_product_list(exclude_ids)
+    current_span.set_attribute("app.recommendation.strategy", RECO_STRATEGY)
+    recommendation_ids = get_cached_recommendations(user_id)
+    if reco_cache is not None and user_id:
+        current_span.set_attribute("cache.hit", recommendation_ids is not None)
+    if recommendation_ids is None:
+        recommendation_ids = [r["id"] for r in get_product_list(exclude_ids, RECO_STRATEGY)]
+        cache_recommendations(user_id, recommendation_ids)
     
-    current_span.set_attribute("app.recommendations.count", len(recommendations))
-    logger.info(f"Generated {len(recommendations)} recommendations")
+    current_span.set_attribute("app.recommendations.count", len(recommendation_ids))
+    logger.info(f"Generated {len(recommendation_ids)} recommendations")
     
-    return {"recommendations": [r["id"] for r in recommendations], "count": len(recommendations)}
+    return {"recommendations": recommendation_ids, "count": len(recommendation_ids)}
+
+
+def cache_key(user_id: str) -> str:
+    return f"recommendations:{user_id}"
+
 
+def get_cached_recommendations(user_id: Optional[str]) -> Optional[List[str]]:
+    """Returns the product IDs last recommended to user_id, or None on a miss,
+    when caching is off or when Redis can't be reached"""
+    if reco_cache is None or not user_id:
+        return None
+    try:
+        cached = reco_cache.get(cache_key(user_id))
+    except redis.RedisError as e:
+        logger.warning(f"Recommendation cache lookup failed: {e}")
+        return None
+    return json.loads(cached) if cached is not None else None
 
-def get_product_list(exclude_ids: List[str]) -> List[dict]:
+
+def cache_recommendations(user_id: Optional[str], product_ids: List[str]):
+    if reco_cache is None or not user_id:
+        return
+    try:
+        reco_cache.set(cache_key(user_id), json.dumps(product_ids), ex=RECO_CACHE_TTL)
+    except redis.RedisError as e:
+        logger.warning(f"Recommendation cache store failed: {e}")
+
+
+def get_product_list(exclude_ids: List[str], strategy: str = "random") -> List[dict]:
     with tracer.start_as_current_span("get_product_list", kind=trace.SpanKind.INTERNAL) as span:
-        logger.info(f"Filtering products, excluding {len(exclude_ids)} items")
+        logger.info(f"Filtering products, excluding {len(exclude_ids)} items, strategy {strategy}")
         
         span.set_attribute("exclude.count", len(exclude_ids))
+        span.set_attribute("app.recommendation.strategy", strategy)
         available = [p for p in PRODUCTS if p["id"] not in exclude_ids]
         sample_size = min(5, len(available))
-        recommendations = random.sample(available, sample_size)
+        if strategy == "same_category":
+            recommendations = recommend_same_category(available, exclude_ids, sample_size)
+        elif strategy == "popular":
+            recommendations = recommend_popular(available, exclude_ids, sample_size)
+        else:
+            recommendations = random.sample(available, sample_size)
         
         span.set_attribute("app.products.count", len(recommendations))
         span.add_event("recommendations_generated", {"count": len(recommendations)})
@@ -75,6 +144,32 @@ def get_product_list(exclude_ids: List[str]) -> List[dict]:
         return recommendations
 
 
+def get_product_categories(product_ids: List[str]) -> set:
+    with tracer.start_as_current_span("get_product_categories", kind=trace.SpanKind.INTERNAL) as span:
+        categories = {c for p in PRODUCTS if p["id"] in product_ids for c in p["categories"]}
+        span.set_attribute("app.product.ids", product_ids)
+        span.set_attribute("app.product.categories", sorted(categories))
+        return categories
+
+
+def recommend_same_category(available: List[dict], product_ids: List[str], limit: int) -> List[dict]:
+    """Recommends products sharing a category with the input products, or
+    random ones when there are no input products to go on"""
+    if not product_ids:
+        return random.sample(available, limit)
+    categories = get_product_categories(product_ids)
+    matching = [p for p in available if categories.intersection(p["categories"])]
+    return random.sample(matching, min(limit, len(matching)))
+
+
+def recommend_popular(available: List[dict], product_ids: List[str], limit: int) -> List[dict]:
+    """Recommends the products asked about most often so far; ties keep
+    catalog order"""
+    product_requests.update(product_ids)
+    ranked = sorted(available, key=lambda p: -product_requests[p["id"]])
+    return ranked[:limit]
+
+
 @app.on_event("startup")
 async def startup_event():
     SystemMetricsInstrumentor().instrument()
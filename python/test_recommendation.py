@@ -0,0 +1,149 @@
+"""
+Recommendation Service tests - run with `python3 -m unittest` from python/
+"""
+import asyncio
+import json
+import unittest
+from collections import Counter
+from unittest import mock
+
+import redis
+
+import recommendation
+
+
+class FakeRedis:
+    """Keeps cached values in a dict and remembers the TTL each was set with"""
+
+    def __init__(self, fail=False):
+        self.values = {}
+        self.ttls = {}
+        self.fail = fail
+
+    def get(self, key):
+        if self.fail:
+            raise redis.ConnectionError("connection refused")
+        return self.values.get(key)
+
+    def set(self, key, value, ex=None):
+        if self.fail:
+            raise redis.ConnectionError("connection refused")
+        self.values[key] = value
+        self.ttls[key] = ex
+
+
+def list_recommendations(user_id=None, product_ids=None):
+    """Calls the handler and returns its response with the attributes it set
+    on the current span"""
+    span = mock.MagicMock()
+    with mock.patch.object(recommendation.trace, "get_current_span", return_value=span):
+        response = asyncio.run(recommendation.list_recommendations(None, productIds=product_ids, user_id=user_id))
+    attributes = {c.args[0]: c.args[1] for c in span.set_attribute.call_args_list}
+    for c in span.set_attributes.call_args_list:
+        attributes.update(c.args[0])
+    return response, attributes
+
+
+class RecommendationCacheTest(unittest.TestCase):
+    def use_cache(self, cache):
+        patcher = mock.patch.object(recommendation, "reco_cache", cache)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+        return cache
+
+    def test_miss_computes_and_stores_with_ttl(self):
+        cache = self.use_cache(FakeRedis())
+
+        response, attributes = list_recommendations(user_id="user-1")
+
+        self.assertFalse(attributes["cache.hit"])
+        self.assertEqual(response["count"], 5)
+        key = recommendation.cache_key("user-1")
+        self.assertEqual(json.loads(cache.values[key]), response["recommendations"])
+        self.assertEqual(cache.ttls[key], recommendation.RECO_CACHE_TTL)
+
+    def test_hit_skips_computing(self):
+        cache = self.use_cache(FakeRedis())
+        cache.values[recommendation.cache_key("user-1")] = json.dumps(["OLJCESPC7Z", "6E92ZMYYFZ"])
+
+        with mock.patch.object(recommendation, "get_product_list") as get_product_list:
+            response, attributes = list_recommendations(user_id="user-1")
+
+        self.assertTrue(attributes["cache.hit"])
+        get_product_list.assert_not_called()
+        self.assertEqual(response, {"recommendations": ["OLJCESPC7Z", "6E92ZMYYFZ"], "count": 2})
+
+    def test_requests_without_user_are_not_cached(self):
+        cache = self.use_cache(FakeRedis())
+
+        response, attributes = list_recommendations()
+
+        self.assertNotIn("cache.hit", attributes)
+        self.assertEqual(response["count"], 5)
+        self.assertEqual(cache.values, {})
+
+    def test_unreachable_redis_falls_back_to_computing(self):
+        self.use_cache(FakeRedis(fail=True))
+
+        response, attributes = list_recommendations(user_id="user-1")
+
+        self.assertFalse(attributes["cache.hit"])
+        self.assertEqual(response["count"], 5)
+
+    def test_caching_is_off_without_redis(self):
+        self.use_cache(None)
+
+        response, attributes = list_recommendations(user_id="user-1")
+
+        self.assertNotIn("cache.hit", attributes)
+        self.assertEqual(response["count"], 5)
+
+
+class RecommendationStrategyTest(unittest.TestCase):
+    def use_strategy(self, strategy):
+        for name, value in (("RECO_STRATEGY", strategy), ("reco_cache", None), ("product_requests", Counter())):
+            patcher = mock.patch.object(recommendation, name, value)
+            patcher.start()
+            self.addCleanup(patcher.stop)
+
+    def test_random_excludes_input_products(self):
+        self.use_strategy("random")
+
+        response, attributes = list_recommendations(product_ids="OLJCESPC7Z,6E92ZMYYFZ")
+
+        self.assertEqual(attributes["app.recommendation.strategy"], "random")
+        self.assertEqual(response["count"], 5)
+        self.assertEqual(len(set(response["recommendations"])), 5)
+        self.assertFalse({"OLJCESPC7Z", "6E92ZMYYFZ"} & set(response["recommendations"]))
+
+    def test_same_category_shares_a_category(self):
+        self.use_strategy("same_category")
+
+        # Sunglasses are accessories, so only the Watch matches
+        response, attributes = list_recommendations(product_ids="OLJCESPC7Z")
+
+        self.assertEqual(attributes["app.recommendation.strategy"], "same_category")
+        self.assertEqual(response["recommendations"], ["1YMWWN1N4O"])
+
+    def test_same_category_without_input_falls_back_to_random(self):
+        self.use_strategy("same_category")
+
+        response, _ = list_recommendations()
+
+        self.assertEqual(response["count"], 5)
+
+    def test_popular_ranks_most_requested_first(self):
+        self.use_strategy("popular")
+        list_recommendations(product_ids="6E92ZMYYFZ")
+        list_recommendations(product_ids="6E92ZMYYFZ")
+        list_recommendations(product_ids="L9ECAV7KIM")
+
+        response, attributes = list_recommendations(product_ids="OLJCESPC7Z")
+
+        self.assertEqual(attributes["app.recommendation.strategy"], "popular")
+        self.assertEqual(response["recommendations"][:2], ["6E92ZMYYFZ", "L9ECAV7KIM"])
+        self.assertNotIn("OLJCESPC7Z", response["recommendations"])
+
+
+if __name__ == "__main__":
+    unittest.main()